@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+
+	logr "github.com/sirupsen/logrus"
+)
+
+// Keys of the structured fields shared by all the packages of this module.
+const (
+	// FileKey is the configuration file a message relates to.
+	FileKey = "file"
+	// EngineKey is the secret engine a message relates to.
+	EngineKey = "engine"
+	// KeyPathKey is the dotted path of the configuration key a message relates to.
+	KeyPathKey = "keyPath"
+	// ErrorKey holds the error that caused a message.
+	ErrorKey = "error"
+)
+
+// Logger is a small leveled, structured logger. keysAndValues alternate keys
+// and values, in the same way as log/slog.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+	// With returns a logger that adds keysAndValues to every message.
+	With(keysAndValues ...interface{}) Logger
+}
+
+// Default returns a Logger writing to the standard logrus logger.
+func Default() Logger {
+	return NewLogrus(logr.StandardLogger())
+}
+
+// OrDefault returns l, or Default() if l is nil.
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return Default()
+	}
+	return l
+}
+
+// NewLogrus adapts a logrus logger or entry.
+func NewLogrus(l logr.FieldLogger) Logger {
+	return &logrusLogger{entry: l.WithFields(logr.Fields{})}
+}
+
+type logrusLogger struct {
+	entry *logr.Entry
+}
+
+func (l *logrusLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.entry.WithFields(fields(keysAndValues)).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.entry.WithFields(fields(keysAndValues)).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.entry.WithFields(fields(keysAndValues)).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.entry.WithFields(fields(keysAndValues)).Error(msg)
+}
+
+func (l *logrusLogger) With(keysAndValues ...interface{}) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(fields(keysAndValues))}
+}
+
+func fields(keysAndValues []interface{}) logr.Fields {
+	f := logr.Fields{}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		if i+1 == len(keysAndValues) {
+			f["!BADKEY"] = keysAndValues[i]
+			break
+		}
+		f[key] = keysAndValues[i+1]
+	}
+	return f
+}
+
+// Discard returns a Logger that drops every message.
+func Discard() Logger {
+	return discard{}
+}
+
+type discard struct{}
+
+func (discard) Debug(string, ...interface{}) {}
+func (discard) Info(string, ...interface{})  {}
+func (discard) Warn(string, ...interface{})  {}
+func (discard) Error(string, ...interface{}) {}
+func (d discard) With(...interface{}) Logger { return d }
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l. Secret engines log with the
+// logger found in the context they are created with.
+func NewContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or Default() if there is none.
+func FromContext(ctx context.Context) Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(Logger); ok {
+			return l
+		}
+	}
+	return Default()
+}
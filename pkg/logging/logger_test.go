@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	logr "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogrusLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := logr.New()
+	l.SetOutput(&buf)
+	l.SetLevel(logr.DebugLevel)
+	l.SetFormatter(&logr.TextFormatter{DisableTimestamp: true})
+
+	logger := NewLogrus(l).With(EngineKey, "vault")
+	logger.Debug("reading secret", KeyPathKey, "services.echo.password")
+	assert.Equal(t, "level=debug msg=\"reading secret\" engine=vault keyPath=services.echo.password\n", buf.String())
+
+	buf.Reset()
+	logger.Error("odd", FileKey)
+	assert.Contains(t, buf.String(), "!BADKEY=file")
+}
+
+func TestContext(t *testing.T) {
+	assert.NotNil(t, FromContext(context.TODO()))
+	d := Discard()
+	assert.Equal(t, d, FromContext(NewContext(context.TODO(), d)))
+	assert.Equal(t, d, OrDefault(d))
+	assert.NotNil(t, OrDefault(nil))
+}
@@ -0,0 +1,37 @@
+//go:build go1.21
+
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlog adapts a log/slog logger.
+func NewSlog(l *slog.Logger) Logger {
+	return &slogLogger{logger: l}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l *slogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelDebug, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelInfo, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelWarn, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelError, msg, keysAndValues...)
+}
+
+func (l *slogLogger) With(keysAndValues ...interface{}) Logger {
+	return &slogLogger{logger: l.logger.With(keysAndValues...)}
+}
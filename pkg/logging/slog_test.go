@@ -0,0 +1,28 @@
+//go:build go1.21
+
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+
+	logger := NewSlog(slog.New(h)).With(FileKey, "/opt/spinnaker/config/gate.yml")
+	logger.Warn("config file not present")
+	assert.Equal(t, "level=WARN msg=\"config file not present\" file=/opt/spinnaker/config/gate.yml\n", buf.String())
+}
@@ -3,7 +3,6 @@ package secrets
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"strings"
 )
@@ -41,10 +40,24 @@ func NewAwsSecretsManagerDecrypter(ctx context.Context, isFile bool, params stri
 }
 
 func (a *AwsSecretsManagerDecrypter) Decrypt() (string, error) {
-	secretValue, err := a.awsSecretsManagerClient.FetchSecret(a.secretName)
+	return a.DecryptContext(context.Background())
+}
+
+func (a *AwsSecretsManagerDecrypter) DecryptContext(ctx context.Context) (string, error) {
+	v, err := a.DecryptValue(ctx)
 	if err != nil {
 		return "", err
 	}
+	return FormatValue(v)
+}
+
+// DecryptValue returns the secret, or the value of its key as found in the JSON
+// of the secret, see StructuredDecrypter.
+func (a *AwsSecretsManagerDecrypter) DecryptValue(ctx context.Context) (interface{}, error) {
+	secretValue, err := a.awsSecretsManagerClient.FetchSecret(ctx, a.secretName)
+	if err != nil {
+		return nil, err
+	}
 
 	if a.isFile { // The secret is assumed to be a file so extract the binary data from the secretValue
 		if len(secretValue.SecretBinary) > 0 { // if the binary data has bytes then its a binary blob
@@ -68,16 +81,12 @@ func (a *AwsSecretsManagerDecrypter) IsFile() bool {
 func (a *AwsSecretsManagerDecrypter) parse(params string) error {
 	// Parse the user supplied params to get a map of the k,v pairs
 	var data = make(map[string]string)
-	entries := strings.Split(params, "!")
-	if len(entries) < 2 {
-		return fmt.Errorf(GenericMalformedKeyError)
+	entries, err := ParseParams(params)
+	if err != nil || len(entries) < 2 {
+		return malformed("secrets-manager", GenericMalformedKeyError)
 	}
 	for _, entry := range entries {
-		kvPair := strings.SplitN(entry, ":", 2)
-		if len(kvPair) != 2 {
-			return fmt.Errorf(GenericMalformedKeyError)
-		}
-		data[kvPair[0]] = kvPair[1]
+		data[entry.Key] = entry.Value
 	}
 
 	// Validate and save the required / known fields
@@ -85,14 +94,14 @@ func (a *AwsSecretsManagerDecrypter) parse(params string) error {
 		a.region = region
 		delete(data, Region)
 	} else {
-		return fmt.Errorf(RegionMissingError)
+		return malformed("secrets-manager", RegionMissingError)
 	}
 
 	if secretName := data[SecretName]; secretName != "" {
 		a.secretName = secretName
 		delete(data, SecretName)
 	} else {
-		return fmt.Errorf(SecretNameMissingError)
+		return malformed("secrets-manager", SecretNameMissingError)
 	}
 
 	if secretKey := data[SecretKey]; secretKey != "" {
@@ -101,44 +110,49 @@ func (a *AwsSecretsManagerDecrypter) parse(params string) error {
 	}
 
 	if a.isFile && a.secretKey != "" {
-		return fmt.Errorf(EncryptedFilesShouldNotSpecifyKeyError)
+		return malformed("secrets-manager", EncryptedFilesShouldNotSpecifyKeyError)
 	}
 
 	if len(data) > 0 {
-		return fmt.Errorf(GenericMalformedKeyError)
+		return malformed("secrets-manager", GenericMalformedKeyError)
 	}
 
 	return nil
 }
 
-func parseBinaryFile(secretValue *secretsmanager.GetSecretValueOutput) (string, error) {
+func parseBinaryFile(secretValue *secretsmanager.GetSecretValueOutput) (interface{}, error) {
 	return ToTempFile(secretValue.SecretBinary)
 }
 
-func parsePlaintextFile(secretValue *secretsmanager.GetSecretValueOutput) (string, error) {
+func parsePlaintextFile(secretValue *secretsmanager.GetSecretValueOutput) (interface{}, error) {
 	return ToTempFile([]byte(*secretValue.SecretString))
 }
 
-func parseSecretValue(secretValue *secretsmanager.GetSecretValueOutput) (string, error) {
+func parseSecretValue(secretValue *secretsmanager.GetSecretValueOutput) (interface{}, error) {
 	return *secretValue.SecretString, nil
 }
 
-func parseSecretKVPair(secretValue *secretsmanager.GetSecretValueOutput, key string) (string, error) {
+// parseSecretKVPair returns the value of key in the JSON of the secret, either
+// a string or a structured value, see StructuredDecrypter.
+func parseSecretKVPair(secretValue *secretsmanager.GetSecretValueOutput, key string) (interface{}, error) {
 	if secretValue.SecretString == nil {
-		return "", fmt.Errorf(MalformedKVPairSecretPayload)
+		return nil, newError(nil, "secrets-manager", nil, MalformedKVPairSecretPayload)
 	}
-	valueAsByteArray := []byte(*secretValue.SecretString)
 	kvPairs := make(map[string]interface{})
-	err := json.Unmarshal(valueAsByteArray, &kvPairs)
+	decoder := json.NewDecoder(strings.NewReader(*secretValue.SecretString))
+	decoder.UseNumber()
+	err := decoder.Decode(&kvPairs)
 
 	if err != nil {
-		return "", fmt.Errorf(MalformedKVPairSecretPayload)
+		return nil, newError(nil, "secrets-manager", nil, MalformedKVPairSecretPayload)
 	}
 
-	untypedValue := kvPairs[key]
-	valueForKeyAsString, ok := untypedValue.(string)
-	if !ok {
-		return "", fmt.Errorf(MalformedKVPairSecretPayload)
+	untypedValue, found := kvPairs[key]
+	if !found {
+		return nil, newError(ErrNotFound, "secrets-manager", nil, MalformedKVPairSecretPayload)
+	}
+	if untypedValue == nil {
+		return nil, newError(nil, "secrets-manager", nil, MalformedKVPairSecretPayload)
 	}
-	return valueForKeyAsString, nil
+	return untypedValue, nil
 }
@@ -1,6 +1,7 @@
 package secrets
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/stretchr/testify/assert"
@@ -15,7 +16,7 @@ type MockAwsSecretsManagerClient struct {
 	payload string
 }
 
-func (m *MockAwsSecretsManagerClient) FetchSecret(secretName string) (*secretsmanager.GetSecretValueOutput, error) {
+func (m *MockAwsSecretsManagerClient) FetchSecret(ctx context.Context, secretName string) (*secretsmanager.GetSecretValueOutput, error) {
 	mockPayloadBytes, _ := ioutil.ReadFile("../../test/aws-secrets-manager/" + m.payload)
 	res := &secretsmanager.GetSecretValueOutput{}
 	err := json.Unmarshal(mockPayloadBytes, res)
@@ -173,6 +174,15 @@ func TestDecrypt(t *testing.T) {
 			expectedFile: "",
 			expectedSecret: "",
 		},
+		{
+			name: "The provided params is for a kv map and a specific key whose value is an embedded object",
+			secretKey: "foo",
+			payload: "custom.json",
+			expectedError: "",
+			isFile: false,
+			expectedFile: "",
+			expectedSecret: `{"bar":"bam"}`,
+		},
 		{
 			name: "The provided params is for a kv map and a specific key, but the configured secrets value is an embedded object and not a string",
 			secretKey: "some-secret",
@@ -1,6 +1,7 @@
 package secrets
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -9,7 +10,7 @@ import (
 )
 
 type AwsSecretsManagerClient interface {
-	FetchSecret(secretName string) (*secretsmanager.GetSecretValueOutput, error)
+	FetchSecret(ctx context.Context, secretName string) (*secretsmanager.GetSecretValueOutput, error)
 }
 
 type AwsSecretsManagerClientImpl struct{
@@ -21,7 +22,7 @@ func NewAwsSecretsManagerClient(region string) (AwsSecretsManagerClient, error)
 		Region: aws.String(region),
 	})
 	if err != nil {
-		return nil, err
+		return nil, newError(errorKind(err), "secrets-manager", err, "unable to create AWS session")
 	}
 	secretsManager := secretsmanager.New(sess)
 	client := &AwsSecretsManagerClientImpl{
@@ -30,20 +31,19 @@ func NewAwsSecretsManagerClient(region string) (AwsSecretsManagerClient, error)
 	return client, nil
 }
 
-func (a *AwsSecretsManagerClientImpl) FetchSecret(secretName string) (*secretsmanager.GetSecretValueOutput, error) {
+func (a *AwsSecretsManagerClientImpl) FetchSecret(ctx context.Context, secretName string) (*secretsmanager.GetSecretValueOutput, error) {
 	request := &secretsmanager.GetSecretValueInput{
 		SecretId: aws.String(secretName),
 	}
 
-	result, err := a.secretsManager.GetSecretValue(request)
+	result, err := a.secretsManager.GetSecretValueWithContext(ctx, request)
 
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
-			code := aerr.Code()
-			return nil, fmt.Errorf("failed to fetch secret from AWS SM, Code: %v, Err: %v", code, aerr.Error())
-		} else {
-			return nil, fmt.Errorf("failed to fetch secret from AWS SM, Err: %v", err.Error())
+			msg := fmt.Sprintf("failed to fetch secret from AWS SM, Code: %v", aerr.Code())
+			return nil, newError(errorKind(err), "secrets-manager", err, msg)
 		}
+		return nil, newError(errorKind(err), "secrets-manager", err, "failed to fetch secret from AWS SM")
 	}
 
 	return result, nil
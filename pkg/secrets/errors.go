@@ -0,0 +1,131 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/hashicorp/vault/api"
+	"google.golang.org/api/googleapi"
+)
+
+// Sentinels for the kinds of errors returned by the engines, to be checked
+// with errors.Is.
+var (
+	// ErrMalformedReference is returned for secret references missing
+	// parameters or that can't be parsed.
+	ErrMalformedReference = errors.New("malformed secret reference")
+	// ErrEngineNotRegistered is returned for references to unknown engines.
+	ErrEngineNotRegistered = errors.New("secret engine not registered")
+	// ErrAuthFailed is returned when the engine couldn't log in or when its
+	// credentials are missing or expired.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrNotFound is returned when the secret, or the key in it, doesn't exist.
+	ErrNotFound = errors.New("secret not found")
+	// ErrPermissionDenied is returned when the credentials don't grant access
+	// to the secret.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrTransient is returned for network errors, throttling and server
+	// errors, for which retrying may succeed.
+	ErrTransient = errors.New("transient error")
+)
+
+// Error is the error returned by the engines. It matches its Kind with
+// errors.Is and unwraps to the underlying error, usually from an SDK.
+type Error struct {
+	// Kind is one of the sentinels above, nil if unknown.
+	Kind   error
+	Engine string
+	Msg    string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether err is transient, so that the operation may be
+// retried.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
+
+func newError(kind error, engine string, cause error, msg string) error {
+	return &Error{Kind: kind, Engine: engine, Msg: msg, Err: cause}
+}
+
+func malformed(engine, msg string) error {
+	return newError(ErrMalformedReference, engine, nil, msg)
+}
+
+// errorKind classifies the errors of the SDKs used by the engines.
+func errorKind(err error) error {
+	if err == nil {
+		return nil
+	}
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) {
+		return statusKind(respErr.StatusCode)
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return statusKind(gErr.Code)
+	}
+	var aErr awserr.Error
+	if errors.As(err, &aErr) {
+		switch aErr.Code() {
+		case "ResourceNotFoundException", "NoSuchKey", "NoSuchBucket", "NotFound":
+			return ErrNotFound
+		case "AccessDeniedException", "AccessDenied", "Forbidden":
+			return ErrPermissionDenied
+		case "UnrecognizedClientException", "InvalidSignatureException", "ExpiredToken",
+			"ExpiredTokenException", "InvalidClientTokenId", "NoCredentialProviders":
+			return ErrAuthFailed
+		}
+		if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+			return ErrTransient
+		}
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) {
+			return statusKind(reqErr.StatusCode())
+		}
+		return nil
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) || errors.As(err, &syntaxErr) {
+		// the vault client fails to parse the empty body of some connection errors
+		return ErrTransient
+	}
+	return nil
+}
+
+func statusKind(code int) error {
+	switch {
+	case code == http.StatusUnauthorized:
+		return ErrAuthFailed
+	case code == http.StatusForbidden:
+		return ErrPermissionDenied
+	case code == http.StatusNotFound:
+		return ErrNotFound
+	case code == http.StatusTooManyRequests || code >= 500:
+		return ErrTransient
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+)
+
+func TestErrorKind(t *testing.T) {
+	cases := map[string]struct {
+		err      error
+		expected error
+	}{
+		"vault 403":         {err: &api.ResponseError{StatusCode: 403}, expected: ErrPermissionDenied},
+		"vault 401":         {err: &api.ResponseError{StatusCode: 401}, expected: ErrAuthFailed},
+		"vault 503":         {err: &api.ResponseError{StatusCode: 503}, expected: ErrTransient},
+		"vault 400":         {err: &api.ResponseError{StatusCode: 400}, expected: nil},
+		"gcs 404":           {err: &googleapi.Error{Code: 404}, expected: ErrNotFound},
+		"aws not found":     {err: awserr.New("ResourceNotFoundException", "no secret", nil), expected: ErrNotFound},
+		"aws access denied": {err: awserr.New("AccessDeniedException", "denied", nil), expected: ErrPermissionDenied},
+		"aws throttling":    {err: awserr.New("ThrottlingException", "slow down", nil), expected: ErrTransient},
+		"aws server error":  {err: awserr.NewRequestFailure(awserr.New("InternalFailure", "oops", nil), 500, "id"), expected: ErrTransient},
+		"url error":         {err: &url.Error{Op: "Get", URL: "http://vault", Err: errors.New("connection refused")}, expected: ErrTransient},
+		"json syntax error": {err: &json.SyntaxError{}, expected: ErrTransient},
+		"wrapped":           {err: fmt.Errorf("reading: %w", &api.ResponseError{StatusCode: 404}), expected: ErrNotFound},
+		"other":             {err: errors.New("some error"), expected: nil},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.expected, errorKind(c.err))
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	cause := &api.ResponseError{StatusCode: 403}
+	err := newError(errorKind(cause), "vault", cause, "error fetching secret from vault")
+	assert.True(t, errors.Is(err, ErrPermissionDenied))
+	assert.False(t, errors.Is(err, ErrNotFound))
+	assert.False(t, IsRetryable(err))
+
+	var respErr *api.ResponseError
+	assert.True(t, errors.As(err, &respErr))
+	var secretErr *Error
+	if assert.True(t, errors.As(fmt.Errorf("wrapped: %w", err), &secretErr)) {
+		assert.Equal(t, "vault", secretErr.Engine)
+	}
+	assert.Equal(t, "error fetching secret from vault: "+cause.Error(), err.Error())
+
+	_, err = NewRegistry().NewDecrypter(context.Background(), "encrypted:unknown!k:v")
+	assert.True(t, errors.Is(err, ErrEngineNotRegistered), "error was %v", err)
+	assert.EqualError(t, err, "secret engine unknown not registered")
+
+	for _, ref := range []string{"encrypted:s3!b:bucket", "encrypted:gcs!f:file", "encrypted:secrets-manager!r:us-east-1"} {
+		_, err = NewDecrypter(context.Background(), ref)
+		assert.True(t, errors.Is(err, ErrMalformedReference), "%s: error was %v", ref, err)
+	}
+}
+
+func TestVaultDecrypter_fetchSecretErrors(t *testing.T) {
+	vc := &fakeVaultClient{
+		t: t,
+		v1response: versionedResponse{
+			expectedPath: "secret/app",
+			err:          &api.ResponseError{StatusCode: 403},
+		},
+		v2response: versionedResponse{
+			expectedPath: "secret/data/app",
+			err:          &api.ResponseError{StatusCode: 403},
+		},
+	}
+	d := &VaultDecrypter{engine: "secret", path: "app", key: "key"}
+	_, err := d.fetchSecret(context.Background(), vc)
+	assert.True(t, errors.Is(err, ErrPermissionDenied), "error was %v", err)
+
+	vc.v2response.err = nil
+	_, err = d.fetchSecret(context.Background(), vc)
+	assert.True(t, errors.Is(err, ErrNotFound), "error was %v", err)
+}
@@ -3,9 +3,9 @@ package secrets
 import (
 	"cloud.google.com/go/storage"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"strings"
 )
 
 type GcsSecret struct {
@@ -15,12 +15,11 @@ type GcsDecrypter struct {
 	bucket   string
 	filepath string
 	key      string
-	ctx      context.Context
 	isFile   bool
 }
 
 func NewGcsDecrypter(ctx context.Context, isFile bool, params string) (Decrypter, error) {
-	gcs := &GcsDecrypter{isFile: isFile, ctx: ctx}
+	gcs := &GcsDecrypter{isFile: isFile}
 	if err := gcs.parse(params); err != nil {
 		return nil, err
 	}
@@ -28,11 +27,29 @@ func NewGcsDecrypter(ctx context.Context, isFile bool, params string) (Decrypter
 }
 
 func (gcs *GcsDecrypter) Decrypt() (string, error) {
-	sec, err := gcs.fetchSecret(gcs.ctx)
+	return gcs.DecryptContext(context.Background())
+}
+
+func (gcs *GcsDecrypter) DecryptContext(ctx context.Context) (string, error) {
+	v, err := gcs.DecryptValue(ctx)
+	if err != nil {
+		return "", err
+	}
+	return FormatValue(v)
+}
+
+// DecryptValue returns the value of the YAML key of the file, or the file
+// itself, see StructuredDecrypter.
+func (gcs *GcsDecrypter) DecryptValue(ctx context.Context) (interface{}, error) {
+	sec, err := gcs.fetchSecret(ctx)
 	if err != nil || !gcs.isFile {
 		return sec, err
 	}
-	return ToTempFile([]byte(sec))
+	content, err := FormatValue(sec)
+	if err != nil {
+		return nil, err
+	}
+	return ToTempFile([]byte(content))
 }
 
 func (gcs *GcsDecrypter) IsFile() bool {
@@ -40,46 +57,45 @@ func (gcs *GcsDecrypter) IsFile() bool {
 }
 
 func (gcs *GcsDecrypter) parse(params string) error {
-	tokens := strings.Split(params, "!")
-	for _, element := range tokens {
-		kv := strings.Split(element, ":")
-		if len(kv) == 2 {
-			switch kv[0] {
-			case "b":
-				gcs.bucket = kv[1]
-			case "f":
-				gcs.filepath = kv[1]
-			case "k":
-				gcs.key = kv[1]
-			}
-		}
+	p, err := engineParams("gcs", params)
+	if err != nil {
+		return err
 	}
+	gcs.bucket, gcs.filepath, gcs.key = p["b"], p["f"], p["k"]
 
 	if gcs.bucket == "" {
-		return fmt.Errorf("secret format error - 'b' for bucket is required")
+		return malformed("gcs", "secret format error - 'b' for bucket is required")
 	}
 	if gcs.filepath == "" {
-		return fmt.Errorf("secret format error - 'f' for file is required")
+		return malformed("gcs", "secret format error - 'f' for file is required")
 	}
 	return nil
 }
 
-func (gcs *GcsDecrypter) fetchSecret(ctx context.Context) (string, error) {
+func (gcs *GcsDecrypter) fetchSecret(ctx context.Context) (interface{}, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		return "", fmt.Errorf("unable to create GCS client: %s", err.Error())
+		return nil, newError(ErrAuthFailed, "gcs", err, "unable to create GCS client")
 	}
 	bucket := client.Bucket(gcs.bucket)
 	r, err := bucket.Object(gcs.filepath).NewReader(ctx)
 	if err != nil {
-		return "", fmt.Errorf("unable to get reader for bucket: %s, file: %s, error: %v", gcs.bucket, gcs.filepath, err)
+		return nil, newError(gcsErrorKind(err), "gcs", err, fmt.Sprintf("unable to get reader for bucket: %s, file: %s", gcs.bucket, gcs.filepath))
 	}
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
-		return "", fmt.Errorf("unable to download file from bucket: %s, file: %s, error: %v", gcs.bucket, gcs.filepath, err)
+		return nil, newError(gcsErrorKind(err), "gcs", err, fmt.Sprintf("unable to download file from bucket: %s, file: %s", gcs.bucket, gcs.filepath))
 	}
 	if len(gcs.key) > 0 {
-		return parseSecretFile(b, gcs.key)
+		return parseSecretFileValue(b, gcs.key)
 	}
 	return string(b), nil
 }
+
+// gcsErrorKind classifies the errors of the storage client.
+func gcsErrorKind(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
+		return ErrNotFound
+	}
+	return errorKind(err)
+}
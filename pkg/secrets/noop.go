@@ -21,6 +21,10 @@ func (n *NoopDecrypter) Decrypt() (string, error) {
 	return n.value, nil
 }
 
+func (n *NoopDecrypter) DecryptContext(ctx context.Context) (string, error) {
+	return n.Decrypt()
+}
+
 func (n *NoopDecrypter) ParseTokens(secret string) {
 	n.value = secret[len("encrypted:noop!v:"):]
 }
@@ -0,0 +1,346 @@
+package secrets
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Reference is a parsed encrypted secret reference, such as
+// encrypted:s3!r:us-west-2!b:bucket!f:secrets.yml.
+//
+// Parameters are separated by "!" and split on their first ":", so values can
+// contain colons as in ARNs. A value containing "!" is either double quoted,
+// k:"a!b", or escaped, k:a\!b. In both forms \\ and \" stand for a backslash
+// and a double quote; other backslashes are kept as is.
+type Reference struct {
+	Engine string
+	IsFile bool
+	Params []Param
+	// RawParams is the text following the engine name, for engines such as
+	// noop that take it as is.
+	RawParams string
+}
+
+// Param is a key:value parameter of a Reference.
+type Param struct {
+	Key   string
+	Value string
+	// Pos is the byte offset of the parameter in the parsed text.
+	Pos int
+}
+
+// Get returns the value of the parameter key.
+func (r *Reference) Get(key string) (string, bool) {
+	for _, p := range r.Params {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// String returns the reference, quoting the values that need it.
+func (r *Reference) String() string {
+	var b strings.Builder
+	if r.IsFile {
+		b.WriteString(encryptedFilePrefix)
+	} else {
+		b.WriteString(encryptedPrefix)
+	}
+	b.WriteString(r.Engine)
+	b.WriteString("!")
+	if r.Params == nil {
+		b.WriteString(r.RawParams)
+		return b.String()
+	}
+	for i, p := range r.Params {
+		if i > 0 {
+			b.WriteString("!")
+		}
+		b.WriteString(p.Key)
+		b.WriteString(":")
+		b.WriteString(quoteParam(p.Value))
+	}
+	return b.String()
+}
+
+func quoteParam(v string) string {
+	if !strings.ContainsAny(v, `!"\`) {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// ReferenceError is returned for references that can't be parsed or that
+// don't have the parameters their engine expects. It matches
+// ErrMalformedReference with errors.Is.
+type ReferenceError struct {
+	// Text is the reference, or the parameters handed to an engine, that failed.
+	Text string
+	// Pos is the byte offset of the problem in Text.
+	Pos int
+	Msg string
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("secret format error - %s at position %d of %q", e.Msg, e.Pos, e.Text)
+}
+
+func (e *ReferenceError) Is(target error) bool {
+	return target == ErrMalformedReference
+}
+
+// ParseReference parses an encrypted: or encryptedFile: secret reference. The
+// parameters of engines taking their parameters as is, such as noop, are
+// only available as RawParams.
+func ParseReference(ref string) (*Reference, error) {
+	r := &Reference{}
+	start := 0
+	switch {
+	case strings.HasPrefix(ref, encryptedPrefix):
+		start = len(encryptedPrefix)
+	case strings.HasPrefix(ref, encryptedFilePrefix):
+		start = len(encryptedFilePrefix)
+		r.IsFile = true
+	default:
+		return nil, &ReferenceError{Text: ref, Msg: "expected an encrypted: or encryptedFile: prefix"}
+	}
+	bang := strings.IndexByte(ref[start:], '!')
+	if bang < 0 {
+		return nil, &ReferenceError{Text: ref, Pos: len(ref), Msg: "expected ! after the engine name"}
+	}
+	r.Engine = ref[start : start+bang]
+	if r.Engine == "" {
+		return nil, &ReferenceError{Text: ref, Pos: start, Msg: "missing engine name"}
+	}
+	r.RawParams = ref[start+bang+1:]
+	if spec, ok := referenceSpecs[r.Engine]; ok && spec.raw {
+		return r, nil
+	}
+	params, err := parseParams(ref, start+bang+1)
+	if err != nil {
+		return nil, err
+	}
+	r.Params = params
+	return r, nil
+}
+
+// ParseParams parses the parameters handed to an EngineFactory, such as
+// "r:us-west-2!b:bucket!f:secrets.yml", see Reference for the syntax.
+// Parameters can't be repeated.
+func ParseParams(params string) ([]Param, error) {
+	return parseParams(params, 0)
+}
+
+// parseParams parses the parameters found in text from offset on.
+func parseParams(text string, offset int) ([]Param, error) {
+	params := []Param{}
+	seen := map[string]bool{}
+	for i := offset; i < len(text); {
+		start := i
+		for i < len(text) && text[i] != ':' && text[i] != '!' {
+			i++
+		}
+		if i == len(text) || text[i] == '!' {
+			if i == start {
+				if i == len(text) {
+					break
+				}
+				return nil, &ReferenceError{Text: text, Pos: start, Msg: "empty parameter"}
+			}
+			return nil, &ReferenceError{Text: text, Pos: start, Msg: fmt.Sprintf("parameter %q has no value, expected key:value", text[start:i])}
+		}
+		key := text[start:i]
+		if key == "" {
+			return nil, &ReferenceError{Text: text, Pos: start, Msg: "missing parameter name"}
+		}
+		if seen[key] {
+			return nil, &ReferenceError{Text: text, Pos: start, Msg: fmt.Sprintf("duplicate parameter %q", key)}
+		}
+		seen[key] = true
+		value, next, err := parseValue(text, i+1)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, Param{Key: key, Value: value, Pos: start})
+		// skip the separator
+		i = next + 1
+	}
+	return params, nil
+}
+
+// parseValue parses the value starting at i, and returns it with the offset of
+// the separator, or the end of text, following it.
+func parseValue(text string, i int) (string, int, error) {
+	var b strings.Builder
+	quoted := i < len(text) && text[i] == '"'
+	if quoted {
+		i++
+	}
+	for ; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(`!"\`, text[i+1]) >= 0:
+			i++
+			b.WriteByte(text[i])
+		case quoted && c == '"':
+			if i+1 < len(text) && text[i+1] != '!' {
+				return "", 0, &ReferenceError{Text: text, Pos: i + 1, Msg: "expected ! after quoted value"}
+			}
+			return b.String(), i + 1, nil
+		case !quoted && c == '!':
+			return b.String(), i, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quoted {
+		return "", 0, &ReferenceError{Text: text, Pos: len(text), Msg: "unterminated quoted value"}
+	}
+	return b.String(), i, nil
+}
+
+// referenceSpec lists the parameters of a built-in engine.
+type referenceSpec struct {
+	// raw engines take their parameters as is
+	raw      bool
+	required []string
+	optional []string
+	// aliases maps deprecated parameter names to their replacement
+	aliases map[string]string
+	// check validates constraints between parameters
+	check func(r *Reference) string
+}
+
+var referenceSpecs = map[string]referenceSpec{
+	"noop": {raw: true},
+	"s3": {
+		required: []string{"r", "b", "f"},
+		optional: []string{"k"},
+	},
+	"gcs": {
+		required: []string{"b", "f"},
+		optional: []string{"k"},
+	},
+	"secrets-manager": {
+		required: []string{"r", "s"},
+		optional: []string{"k"},
+		check: func(r *Reference) string {
+			if _, ok := r.Get("k"); ok && r.IsFile {
+				return "encryptedFile references can't have a 'k' parameter"
+			}
+			return ""
+		},
+	},
+	"vault": {
+		required: []string{"e", "p"},
+		optional: []string{"b", "d", "k", "m", "v"},
+		aliases:  map[string]string{"n": "p"},
+		check: func(r *Reference) string {
+			k, _ := r.Get("k")
+			m, _ := r.Get("m")
+			v, _ := r.Get("v")
+			b, _ := r.Get("b")
+			d, _ := r.Get("d")
+			if msg := checkVaultKeys(k, m, v); msg != "" {
+				return msg
+			}
+			if msg := checkFlag("b", "base64", b); msg != "" {
+				return msg
+			}
+			return checkDynamic(d, m, v)
+		},
+	},
+}
+
+// ValidateReference checks that ref can be parsed and, for built-in engines,
+// that it has the parameters its engine expects, without contacting any
+// backend. References to other engines are only checked for syntax.
+func ValidateReference(ref string) error {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	spec, ok := referenceSpecs[r.Engine]
+	if !ok || spec.raw {
+		return nil
+	}
+	if _, err := spec.params(ref, r.Params); err != nil {
+		return err
+	}
+	var missing []string
+	for _, key := range spec.required {
+		if _, ok := r.Get(key); ok {
+			continue
+		}
+		if alias := spec.aliasOf(key); alias != "" {
+			if _, ok := r.Get(alias); ok {
+				continue
+			}
+		}
+		missing = append(missing, key)
+	}
+	if len(missing) > 0 {
+		return &ReferenceError{Text: ref, Pos: len(ref), Msg: fmt.Sprintf("missing required parameter(s) %s", strings.Join(missing, ", "))}
+	}
+	if spec.check != nil {
+		if msg := spec.check(r); msg != "" {
+			return &ReferenceError{Text: ref, Pos: 0, Msg: msg}
+		}
+	}
+	return nil
+}
+
+func (s referenceSpec) aliasOf(key string) string {
+	for alias, k := range s.aliases {
+		if k == key {
+			return alias
+		}
+	}
+	return ""
+}
+
+// params returns the parameters by name, aliases being replaced, and fails on
+// unknown parameters or a parameter given along with its alias. text is what
+// params were parsed from.
+func (s referenceSpec) params(text string, params []Param) (map[string]string, error) {
+	known := map[string]bool{}
+	for _, k := range append(append([]string{}, s.required...), s.optional...) {
+		known[k] = true
+	}
+	m := make(map[string]string, len(params))
+	for _, p := range params {
+		key := p.Key
+		if k, ok := s.aliases[key]; ok {
+			key = k
+		}
+		if !known[key] {
+			return nil, &ReferenceError{Text: text, Pos: p.Pos, Msg: fmt.Sprintf("unknown parameter %q, expected one of %s", p.Key, s.keys())}
+		}
+		if _, ok := m[key]; ok {
+			return nil, &ReferenceError{Text: text, Pos: p.Pos, Msg: fmt.Sprintf("duplicate parameter %q", p.Key)}
+		}
+		m[key] = p.Value
+	}
+	return m, nil
+}
+
+func (s referenceSpec) keys() string {
+	keys := append(append([]string{}, s.required...), s.optional...)
+	for alias := range s.aliases {
+		keys = append(keys, alias)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// engineParams parses the parameters handed to the factory of a built-in
+// engine and returns them by name.
+func engineParams(engine, params string) (map[string]string, error) {
+	parsed, err := ParseParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return referenceSpecs[engine].params(params, parsed)
+}
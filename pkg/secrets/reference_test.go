@@ -0,0 +1,130 @@
+package secrets
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReference(t *testing.T) {
+	cases := map[string]struct {
+		ref      string
+		expected *Reference
+	}{
+		"simple": {
+			ref: "encrypted:s3!r:us-west-2!b:bucket!f:file.yml",
+			expected: &Reference{Engine: "s3", RawParams: "r:us-west-2!b:bucket!f:file.yml", Params: []Param{
+				{Key: "r", Value: "us-west-2", Pos: 13}, {Key: "b", Value: "bucket", Pos: 25}, {Key: "f", Value: "file.yml", Pos: 34},
+			}},
+		},
+		"colons in values": {
+			ref: "encryptedFile:secrets-manager!r:us-east-1!s:arn:aws:secretsmanager:us-east-1:123:secret:db",
+			expected: &Reference{Engine: "secrets-manager", IsFile: true, RawParams: "r:us-east-1!s:arn:aws:secretsmanager:us-east-1:123:secret:db", Params: []Param{
+				{Key: "r", Value: "us-east-1", Pos: 30}, {Key: "s", Value: "arn:aws:secretsmanager:us-east-1:123:secret:db", Pos: 42},
+			}},
+		},
+		"quoted and escaped values": {
+			ref: `encrypted:vault!e:secret!p:"team!a/db \"x\""!k:pass\!word\\`,
+			expected: &Reference{Engine: "vault", RawParams: `e:secret!p:"team!a/db \"x\""!k:pass\!word\\`, Params: []Param{
+				{Key: "e", Value: "secret", Pos: 16}, {Key: "p", Value: `team!a/db "x"`, Pos: 25}, {Key: "k", Value: `pass!word\`, Pos: 45},
+			}},
+		},
+		"other backslashes are kept": {
+			ref: `encrypted:s3!f:C:\secrets\file!`,
+			expected: &Reference{Engine: "s3", RawParams: `f:C:\secrets\file!`, Params: []Param{
+				{Key: "f", Value: `C:\secrets\file`, Pos: 13},
+			}},
+		},
+		"raw engines": {
+			ref:      "encrypted:noop!not:key!value",
+			expected: &Reference{Engine: "noop", RawParams: "not:key!value"},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := ParseReference(c.ref)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, r)
+		})
+	}
+}
+
+func TestParseReferenceErrors(t *testing.T) {
+	cases := map[string]struct {
+		ref string
+		pos int
+		msg string
+	}{
+		"no prefix":         {ref: "s3!b:bucket", pos: 0, msg: "expected an encrypted: or encryptedFile: prefix"},
+		"no bang":           {ref: "encrypted:s3", pos: 12, msg: "expected ! after the engine name"},
+		"no engine":         {ref: "encrypted:!b:x", pos: 10, msg: "missing engine name"},
+		"no value":          {ref: "encrypted:s3!b:x!f!r:y", pos: 17, msg: `parameter "f" has no value, expected key:value`},
+		"no name":           {ref: "encrypted:s3!:x", pos: 13, msg: "missing parameter name"},
+		"empty parameter":   {ref: "encrypted:s3!b:x!!f:y", pos: 17, msg: "empty parameter"},
+		"duplicate":         {ref: "encrypted:s3!b:x!b:y", pos: 17, msg: `duplicate parameter "b"`},
+		"unterminated":      {ref: `encrypted:s3!b:"x!f:y`, pos: 21, msg: "unterminated quoted value"},
+		"text after quotes": {ref: `encrypted:s3!b:"x"y`, pos: 18, msg: "expected ! after quoted value"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseReference(c.ref)
+			var refErr *ReferenceError
+			if assert.True(t, errors.As(err, &refErr), "error was %v", err) {
+				assert.Equal(t, c.pos, refErr.Pos)
+				assert.Equal(t, c.msg, refErr.Msg)
+			}
+			assert.True(t, errors.Is(err, ErrMalformedReference))
+		})
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	for _, ref := range []string{
+		"encrypted:s3!r:us-west-2!b:bucket!f:file.yml",
+		`encryptedFile:vault!e:secret!p:"a!b \"c\" \\d"!k:key`,
+		"encrypted:noop!anything!goes",
+	} {
+		r, err := ParseReference(ref)
+		assert.NoError(t, err)
+		assert.Equal(t, ref, r.String())
+	}
+}
+
+func TestValidateReference(t *testing.T) {
+	cases := map[string]string{
+		"encrypted:s3!r:us-west-2!b:bucket!f:file.yml":                  "",
+		"encrypted:vault!e:secret!n:path!k:key":                         "",
+		"encrypted:custom!anything:goes":                                "",
+		"encrypted:noop!value":                                          "",
+		"encrypted:s3!r:us-west-2!b:bucket":                             `secret format error - missing required parameter(s) f at position 33 of "encrypted:s3!r:us-west-2!b:bucket"`,
+		"encrypted:gcs!b:bucket!f:file!x:y":                             `secret format error - unknown parameter "x", expected one of b, f, k at position 30 of "encrypted:gcs!b:bucket!f:file!x:y"`,
+		"encrypted:vault!e:secret!n:path!p:path!k:key":                  `secret format error - duplicate parameter "p" at position 32 of "encrypted:vault!e:secret!n:path!p:path!k:key"`,
+		"encryptedFile:secrets-manager!r:us-east-1!s:secret!k:password": `secret format error - encryptedFile references can't have a 'k' parameter at position 0 of "encryptedFile:secrets-manager!r:us-east-1!s:secret!k:password"`,
+	}
+	for ref, expected := range cases {
+		t.Run(ref, func(t *testing.T) {
+			err := ValidateReference(ref)
+			if expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, expected)
+		})
+	}
+}
+
+func TestEngineParams(t *testing.T) {
+	s3 := &S3Decrypter{}
+	assert.NoError(t, s3.parse(`r:us-west-2!b:bucket!f:"dir/with!bang.yml"`))
+	assert.Equal(t, "dir/with!bang.yml", s3.filepath)
+
+	v := &VaultDecrypter{}
+	err := v.parseSyntax("e:secret!p:path!k:key!x:y")
+	assert.True(t, errors.Is(err, ErrMalformedReference), "error was %v", err)
+	assert.EqualError(t, err, `secret format error - unknown parameter "x", expected one of b, d, e, k, m, n, p, v at position 22 of "e:secret!p:path!k:key!x:y"`)
+
+	sm := &AwsSecretsManagerDecrypter{}
+	assert.NoError(t, sm.parse(`r:us-east-1!s:arn:aws:secretsmanager:us-east-1:123:secret:a\!b`))
+	assert.Equal(t, "arn:aws:secretsmanager:us-east-1:123:secret:a!b", sm.secretName)
+}
@@ -0,0 +1,179 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Registry maps engine names, as found in encrypted:<engine>!... references,
+// to the factories building their decrypters. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.RWMutex
+	engines map[string]EngineFactory
+	// vault is the configuration of the vault engine registered with
+	// RegisterVaultConfigIn, whose connection r holds a reference to
+	vault *VaultConfig
+	// replaced are the configurations vault replaced, whose connections r
+	// holds until ReleaseReplaced
+	replaced []VaultConfig
+}
+
+// NewRegistry returns a registry without any engine.
+func NewRegistry() *Registry {
+	return &Registry{engines: map[string]EngineFactory{}}
+}
+
+// NewDefaultRegistry returns a registry with the engines built in this
+// package: gcs, noop, s3 and secrets-manager. Vault is registered with
+// RegisterVaultConfigIn once its configuration is known.
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register("gcs", NewGcsDecrypter)
+	r.Register("noop", NewNoopDecrypter)
+	r.Register("s3", NewS3Decrypter)
+	r.Register("secrets-manager", NewAwsSecretsManagerDecrypter)
+	return r
+}
+
+// Clone returns a new registry with the engines registered in r. Engines
+// registered in either afterwards aren't seen by the other.
+func (r *Registry) Clone() *Registry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c := NewRegistry()
+	for name, factory := range r.engines {
+		c.engines[name] = factory
+	}
+	if r.vault != nil {
+		vault := *r.vault
+		acquireVaultConn(vault, nil)
+		c.vault = &vault
+	}
+	return c
+}
+
+// Register installs factory under name, replacing any engine with the same name.
+func (r *Registry) Register(name string, factory EngineFactory) {
+	r.mu.Lock()
+	r.engines[name] = factory
+	previous := r.swapVault(name, nil)
+	r.mu.Unlock()
+	releaseVault(previous)
+}
+
+// Unregister removes the engine registered under name, if any.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	delete(r.engines, name)
+	previous := r.swapVault(name, nil)
+	r.mu.Unlock()
+	releaseVault(previous)
+}
+
+// registerVault installs the vault engine of cfg, holding a reference to its
+// connection. The connection of the configuration it replaces is held until
+// ReleaseReplaced, the secrets decrypted with it being still in use.
+func (r *Registry) registerVault(cfg VaultConfig, factory EngineFactory) {
+	acquireVaultConn(cfg, nil)
+	r.mu.Lock()
+	r.engines["vault"] = factory
+	previous := r.swapVault("vault", &cfg)
+	if previous != nil && (*previous == cfg || r.isReplaced(*previous)) {
+		// the connection is held already
+		r.mu.Unlock()
+		releaseVault(previous)
+		return
+	}
+	if previous != nil {
+		r.replaced = append(r.replaced, *previous)
+	}
+	r.mu.Unlock()
+}
+
+// isReplaced tells whether cfg is among the replaced configurations. r.mu must
+// be held.
+func (r *Registry) isReplaced(cfg VaultConfig) bool {
+	for _, replaced := range r.replaced {
+		if replaced == cfg {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleaseReplaced releases the connections of the vault configurations
+// replaced by RegisterVaultConfigIn, revoking their leases and tokens once no
+// other registry uses them. Call it once the secrets decrypted with them
+// aren't used anymore, such as when a reloaded configuration has been
+// delivered.
+func (r *Registry) ReleaseReplaced() {
+	r.mu.Lock()
+	replaced := r.replaced
+	r.replaced = nil
+	r.mu.Unlock()
+	for _, cfg := range replaced {
+		releaseVaultConn(cfg)
+	}
+}
+
+// Close unregisters the vault engine and releases the connections of the vault
+// configurations r holds, as ReleaseReplaced does. Other engines are left
+// registered.
+func (r *Registry) Close() {
+	r.Unregister("vault")
+	r.ReleaseReplaced()
+}
+
+// swapVault records cfg as the configuration of the vault engine when name is
+// vault, and returns the previous one. r.mu must be held.
+func (r *Registry) swapVault(name string, cfg *VaultConfig) *VaultConfig {
+	if name != "vault" {
+		return nil
+	}
+	previous := r.vault
+	r.vault = cfg
+	return previous
+}
+
+// releaseVault releases the connection of cfg, if any.
+func releaseVault(cfg *VaultConfig) {
+	if cfg != nil {
+		releaseVaultConn(*cfg)
+	}
+}
+
+// Lookup returns the factory registered under name.
+func (r *Registry) Lookup(name string) (EngineFactory, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	factory, ok := r.engines[name]
+	return factory, ok
+}
+
+// Names returns the sorted names of the registered engines.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.engines))
+	for name := range r.engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewDecrypter is like the package level NewDecrypter but looks the engine up
+// in r.
+func (r *Registry) NewDecrypter(ctx context.Context, encryptedSecret string) (Decrypter, error) {
+	e, isFile, params := GetEngine(encryptedSecret)
+	if e == "" {
+		return &NoopDecrypter{value: encryptedSecret}, nil
+	}
+	engine, ok := r.Lookup(e)
+	if !ok {
+		return nil, newError(ErrEngineNotRegistered, e, nil, fmt.Sprintf("secret engine %s not registered", e))
+	}
+	return engine(ctx, isFile, params)
+}
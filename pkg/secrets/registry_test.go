@@ -0,0 +1,69 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	assert.Empty(t, r.Names())
+
+	r.Register("custom", func(ctx context.Context, isFile bool, params string) (Decrypter, error) {
+		return NewNoopDecrypter(ctx, isFile, "decrypted-"+params)
+	})
+	r.Register("noop", NewNoopDecrypter)
+	assert.Equal(t, []string{"custom", "noop"}, r.Names())
+
+	_, ok := r.Lookup("custom")
+	assert.True(t, ok)
+	d, err := r.NewDecrypter(context.Background(), "encrypted:custom!s3cr3t")
+	assert.NoError(t, err)
+	s, err := d.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "decrypted-s3cr3t", s)
+
+	r.Unregister("custom")
+	_, ok = r.Lookup("custom")
+	assert.False(t, ok)
+	_, err = r.NewDecrypter(context.Background(), "encrypted:custom!s3cr3t")
+	assert.True(t, errors.Is(err, ErrEngineNotRegistered), "error was %v", err)
+
+	assert.Equal(t, []string{"gcs", "noop", "s3", "secrets-manager"}, NewDefaultRegistry().Names())
+
+	// clones don't see the engines registered in the original afterwards
+	c := r.Clone()
+	r.Register("late", NewNoopDecrypter)
+	c.Register("own", NewNoopDecrypter)
+	assert.Equal(t, []string{"noop", "own"}, c.Names())
+	assert.Equal(t, []string{"late", "noop"}, r.Names())
+}
+
+func TestRegistryConcurrentUse(t *testing.T) {
+	r := NewDefaultRegistry()
+	cfg := VaultConfig{Enabled: true, Url: "http://vault", AuthMethod: "TOKEN", Token: "token"}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, RegisterVaultConfigIn(r, cfg))
+		}()
+		go func(i int) {
+			defer wg.Done()
+			d, err := r.NewDecrypter(context.Background(), fmt.Sprintf("encrypted:noop!%d", i))
+			assert.NoError(t, err)
+			s, _ := d.Decrypt()
+			assert.Equal(t, fmt.Sprint(i), s)
+			r.Names()
+		}(i)
+	}
+	wg.Wait()
+	_, ok := r.Lookup("vault")
+	assert.True(t, ok)
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	awss3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"strings"
 )
 
 const (
@@ -31,11 +30,29 @@ func NewS3Decrypter(ctx context.Context, isFile bool, params string) (Decrypter,
 }
 
 func (s3 *S3Decrypter) Decrypt() (string, error) {
-	sec, err := s3.fetchSecret()
+	return s3.DecryptContext(context.Background())
+}
+
+func (s3 *S3Decrypter) DecryptContext(ctx context.Context) (string, error) {
+	v, err := s3.DecryptValue(ctx)
+	if err != nil {
+		return "", err
+	}
+	return FormatValue(v)
+}
+
+// DecryptValue returns the value of the YAML key of the file, or the file
+// itself, see StructuredDecrypter.
+func (s3 *S3Decrypter) DecryptValue(ctx context.Context) (interface{}, error) {
+	sec, err := s3.fetchSecret(ctx)
 	if err != nil || !s3.isFile {
 		return sec, err
 	}
-	return ToTempFile([]byte(sec))
+	content, err := FormatValue(sec)
+	if err != nil {
+		return nil, err
+	}
+	return ToTempFile([]byte(content))
 }
 
 func (s3 *S3Decrypter) IsFile() bool {
@@ -43,62 +60,51 @@ func (s3 *S3Decrypter) IsFile() bool {
 }
 
 func (s3 *S3Decrypter) parse(params string) error {
-	tokens := strings.Split(params, "!")
-	for _, element := range tokens {
-		kv := strings.Split(element, ":")
-		if len(kv) == 2 {
-			switch kv[0] {
-			case "r":
-				s3.region = kv[1]
-			case "b":
-				s3.bucket = kv[1]
-			case "f":
-				s3.filepath = kv[1]
-			case "k":
-				s3.key = kv[1]
-			}
-		}
+	p, err := engineParams("s3", params)
+	if err != nil {
+		return err
 	}
+	s3.region, s3.bucket, s3.filepath, s3.key = p["r"], p["b"], p["f"], p["k"]
 
 	if s3.region == "" {
-		return fmt.Errorf("secret format error - 'r' for region is required")
+		return malformed("s3", "secret format error - 'r' for region is required")
 	}
 	if s3.bucket == "" {
-		return fmt.Errorf("secret format error - 'b' for bucket is required")
+		return malformed("s3", "secret format error - 'b' for bucket is required")
 	}
 	if s3.filepath == "" {
-		return fmt.Errorf("secret format error - 'f' for file is required")
+		return malformed("s3", "secret format error - 'f' for file is required")
 	}
 	return nil
 }
 
-func (s3 *S3Decrypter) fetchSecret() (string, error) {
+func (s3 *S3Decrypter) fetchSecret(ctx context.Context) (interface{}, error) {
 	sess, err := session.NewSession(&aws.Config{
 		Region:     aws.String(s3.region),
 		MaxRetries: aws.Int(MaxApiRetry),
 	})
 	if err != nil {
-		return "", err
+		return nil, newError(errorKind(err), "s3", err, "unable to create AWS session")
 	}
 
 	downloader := s3manager.NewDownloader(sess)
 
 	contents := aws.NewWriteAtBuffer([]byte{})
-	size, err := downloader.Download(contents,
+	size, err := downloader.DownloadWithContext(ctx, contents,
 		&awss3.GetObjectInput{
 			Bucket: aws.String(s3.bucket),
 			Key:    aws.String(s3.filepath),
 		})
 	if err != nil {
-		return "", fmt.Errorf("unable to download item %q: %v", s3.filepath, err)
+		return nil, newError(errorKind(err), "s3", err, fmt.Sprintf("unable to download item %q", s3.filepath))
 	}
 	if size == 0 {
-		return "", fmt.Errorf("file %q empty", s3.filepath)
+		return nil, newError(ErrNotFound, "s3", nil, fmt.Sprintf("file %q empty", s3.filepath))
 	}
 
 	if len(s3.key) > 0 {
 		bytes := contents.Bytes()
-		return parseSecretFile(bytes, s3.key)
+		return parseSecretFileValue(bytes, s3.key)
 	}
 
 	return string(contents.Bytes()), nil
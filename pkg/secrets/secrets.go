@@ -2,11 +2,13 @@ package secrets
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	yamlParse "gopkg.in/yaml.v2"
 	"io/ioutil"
-	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -14,33 +16,152 @@ const (
 	encryptedFilePrefix = "encryptedFile:"
 )
 
-var Engines = map[string]func(context.Context, bool, string) (Decrypter, error){
-	"gcs":             NewGcsDecrypter,
-	"noop":            NewNoopDecrypter,
-	"s3":              NewS3Decrypter,
-	"secrets-manager": NewAwsSecretsManagerDecrypter,
-}
+// EngineFactory builds a Decrypter from the parameters of an encrypted secret reference.
+type EngineFactory func(ctx context.Context, isFile bool, params string) (Decrypter, error)
+
+// Engines is the registry used by NewDecrypter and the package level resolving
+// and loading functions. Resolvers and loaders get a copy of it when they are
+// created. Register custom engines with Engines.Register.
+var Engines = NewDefaultRegistry()
 
 type Decrypter interface {
 	Decrypt() (string, error)
 	IsFile() bool
 }
 
+// ContextDecrypter is implemented by decrypters whose fetching of the secret
+// can be cancelled or given a deadline. All the engines of this package
+// implement it.
+type ContextDecrypter interface {
+	Decrypter
+	DecryptContext(ctx context.Context) (string, error)
+}
+
+// AsContextDecrypter returns d as a ContextDecrypter. Decrypters that don't
+// implement it are wrapped: Decrypt is called in the background and its result
+// abandoned if ctx is done first.
+func AsContextDecrypter(d Decrypter) ContextDecrypter {
+	if cd, ok := d.(ContextDecrypter); ok {
+		return cd
+	}
+	return contextAdapter{d}
+}
+
+// DecryptContext decrypts the secret of d with ctx, see AsContextDecrypter.
+func DecryptContext(ctx context.Context, d Decrypter) (string, error) {
+	return AsContextDecrypter(d).DecryptContext(ctx)
+}
+
+type contextAdapter struct {
+	Decrypter
+}
+
+type decryptResult struct {
+	secret string
+	err    error
+}
+
+func (a contextAdapter) DecryptContext(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	done := make(chan decryptResult, 1)
+	go func() {
+		secret, err := a.Decrypt()
+		done <- decryptResult{secret, err}
+	}()
+	select {
+	case r := <-done:
+		return r.secret, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// LeaseAware is implemented by decrypters whose secrets are only valid for a
+// limited time, such as Vault secrets.
+type LeaseAware interface {
+	// LeaseDuration returns how long the last decrypted value is valid, 0 if unknown.
+	LeaseDuration() time.Duration
+}
+
+// LeaseWatcher is implemented by decrypters whose secrets are renewed in the
+// background, such as Vault dynamic secrets.
+type LeaseWatcher interface {
+	// LeaseDone returns a channel closed once the lease of the last decrypted
+	// value can't be renewed anymore: decrypting again issues a new secret.
+	// It is nil for secrets without such a lease.
+	LeaseDone() <-chan struct{}
+}
+
+// StructuredDecrypter is implemented by decrypters whose secrets aren't
+// necessarily strings, such as JSON objects stored in Vault or Secrets Manager.
+// Decrypt renders such secrets with FormatValue.
+type StructuredDecrypter interface {
+	Decrypter
+	// DecryptValue returns the secret as stored: a string, a number, a bool, a
+	// map[string]interface{} or a []interface{}. File secrets are the path of
+	// their temporary file, as with Decrypt.
+	DecryptValue(ctx context.Context) (interface{}, error)
+}
+
+// FormatValue renders a secret value as a string: strings as is, numbers and
+// booleans as in YAML and maps and lists as JSON.
+func FormatValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	}
+	out, err := json.Marshal(normalizeValue(v))
+	if err != nil {
+		return "", fmt.Errorf("unable to render secret of type %T: %w", v, err)
+	}
+	return string(out), nil
+}
+
+// normalizeValue converts the maps of v, as decoded from YAML, to
+// map[string]interface{}.
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalizeValue(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = normalizeValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = normalizeValue(e)
+		}
+		return l
+	}
+	return v
+}
+
 func IsEncryptedSecret(val string) bool {
 	return strings.HasPrefix(val, encryptedPrefix) ||
 		strings.HasPrefix(val, encryptedFilePrefix)
 }
 
 func NewDecrypter(ctx context.Context, encryptedSecret string) (Decrypter, error) {
-	e, isFile, params := GetEngine(encryptedSecret)
-	if e == "" {
-		return &NoopDecrypter{value: encryptedSecret}, nil
-	}
-	engine, ok := Engines[e]
-	if !ok {
-		return nil, fmt.Errorf("secret engine %s not registered", e)
-	}
-	return engine(ctx, isFile, params)
+	return Engines.NewDecrypter(ctx, encryptedSecret)
 }
 
 // GetEngine returns the name of the engine if recognized,
@@ -63,26 +184,28 @@ func GetEngine(encryptedSecret string) (string, bool, string) {
 }
 
 func parseSecretFile(fileContents []byte, key string) (string, error) {
-	m := make(map[interface{}]interface{})
-	if err := yamlParse.Unmarshal(fileContents, &m); err != nil {
+	v, err := parseSecretFileValue(fileContents, key)
+	if err != nil {
 		return "", err
 	}
+	return FormatValue(v)
+}
+
+// parseSecretFileValue returns the value found at the dotted key of a YAML
+// file, see StructuredDecrypter.
+func parseSecretFileValue(fileContents []byte, key string) (interface{}, error) {
+	var v interface{} = map[interface{}]interface{}{}
+	if err := yamlParse.Unmarshal(fileContents, &v); err != nil {
+		return nil, err
+	}
 
 	for _, yamlKey := range strings.Split(key, ".") {
-		switch s := m[yamlKey].(type) {
-		case map[interface{}]interface{}:
-			m = s
-		case string:
-			return s, nil
-		case nil:
-			return "", fmt.Errorf("error parsing secret file: couldn't find key %q in yaml", key)
-		default:
-			return "", fmt.Errorf("error parsing secret file: unknown type %q with value %q",
-				reflect.TypeOf(s), s)
+		m, _ := v.(map[interface{}]interface{})
+		if v = m[yamlKey]; v == nil {
+			return nil, newError(ErrNotFound, "", nil, fmt.Sprintf("error parsing secret file: couldn't find key %q in yaml", key))
 		}
 	}
-
-	return "", fmt.Errorf("error parsing secret file for key %q", key)
+	return normalizeValue(v), nil
 }
 
 func ToTempFile(content []byte) (string, error) {
@@ -2,9 +2,12 @@ package secrets
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -15,7 +18,7 @@ func TestMain(m *testing.M) {
 		Token:      "abcdef",
 	})
 	m.Run()
-	delete(Engines, "vault")
+	Engines.Unregister("vault")
 }
 
 func TestEngineCheck(t *testing.T) {
@@ -249,3 +252,80 @@ func TestDecrypter(t *testing.T) {
 		}
 	}
 }
+
+type blockingDecrypter struct {
+	release chan struct{}
+}
+
+func (b blockingDecrypter) Decrypt() (string, error) {
+	<-b.release
+	return "secret", nil
+}
+
+func (b blockingDecrypter) IsFile() bool {
+	return false
+}
+
+func TestDecryptContext(t *testing.T) {
+	for _, secret := range []string{"encrypted:noop!v", "encrypted:s3!b:bucket!r:us-west-2!f:file",
+		"encrypted:gcs!b:bucket!f:file", "encrypted:vault!e:engine!p:file!k:mykey"} {
+		d, err := NewDecrypter(context.Background(), secret)
+		assert.Nil(t, err)
+		_, ok := d.(ContextDecrypter)
+		assert.True(t, ok, "%T should implement ContextDecrypter", d)
+	}
+
+	d := blockingDecrypter{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := DecryptContext(ctx, d)
+	assert.Equal(t, context.Canceled, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = DecryptContext(ctx, d)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(d.release)
+	s, err := DecryptContext(context.Background(), d)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", s)
+}
+
+func TestFormatValue(t *testing.T) {
+	cases := map[string]struct {
+		value    interface{}
+		expected string
+	}{
+		"string":   {value: "s3cr3t", expected: "s3cr3t"},
+		"nil":      {value: nil, expected: ""},
+		"bool":     {value: true, expected: "true"},
+		"int":      {value: 42, expected: "42"},
+		"float":    {value: 1.5, expected: "1.5"},
+		"number":   {value: json.Number("5432"), expected: "5432"},
+		"list":     {value: []interface{}{"a", 1}, expected: `["a",1]`},
+		"map":      {value: map[string]interface{}{"b": "x", "a": json.Number("1")}, expected: `{"a":1,"b":"x"}`},
+		"yaml map": {value: map[interface{}]interface{}{"a": map[interface{}]interface{}{1: "x"}}, expected: `{"a":{"1":"x"}}`},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			s, err := FormatValue(c.value)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, s)
+		})
+	}
+}
+
+func TestParseYamlValue(t *testing.T) {
+	secretBytes := []byte("db:\n  user: admin\n  port: 5432\n  hosts: [db1, db2]\n")
+	v, err := parseSecretFileValue(secretBytes, "db")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"user": "admin", "port": 5432, "hosts": []interface{}{"db1", "db2"}}, v)
+
+	s, err := parseSecretFile(secretBytes, "db.port")
+	assert.NoError(t, err)
+	assert.Equal(t, "5432", s)
+
+	_, err = parseSecretFile(secretBytes, "db.user.name")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
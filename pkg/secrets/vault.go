@@ -2,15 +2,20 @@ package secrets
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/mitchellh/mapstructure"
-	log "github.com/sirupsen/logrus"
+
+	"github.com/armory/go-yaml-tools/pkg/logging"
 )
 
 type VaultConfig struct {
@@ -24,6 +29,57 @@ type VaultConfig struct {
 	UserAuthPath string `json:"userAuthPath" yaml:"userAuthPath"`
 	Namespace    string `json:"namespace" yaml:"namespace"`
 	Token        string // no struct tags for token
+
+	// ServiceAccountTokenPath is the service account token KUBERNETES logs in
+	// with, such as a projected token with a Vault audience. It's read again
+	// on every login, and tokens from a login are only used until it expires.
+	ServiceAccountTokenPath string `json:"serviceAccountTokenPath" yaml:"serviceAccountTokenPath"`
+
+	// RoleId and SecretId are the APPROLE credentials. Each can instead be
+	// read from a file or an environment variable. The secret ID is optional
+	// for roles that don't require one. Path, the mount path of the auth
+	// method, defaults to "approle".
+	RoleId       string `json:"roleId" yaml:"roleId"`
+	RoleIdFile   string `json:"roleIdFile" yaml:"roleIdFile"`
+	RoleIdEnv    string `json:"roleIdEnv" yaml:"roleIdEnv"`
+	SecretId     string `json:"secretId" yaml:"secretId"`
+	SecretIdFile string `json:"secretIdFile" yaml:"secretIdFile"`
+	SecretIdEnv  string `json:"secretIdEnv" yaml:"secretIdEnv"`
+	// SecretIdWrapped is set when the secret ID is a response wrapping token
+	// to unwrap before logging in.
+	SecretIdWrapped bool `json:"secretIdWrapped" yaml:"secretIdWrapped"`
+
+	// AwsRegion is the region of the STS endpoint AWS_IAM signs requests for,
+	// us-east-1, the global endpoint, by default. IamServerIdHeader is the
+	// value of the X-Vault-AWS-IAM-Server-ID header, when the aws auth method
+	// requires one. Role is the Vault role, the one bound to the IAM principal
+	// by default, and Path defaults to "aws".
+	AwsRegion         string `json:"awsRegion" yaml:"awsRegion"`
+	IamServerIdHeader string `json:"iamServerIdHeader" yaml:"iamServerIdHeader"`
+
+	// Jwt is the token JWT logs in with, or is read from JwtFile or JwtEnv.
+	// Without any of them, an identity token for JwtAudience is requested
+	// from the GCP metadata server. Path defaults to "jwt".
+	Jwt         string `json:"jwt" yaml:"jwt"`
+	JwtFile     string `json:"jwtFile" yaml:"jwtFile"`
+	JwtEnv      string `json:"jwtEnv" yaml:"jwtEnv"`
+	JwtAudience string `json:"jwtAudience" yaml:"jwtAudience"`
+
+	// GcpAuthType is "gce", logging in as the instance, the default, or
+	// "iam", logging in as GcpServiceAccount. Path defaults to "gcp".
+	GcpAuthType       string `json:"gcpAuthType" yaml:"gcpAuthType"`
+	GcpServiceAccount string `json:"gcpServiceAccount" yaml:"gcpServiceAccount"`
+
+	// TLS settings of the connection to Vault. CaCert, ClientCert and
+	// ClientKey can be encryptedFile references to other engines. The
+	// client certificate is what CERT logs in with, Role then being the name
+	// of the certificate role and Path defaulting to "cert".
+	CaCert        string `json:"caCert" yaml:"caCert"`
+	CaPath        string `json:"caPath" yaml:"caPath"`
+	ClientCert    string `json:"clientCert" yaml:"clientCert"`
+	ClientKey     string `json:"clientKey" yaml:"clientKey"`
+	TlsServerName string `json:"tlsServerName" yaml:"tlsServerName"`
+	TlsSkipVerify bool   `json:"tlsSkipVerify" yaml:"tlsSkipVerify"`
 }
 
 type VaultSecret struct {
@@ -34,23 +90,55 @@ type VaultDecrypter struct {
 	path          string
 	key           string
 	base64Encoded string
+	// version pins the KV v2 version of the secret
+	version string
+	// metadataKey is the KV v2 metadata field to read instead of key
+	metadataKey string
+	// dynamic is set for secrets issued with a lease, such as database
+	// credentials, see leaseDone
+	dynamic       bool
 	isFile        bool
 	vaultConfig   VaultConfig
 	tokenFetcher  TokenFetcher
+	logger        logging.Logger
+	leaseDuration time.Duration
+	leaseDone     <-chan struct{}
+	// engines decrypts the TLS files referencing other engines
+	engines   *Registry
+	tlsConfig *api.TLSConfig
+	// conn is shared by the decrypters of a VaultConfig
+	conn *vaultConn
+	// kvVersion is the version of the KV engine, 0 when unknown
+	kvVersion int
 }
 
 type VaultClient interface {
-	Write(path string, data map[string]interface{}) (*api.Secret, error)
-	Read(path string) (*api.Secret, error)
+	WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error)
+	ReadWithContext(ctx context.Context, path string) (*api.Secret, error)
+	ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*api.Secret, error)
 }
 
 func RegisterVaultConfig(vaultConfig VaultConfig) error {
+	return RegisterVaultConfigIn(Engines, vaultConfig)
+}
+
+// RegisterVaultConfigIn is like RegisterVaultConfig but installs the vault
+// engine in the given registry instead of the global Engines. The connection
+// of the configuration it replaces is kept until the registry's
+// ReleaseReplaced.
+func RegisterVaultConfigIn(engines *Registry, vaultConfig VaultConfig) error {
 	if err := validateVaultConfig(vaultConfig); err != nil {
-		return fmt.Errorf("vault configuration error - %s", err)
+		return fmt.Errorf("vault configuration error - %w", err)
 	}
 
-	Engines["vault"] = func(ctx context.Context, isFile bool, params string) (Decrypter, error) {
-		vd := &VaultDecrypter{isFile: isFile, vaultConfig: vaultConfig}
+	engines.registerVault(vaultConfig, func(ctx context.Context, isFile bool, params string) (Decrypter, error) {
+		vd := &VaultDecrypter{
+			isFile:      isFile,
+			vaultConfig: vaultConfig,
+			logger:      logging.FromContext(ctx).With(logging.EngineKey, "vault"),
+			engines:     engines,
+			conn:        sharedVaultConn(vaultConfig, logging.FromContext(ctx).With(logging.EngineKey, "vault")),
+		}
 		if err := vd.parseSyntax(params); err != nil {
 			return nil, err
 		}
@@ -58,20 +146,44 @@ func RegisterVaultConfig(vaultConfig VaultConfig) error {
 			return nil, err
 		}
 		return vd, nil
-	}
+	})
 	return nil
 }
 
 type TokenFetcher interface {
-	fetchToken(client VaultClient) (string, error)
+	fetchToken(ctx context.Context, client VaultClient) (string, error)
+}
+
+// authFetcher is implemented by the TokenFetchers logging in with an auth
+// method, which tells how long their tokens last.
+type authFetcher interface {
+	TokenFetcher
+	fetchAuth(ctx context.Context, client VaultClient) (*vaultAuth, error)
+}
+
+// vaultAuth is the outcome of a login.
+type vaultAuth struct {
+	token     string
+	renewable bool
+	ttl       time.Duration
+	// credentialsExpiry is when the credentials logged in with expire, zero
+	// if they don't
+	credentialsExpiry time.Time
+}
+
+func tokenOf(auth *vaultAuth, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	return auth.token, nil
 }
 
 type EnvironmentVariableTokenFetcher struct{}
 
-func (e EnvironmentVariableTokenFetcher) fetchToken(client VaultClient) (string, error) {
+func (e EnvironmentVariableTokenFetcher) fetchToken(ctx context.Context, client VaultClient) (string, error) {
 	token := os.Getenv("VAULT_TOKEN")
 	if token == "" {
-		return "", fmt.Errorf("VAULT_TOKEN environment variable not set")
+		return "", newError(ErrAuthFailed, "vault", nil, "VAULT_TOKEN environment variable not set")
 	}
 	return token, nil
 }
@@ -80,58 +192,96 @@ type UserPassTokenFetcher struct {
 	username     string
 	password     string
 	userAuthPath string
+	logger       logging.Logger
+}
+
+func (u UserPassTokenFetcher) fetchToken(ctx context.Context, client VaultClient) (string, error) {
+	return tokenOf(u.fetchAuth(ctx, client))
 }
 
-func (u UserPassTokenFetcher) fetchToken(client VaultClient) (string, error) {
+func (u UserPassTokenFetcher) fetchAuth(ctx context.Context, client VaultClient) (*vaultAuth, error) {
 	data := map[string]interface{}{
 		"password": u.password,
 	}
-	loginPath := "auth/" + u.userAuthPath + "/login/" + u.username
-
-	log.Infof("logging into vault with USERPASS auth at: %s", loginPath)
-	secret, err := client.Write(loginPath, data)
-	if err != nil {
-		return handleLoginErrors(err)
-	}
-
-	return secret.Auth.ClientToken, nil
+	return login(ctx, client, u.logger, "USERPASS", "auth/"+u.userAuthPath+"/login/"+u.username, data)
 }
 
+const defaultServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
 type KubernetesServiceAccountTokenFetcher struct {
-	role string
-	path string
+	role       string
+	path       string
+	tokenPath  string
 	fileReader fileReader
+	logger     logging.Logger
 }
 
 // define a file reader function so we can test kubernetes auth
 type fileReader func(string) ([]byte, error)
 
-func (k KubernetesServiceAccountTokenFetcher) fetchToken(client VaultClient) (string, error) {
-	tokenBytes, err := k.fileReader("/var/run/secrets/kubernetes.io/serviceaccount/token")
+func (k KubernetesServiceAccountTokenFetcher) fetchToken(ctx context.Context, client VaultClient) (string, error) {
+	return tokenOf(k.fetchAuth(ctx, client))
+}
+
+// fetchAuth logs in with the service account token, read again on every
+// login since projected tokens are rotated, and reports its expiry.
+func (k KubernetesServiceAccountTokenFetcher) fetchAuth(ctx context.Context, client VaultClient) (*vaultAuth, error) {
+	tokenPath := k.tokenPath
+	if tokenPath == "" {
+		tokenPath = defaultServiceAccountTokenPath
+	}
+	tokenBytes, err := k.fileReader(tokenPath)
 	if err != nil {
-		return "", fmt.Errorf("error reading service account token: %s", err)
+		return nil, newError(ErrAuthFailed, "vault", err, "error reading service account token")
 	}
+	jwt := strings.TrimSpace(string(tokenBytes))
 	data := map[string]interface{}{
 		"role": k.role,
-		"jwt":  string(tokenBytes),
+		"jwt":  jwt,
 	}
-	loginPath := "auth/" + k.path + "/login"
-
-	log.Infof("logging into vault with KUBERNETES auth at: %s", loginPath)
-	secret, err := client.Write(loginPath, data)
+	auth, err := login(ctx, client, k.logger, "KUBERNETES", "auth/"+k.path+"/login", data)
 	if err != nil {
-		return handleLoginErrors(err)
+		return nil, err
 	}
+	auth.credentialsExpiry = jwtExpiry(jwt)
+	return auth, nil
+}
 
-	return secret.Auth.ClientToken, nil
+// jwtExpiry returns the expiry of a JWT, zero if it has none or can't be
+// parsed. The JWT isn't verified, Vault does that.
+func jwtExpiry(jwt string) time.Time {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp json.Number `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}
+	}
+	exp, err := claims.Exp.Float64()
+	if err != nil || exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(exp), 0)
 }
 
 func handleLoginErrors(err error) (string, error) {
 	if _, ok := err.(*json.SyntaxError); ok {
 		// some connection errors aren't properly caught, and the vault client tries to parse <nil>
-		return "", fmt.Errorf("error fetching secret from vault - check connection to the server")
+		return "", newError(ErrTransient, "vault", err, "error fetching secret from vault - check connection to the server")
 	}
-	return "", fmt.Errorf("error logging into vault: %s", err)
+	kind := errorKind(err)
+	if kind != ErrTransient {
+		// whatever vault answers, the credentials weren't accepted
+		kind = ErrAuthFailed
+	}
+	return "", newError(kind, "vault", err, "error logging into vault")
 }
 
 func (decrypter *VaultDecrypter) setTokenFetcher() error {
@@ -142,18 +292,72 @@ func (decrypter *VaultDecrypter) setTokenFetcher() error {
 		tokenFetcher = EnvironmentVariableTokenFetcher{}
 	case "KUBERNETES":
 		tokenFetcher = KubernetesServiceAccountTokenFetcher{
-			role: decrypter.vaultConfig.Role,
-			path: decrypter.vaultConfig.Path,
+			role:       decrypter.vaultConfig.Role,
+			path:       decrypter.vaultConfig.Path,
+			tokenPath:  decrypter.vaultConfig.ServiceAccountTokenPath,
 			fileReader: ioutil.ReadFile,
+			logger:     decrypter.logger,
 		}
 	case "USERPASS":
 		tokenFetcher = UserPassTokenFetcher{
 			username:     decrypter.vaultConfig.Username,
 			password:     decrypter.vaultConfig.Password,
 			userAuthPath: decrypter.vaultConfig.UserAuthPath,
+			logger:       decrypter.logger,
+		}
+	case "APPROLE":
+		cfg := decrypter.vaultConfig
+		tokenFetcher = AppRoleTokenFetcher{
+			roleID:          credential{value: cfg.RoleId, file: cfg.RoleIdFile, env: cfg.RoleIdEnv},
+			secretID:        credential{value: cfg.SecretId, file: cfg.SecretIdFile, env: cfg.SecretIdEnv},
+			secretIDWrapped: cfg.SecretIdWrapped,
+			path:            authPath(cfg.Path, "approle"),
+			fileReader:      ioutil.ReadFile,
+			logger:          decrypter.logger,
+		}
+	case "AWS_IAM":
+		region := decrypter.vaultConfig.AwsRegion
+		if region == "" {
+			region = defaultAwsIamRegion
+		}
+		tokenFetcher = AwsIamTokenFetcher{
+			role:     decrypter.vaultConfig.Role,
+			path:     authPath(decrypter.vaultConfig.Path, "aws"),
+			region:   region,
+			serverID: decrypter.vaultConfig.IamServerIdHeader,
+			logger:   decrypter.logger,
+		}
+	case "JWT":
+		cfg := decrypter.vaultConfig
+		tokenFetcher = JwtTokenFetcher{
+			role:       cfg.Role,
+			path:       authPath(cfg.Path, "jwt"),
+			jwt:        credential{value: cfg.Jwt, file: cfg.JwtFile, env: cfg.JwtEnv},
+			audience:   cfg.JwtAudience,
+			fileReader: ioutil.ReadFile,
+			logger:     decrypter.logger,
+		}
+	case "GCP":
+		authType := decrypter.vaultConfig.GcpAuthType
+		if authType == "" {
+			authType = gcpAuthTypeGce
+		}
+		tokenFetcher = GcpTokenFetcher{
+			role:           decrypter.vaultConfig.Role,
+			path:           authPath(decrypter.vaultConfig.Path, "gcp"),
+			authType:       authType,
+			serviceAccount: decrypter.vaultConfig.GcpServiceAccount,
+			iamEndpoint:    iamCredentialsEndpoint,
+			logger:         decrypter.logger,
+		}
+	case "CERT":
+		tokenFetcher = CertTokenFetcher{
+			role:   decrypter.vaultConfig.Role,
+			path:   authPath(decrypter.vaultConfig.Path, "cert"),
+			logger: decrypter.logger,
 		}
 	default:
-		return fmt.Errorf("unknown Vault secrets auth method: %q", decrypter.vaultConfig.AuthMethod)
+		return newError(ErrAuthFailed, "vault", nil, fmt.Sprintf("unknown Vault secrets auth method: %q", decrypter.vaultConfig.AuthMethod))
 	}
 
 	decrypter.tokenFetcher = tokenFetcher
@@ -161,65 +365,112 @@ func (decrypter *VaultDecrypter) setTokenFetcher() error {
 }
 
 func (decrypter *VaultDecrypter) Decrypt() (string, error) {
-	if decrypter.vaultConfig.Token == "" {
-		err := decrypter.setToken()
-		if err != nil {
-			return "", err
-		}
-	}
-	client, err := decrypter.getVaultClient()
+	return decrypter.DecryptContext(context.Background())
+}
+
+func (decrypter *VaultDecrypter) DecryptContext(ctx context.Context) (string, error) {
+	v, err := decrypter.DecryptValue(ctx)
 	if err != nil {
 		return "", err
 	}
-	secret, err := decrypter.fetchSecret(client)
-	if err != nil && strings.Contains(err.Error(), "403") {
-		// get new token and retry in case our saved token is no longer valid
-		err := decrypter.setToken()
-		if err != nil {
-			return "", err
+	return FormatValue(v)
+}
+
+// DecryptValue returns the secret as stored in Vault, see StructuredDecrypter.
+// With the 'b' parameter, the secret is base64 decoded first, so that binary
+// files such as keystores can be stored in Vault.
+func (decrypter *VaultDecrypter) DecryptValue(ctx context.Context) (interface{}, error) {
+	if err := decrypter.setToken(ctx); err != nil {
+		return nil, err
+	}
+	client, err := decrypter.getVaultClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fetch := decrypter.fetchValue
+	if decrypter.dynamic {
+		fetch = decrypter.fetchDynamicValue
+	} else {
+		decrypter.kvVersion = decrypter.connection().kvVersion(ctx, client, decrypter.engine)
+	}
+	secret, err := fetch(ctx, client)
+	if errors.Is(err, ErrPermissionDenied) && decrypter.tokenRejected(ctx) {
+		// get new token and retry, our saved token is no longer valid
+		decrypter.tokenManager().invalidate(decrypter.vaultConfig.Token)
+		if err := decrypter.setToken(ctx); err != nil {
+			return nil, err
+		}
+		if client, err = decrypter.getVaultClient(ctx); err != nil {
+			return nil, err
 		}
-		secret, err = decrypter.fetchSecret(client)
+		secret, err = fetch(ctx, client)
 	}
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if b, _ := strconv.ParseBool(decrypter.base64Encoded); b {
+		decoded, err := decrypter.decodeBase64(secret)
+		if err != nil {
+			return nil, err
+		}
+		if decrypter.IsFile() {
+			return ToTempFile(decoded)
+		}
+		return string(decoded), nil
 	}
 	if decrypter.IsFile() {
-		return ToTempFile([]byte(secret))
+		content, err := FormatValue(secret)
+		if err != nil {
+			return nil, err
+		}
+		return ToTempFile([]byte(content))
 	}
 	return secret, nil
 }
 
+func (decrypter *VaultDecrypter) log() logging.Logger {
+	return logging.OrDefault(decrypter.logger)
+}
+
 func (v *VaultDecrypter) IsFile() bool {
 	return v.isFile
 }
 
+// LeaseDuration returns the lease of the last secret read, as reported by Vault.
+func (v *VaultDecrypter) LeaseDuration() time.Duration {
+	return v.leaseDuration
+}
+
+// LeaseDone returns a channel closed once the lease of the last dynamic secret
+// read can't be renewed anymore, nil for other secrets.
+func (v *VaultDecrypter) LeaseDone() <-chan struct{} {
+	return v.leaseDone
+}
+
 func (v *VaultDecrypter) parseSyntax(params string) error {
-	tokens := strings.Split(params, "!")
-	for _, element := range tokens {
-		kv := strings.Split(element, ":")
-		if len(kv) == 2 {
-			switch kv[0] {
-			case "e":
-				v.engine = kv[1]
-			case "p", "n":
-				v.path = kv[1]
-			case "k":
-				v.key = kv[1]
-			case "b":
-				v.base64Encoded = kv[1]
-			}
-		}
+	p, err := engineParams("vault", params)
+	if err != nil {
+		return err
 	}
+	v.engine, v.path, v.key, v.base64Encoded = p["e"], p["p"], p["k"], p["b"]
+	v.version, v.metadataKey = p["v"], p["m"]
 
 	if v.engine == "" {
-		return fmt.Errorf("secret format error - 'e' for engine is required")
+		return malformed("vault", "secret format error - 'e' for engine is required")
 	}
 	if v.path == "" {
-		return fmt.Errorf("secret format error - 'p' for path is required (replaces deprecated 'n' param)")
+		return malformed("vault", "secret format error - 'p' for path is required (replaces deprecated 'n' param)")
+	}
+	if msg := checkVaultKeys(v.key, v.metadataKey, v.version); msg != "" {
+		return malformed("vault", "secret format error - "+msg)
+	}
+	if msg := checkFlag("b", "base64", v.base64Encoded); msg != "" {
+		return malformed("vault", "secret format error - "+msg)
 	}
-	if v.key == "" {
-		return fmt.Errorf("secret format error - 'k' for key is required")
+	if msg := checkDynamic(p["d"], v.metadataKey, v.version); msg != "" {
+		return malformed("vault", "secret format error - "+msg)
 	}
+	v.dynamic, _ = strconv.ParseBool(p["d"])
 	return nil
 }
 
@@ -237,6 +488,10 @@ func validateVaultConfig(vaultConfig VaultConfig) error {
 		return fmt.Errorf("auth method required")
 	}
 
+	if (vaultConfig.ClientCert == "") != (vaultConfig.ClientKey == "") {
+		return fmt.Errorf("clientCert and clientKey must be set together")
+	}
+
 	switch vaultConfig.AuthMethod {
 	case "TOKEN":
 		if vaultConfig.Token == "" {
@@ -253,6 +508,36 @@ func validateVaultConfig(vaultConfig VaultConfig) error {
 		if vaultConfig.Username == "" || vaultConfig.Password == "" || vaultConfig.UserAuthPath == "" {
 			return fmt.Errorf("username, password and userAuthPath are required for USERPASS auth method")
 		}
+	case "APPROLE":
+		if vaultConfig.RoleId == "" && vaultConfig.RoleIdFile == "" && vaultConfig.RoleIdEnv == "" {
+			return fmt.Errorf("one of roleId, roleIdFile or roleIdEnv is required for APPROLE auth method")
+		}
+		if vaultConfig.SecretIdWrapped && vaultConfig.SecretId == "" && vaultConfig.SecretIdFile == "" && vaultConfig.SecretIdEnv == "" {
+			return fmt.Errorf("secretIdWrapped requires a secret ID for APPROLE auth method")
+		}
+	case "AWS_IAM":
+		// credentials come from the environment and the role defaults to the IAM principal's
+	case "JWT":
+		if vaultConfig.Jwt == "" && vaultConfig.JwtFile == "" && vaultConfig.JwtEnv == "" && vaultConfig.JwtAudience == "" {
+			return fmt.Errorf("one of jwt, jwtFile, jwtEnv or jwtAudience is required for JWT auth method")
+		}
+	case "GCP":
+		if vaultConfig.Role == "" {
+			return fmt.Errorf("role required for GCP auth method")
+		}
+		switch vaultConfig.GcpAuthType {
+		case "", gcpAuthTypeGce:
+		case gcpAuthTypeIam:
+			if vaultConfig.GcpServiceAccount == "" {
+				return fmt.Errorf("gcpServiceAccount required for GCP auth method of type iam")
+			}
+		default:
+			return fmt.Errorf("unknown gcpAuthType %q, expected gce or iam", vaultConfig.GcpAuthType)
+		}
+	case "CERT":
+		if vaultConfig.ClientCert == "" {
+			return fmt.Errorf("clientCert and clientKey required for CERT auth method")
+		}
 	default:
 		return fmt.Errorf("unknown Vault secrets auth method: %q", vaultConfig.AuthMethod)
 	}
@@ -260,33 +545,71 @@ func validateVaultConfig(vaultConfig VaultConfig) error {
 	return nil
 }
 
-func (decrypter *VaultDecrypter) setToken() error {
-	client, err := decrypter.getVaultClient()
+// setToken sets the token shared by the decrypters of the configuration,
+// logging in if needed.
+func (decrypter *VaultDecrypter) setToken(ctx context.Context) error {
+	client, err := decrypter.connection().apiClient(ctx, decrypter.newAPIClient)
 	if err != nil {
 		return err
 	}
-	token, err := decrypter.tokenFetcher.fetchToken(client)
+	token, err := decrypter.tokenManager().get(ctx, client, decrypter.tokenFetcher)
 	if err != nil {
-		return fmt.Errorf("error fetching vault token - %s", err)
+		return newError(nil, "vault", err, "error fetching vault token")
 	}
 	decrypter.vaultConfig.Token = token
 	return nil
 }
 
-func (decrypter *VaultDecrypter) getVaultClient() (*api.Logical, error) {
-	client, err := decrypter.newAPIClient()
+// tokenRejected tells whether Vault rejects the token of the decrypter itself,
+// rather than the policies of the token denying access to the secret. Only
+// then is the token shared by the other decrypters replaced.
+func (decrypter *VaultDecrypter) tokenRejected(ctx context.Context) bool {
+	client, err := decrypter.connection().tokenClient(ctx, decrypter.newAPIClient, decrypter.vaultConfig.Token)
+	if err != nil {
+		return false
+	}
+	_, err = client.Auth().Token().LookupSelfWithContext(ctx)
+	kind := errorKind(err)
+	return kind == ErrPermissionDenied || kind == ErrAuthFailed
+}
+
+func (decrypter *VaultDecrypter) tokenManager() *tokenManager {
+	return decrypter.connection().tokens
+}
+
+func (decrypter *VaultDecrypter) connection() *vaultConn {
+	if decrypter.conn == nil {
+		decrypter.conn = newVaultConn(decrypter.vaultConfig.Token, decrypter.logger)
+	}
+	return decrypter.conn
+}
+
+// getVaultClient returns the client of the configuration, using the token of
+// the decrypter.
+func (decrypter *VaultDecrypter) getVaultClient(ctx context.Context) (*api.Logical, error) {
+	client, err := decrypter.connection().tokenClient(ctx, decrypter.newAPIClient, decrypter.vaultConfig.Token)
 	if err != nil {
 		return nil, err
 	}
 	return client.Logical(), nil
 }
 
-func (decrypter *VaultDecrypter) newAPIClient() (*api.Client, error) {
-	client, err := api.NewClient(&api.Config{
+func (decrypter *VaultDecrypter) newAPIClient(ctx context.Context) (*api.Client, error) {
+	config := &api.Config{
 		Address: decrypter.vaultConfig.Url,
-	})
+	}
+	tlsConfig, err := decrypter.getTLSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if err := config.ConfigureTLS(tlsConfig); err != nil {
+			return nil, newError(nil, "vault", err, "error configuring vault TLS")
+		}
+	}
+	client, err := api.NewClient(config)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching vault client: %s", err)
+		return nil, newError(nil, "vault", err, "error fetching vault client")
 	}
 	if decrypter.vaultConfig.Namespace != "" {
 		client.SetNamespace(decrypter.vaultConfig.Namespace)
@@ -297,16 +620,35 @@ func (decrypter *VaultDecrypter) newAPIClient() (*api.Client, error) {
 	return client, nil
 }
 
+// fetchSecret reads the secret and renders it as a string.
+func (decrypter *VaultDecrypter) fetchSecret(ctx context.Context, client VaultClient) (string, error) {
+	v, err := decrypter.fetchValue(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	return FormatValue(v)
+}
 
-func (decrypter *VaultDecrypter) fetchSecret(client VaultClient) (string, error) {
+// fetchValue reads the secret, probing the KV v1 then the KV v2 path when the
+// KV version of the engine is unknown.
+func (decrypter *VaultDecrypter) fetchValue(ctx context.Context, client VaultClient) (interface{}, error) {
+	if decrypter.version != "" || decrypter.metadataKey != "" {
+		if decrypter.kvVersion == 1 {
+			return nil, malformed("vault", fmt.Sprintf("engine %s is a KV v1 engine, 'v' and 'm' require KV v2", decrypter.engine))
+		}
+		return decrypter.fetchKVSecret(ctx, client, 2)
+	}
+	if decrypter.kvVersion != 0 {
+		return decrypter.fetchKVSecret(ctx, client, decrypter.kvVersion)
+	}
 	path := decrypter.engine + "/" + decrypter.path
-	log.Infof("attempting to read secret at KV v1 path: %s", path)
-	secretMapping, v1err := client.Read(path)
+	decrypter.log().Info("attempting to read secret", "kvVersion", 1, "secretPath", path)
+	secretMapping, v1err := client.ReadWithContext(ctx, path)
 	if v1err != nil {
 		if _, ok := v1err.(*json.SyntaxError); ok {
 			// some connection errors aren't properly caught, and the vault client tries to parse <nil>
-			return "", fmt.Errorf("error fetching secret from vault - check connection to the server: %s",
-				decrypter.vaultConfig.Url)
+			return nil, newError(ErrTransient, "vault", v1err, fmt.Sprintf("error fetching secret from vault - check connection to the server: %s",
+				decrypter.vaultConfig.Url))
 		}
 	}
 
@@ -314,18 +656,42 @@ func (decrypter *VaultDecrypter) fetchSecret(client VaultClient) (string, error)
 	if containsRetryableError(v1err, secretMapping) {
 		// try again using K/V v2 path
 		path = decrypter.engine + "/data/" + decrypter.path
-		log.Infof("attempting to read secret at KV v2 path: %s", path)
-		secretMapping, v2err = client.Read(path)
+		decrypter.log().Info("attempting to read secret", "kvVersion", 2, "secretPath", path)
+		secretMapping, v2err = client.ReadWithContext(ctx, path)
 	}
 
 	if v2err != nil {
-		log.Errorf("error reading secret at KV v1 path and KV v2 path")
-		log.Errorf("KV v1 error: %s", v1err)
-		log.Errorf("KV v2 error: %s", v2err)
-		return "", fmt.Errorf("error fetching secret from vault")
+		decrypter.log().Error("error reading secret at KV v1 path and KV v2 path",
+			"secretPath", decrypter.engine+"/"+decrypter.path, "kvV1Error", v1err, "kvV2Error", v2err)
+		return nil, newError(errorKind(v2err), "vault", v2err, "error fetching secret from vault")
 	}
 
-	return decrypter.parseResults(secretMapping)
+	return decrypter.resultValue(secretMapping)
+}
+
+// fetchKVSecret reads the secret from the path of its KV version.
+func (decrypter *VaultDecrypter) fetchKVSecret(ctx context.Context, client VaultClient, kvVersion int) (interface{}, error) {
+	path := decrypter.engine + "/" + decrypter.path
+	if kvVersion == 2 {
+		path = decrypter.engine + "/data/" + decrypter.path
+	}
+	decrypter.log().Info("attempting to read secret", "kvVersion", kvVersion, "secretPath", path, "version", decrypter.version)
+	var secretMapping *api.Secret
+	var err error
+	if decrypter.version != "" {
+		secretMapping, err = client.ReadWithDataWithContext(ctx, path, map[string][]string{"version": {decrypter.version}})
+	} else {
+		secretMapping, err = client.ReadWithContext(ctx, path)
+	}
+	if err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			// some connection errors aren't properly caught, and the vault client tries to parse <nil>
+			return nil, newError(ErrTransient, "vault", err, fmt.Sprintf("error fetching secret from vault - check connection to the server: %s",
+				decrypter.vaultConfig.Url))
+		}
+		return nil, newError(errorKind(err), "vault", err, "error fetching secret from vault")
+	}
+	return decrypter.resultValue(secretMapping)
 }
 
 func containsRetryableError(err error, secret *api.Secret) bool {
@@ -342,26 +708,61 @@ func containsRetryableError(err error, secret *api.Secret) bool {
 	return false
 }
 
-func (decrypter *VaultDecrypter) parseResults(secretMapping *api.Secret) (string, error) {
+// resultValue returns the value of the key, or metadata field, of the secret
+// read from Vault.
+func (decrypter *VaultDecrypter) resultValue(secretMapping *api.Secret) (interface{}, error) {
 	if secretMapping == nil {
-		return "", fmt.Errorf("couldn't find vault path %s under engine %s", decrypter.path, decrypter.engine)
+		if decrypter.version != "" {
+			return nil, newError(ErrNotFound, "vault", nil, fmt.Sprintf("couldn't find version %s of vault path %s under engine %s", decrypter.version, decrypter.path, decrypter.engine))
+		}
+		return nil, newError(ErrNotFound, "vault", nil, fmt.Sprintf("couldn't find vault path %s under engine %s", decrypter.path, decrypter.engine))
 	}
 
 	mapping := secretMapping.Data
 	if data, ok := mapping["data"]; ok { // one more nesting of "data" if using K/V v2
 		if submap, ok := data.(map[string]interface{}); ok {
 			mapping = submap
+		} else if data == nil {
+			if err := decrypter.deletedVersionError(secretMapping); err != nil {
+				return nil, err
+			}
 		}
 	}
+	if decrypter.metadataKey != "" {
+		return decrypter.metadataValue(secretMapping)
+	}
 
-	decrypted, ok := mapping[decrypter.key].(string)
-	if !ok {
-		return "", fmt.Errorf("key %q not found at engine: %s, path: %s", decrypter.key, decrypter.engine, decrypter.path)
+	decrypted, ok := mapping[decrypter.key]
+	if !ok || decrypted == nil {
+		return nil, newError(ErrNotFound, "vault", nil, fmt.Sprintf("key %q not found at engine: %s, path: %s", decrypter.key, decrypter.engine, decrypter.path))
 	}
-	log.Debugf("successfully fetched secret")
+	decrypter.leaseDuration = time.Duration(secretMapping.LeaseDuration) * time.Second
+	decrypter.log().Debug("successfully fetched secret", "secretPath", decrypter.engine+"/"+decrypter.path)
 	return decrypted, nil
 }
 
+// checkFlag checks a boolean parameter of a vault reference, such as 'b' for
+// base64, and returns what's wrong with it, if anything.
+func checkFlag(key, name, flag string) string {
+	if _, err := strconv.ParseBool(flag); flag != "" && err != nil {
+		return fmt.Sprintf("'%s' for %s must be true or false, not %q", key, name, flag)
+	}
+	return ""
+}
+
+// decodeBase64 decodes a base64 encoded secret, ignoring line breaks.
+func (decrypter *VaultDecrypter) decodeBase64(secret interface{}) ([]byte, error) {
+	encoded, ok := secret.(string)
+	if !ok {
+		return nil, newError(nil, "vault", nil, fmt.Sprintf("key %q at engine: %s, path: %s is a %T, not a base64 string", decrypter.key, decrypter.engine, decrypter.path, secret))
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, newError(nil, "vault", err, fmt.Sprintf("key %q at engine: %s, path: %s isn't valid base64", decrypter.key, decrypter.engine, decrypter.path))
+	}
+	return decoded, nil
+}
+
 func DecodeVaultConfig(vaultYaml map[interface{}]interface{}) (*VaultConfig, error) {
 	var cfg VaultConfig
 	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
@@ -0,0 +1,417 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/hashicorp/vault/api"
+	"golang.org/x/oauth2/google"
+
+	"github.com/armory/go-yaml-tools/pkg/logging"
+)
+
+// credential is a login parameter given directly, read from a file or from an
+// environment variable, in that order of precedence.
+type credential struct {
+	value string
+	file  string
+	env   string
+}
+
+func (c credential) isSet() bool {
+	return c.value != "" || c.file != "" || c.env != ""
+}
+
+// read returns the credential, without the surrounding whitespace of files.
+func (c credential) read(readFile fileReader) (string, error) {
+	switch {
+	case c.value != "":
+		return c.value, nil
+	case c.file != "":
+		b, err := readFile(c.file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case c.env != "":
+		v, ok := os.LookupEnv(c.env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", c.env)
+		}
+		return v, nil
+	}
+	return "", nil
+}
+
+// authPath returns the mount path of an auth method, path if configured.
+func authPath(path, defaultPath string) string {
+	if path == "" {
+		return defaultPath
+	}
+	return strings.Trim(path, "/")
+}
+
+// login logs in with an auth method, loginPath being its login endpoint.
+func login(ctx context.Context, client VaultClient, logger logging.Logger, authMethod, loginPath string, data map[string]interface{}) (*vaultAuth, error) {
+	logging.OrDefault(logger).Info("logging into vault", "authMethod", authMethod, "loginPath", loginPath)
+	secret, err := client.WriteWithContext(ctx, loginPath, data)
+	if err != nil {
+		_, err = handleLoginErrors(err)
+		return nil, err
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, newError(ErrAuthFailed, "vault", nil, "error logging into vault: no token returned")
+	}
+	return &vaultAuth{
+		token:     secret.Auth.ClientToken,
+		renewable: secret.Auth.Renewable,
+		ttl:       time.Duration(secret.Auth.LeaseDuration) * time.Second,
+	}, nil
+}
+
+type AppRoleTokenFetcher struct {
+	roleID   credential
+	secretID credential
+	// secretIDWrapped is set when the secret ID is a response wrapping token
+	secretIDWrapped bool
+	path            string
+	fileReader      fileReader
+	logger          logging.Logger
+}
+
+func (a AppRoleTokenFetcher) fetchToken(ctx context.Context, client VaultClient) (string, error) {
+	return tokenOf(a.fetchAuth(ctx, client))
+}
+
+func (a AppRoleTokenFetcher) fetchAuth(ctx context.Context, client VaultClient) (*vaultAuth, error) {
+	roleID, err := a.roleID.read(a.fileReader)
+	if err != nil {
+		return nil, newError(ErrAuthFailed, "vault", err, "error reading approle role ID")
+	}
+	data := map[string]interface{}{"role_id": roleID}
+	if a.secretID.isSet() {
+		secretID, err := a.secretID.read(a.fileReader)
+		if err != nil {
+			return nil, newError(ErrAuthFailed, "vault", err, "error reading approle secret ID")
+		}
+		if a.secretIDWrapped {
+			if secretID, err = a.unwrapSecretID(ctx, client, secretID); err != nil {
+				return nil, err
+			}
+		}
+		data["secret_id"] = secretID
+	}
+	return login(ctx, client, a.logger, "APPROLE", "auth/"+a.path+"/login", data)
+}
+
+// unwrapSecretID returns the secret ID wrapped by the given wrapping token.
+func (a AppRoleTokenFetcher) unwrapSecretID(ctx context.Context, client VaultClient, wrappingToken string) (string, error) {
+	unwrapper, ok := client.(vaultUnwrapper)
+	if !ok {
+		return "", newError(ErrAuthFailed, "vault", nil, "error unwrapping approle secret ID: the vault client can't unwrap responses")
+	}
+	secret, err := unwrapper.UnwrapWithContext(ctx, wrappingToken)
+	if err != nil {
+		return "", newError(ErrAuthFailed, "vault", err, "error unwrapping approle secret ID")
+	}
+	if secret != nil {
+		if secretID, ok := secret.Data["secret_id"].(string); ok {
+			return secretID, nil
+		}
+	}
+	return "", newError(ErrAuthFailed, "vault", nil, "error unwrapping approle secret ID: no secret_id in the wrapped response")
+}
+
+// vaultUnwrapper unwraps response wrapped secrets, Vault requiring the
+// wrapping token as the client token.
+type vaultUnwrapper interface {
+	UnwrapWithContext(ctx context.Context, wrappingToken string) (*api.Secret, error)
+}
+
+// loginClient is the VaultClient logins are made with. It unwraps with a copy
+// of the client using the wrapping token, since api.Logical would set it on
+// the client logins share.
+type loginClient struct {
+	*api.Logical
+	client *api.Client
+}
+
+func newLoginClient(client *api.Client) loginClient {
+	return loginClient{Logical: client.Logical(), client: client}
+}
+
+func (c loginClient) UnwrapWithContext(ctx context.Context, wrappingToken string) (*api.Secret, error) {
+	clone, err := c.client.CloneWithHeaders()
+	if err != nil {
+		return nil, err
+	}
+	clone.SetToken(wrappingToken)
+	return clone.Logical().UnwrapWithContext(ctx, wrappingToken)
+}
+
+// defaultAwsIamRegion signs requests for the global STS endpoint, the one
+// Vault expects unless its aws auth method is configured otherwise.
+const defaultAwsIamRegion = "us-east-1"
+
+type AwsIamTokenFetcher struct {
+	role     string
+	path     string
+	region   string
+	serverID string
+	// credentials are those of the default AWS credential chain when nil
+	credentials *credentials.Credentials
+	logger      logging.Logger
+}
+
+func (a AwsIamTokenFetcher) fetchToken(ctx context.Context, client VaultClient) (string, error) {
+	return tokenOf(a.fetchAuth(ctx, client))
+}
+
+func (a AwsIamTokenFetcher) fetchAuth(ctx context.Context, client VaultClient) (*vaultAuth, error) {
+	data, err := a.loginData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return login(ctx, client, a.logger, "AWS_IAM", "auth/"+a.path+"/login", data)
+}
+
+// loginData signs an sts:GetCallerIdentity request that Vault replays to
+// check the identity of the caller.
+func (a AwsIamTokenFetcher) loginData(ctx context.Context) (map[string]interface{}, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(a.region),
+		Credentials: a.credentials,
+	})
+	if err != nil {
+		return nil, newError(ErrAuthFailed, "vault", err, "unable to create AWS session")
+	}
+	req, _ := sts.New(sess).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	req.SetContext(ctx)
+	if a.serverID != "" {
+		req.HTTPRequest.Header.Set("X-Vault-AWS-IAM-Server-ID", a.serverID)
+	}
+	if err := req.Sign(); err != nil {
+		return nil, newError(ErrAuthFailed, "vault", err, "unable to sign sts:GetCallerIdentity request")
+	}
+	headers, err := json.Marshal(req.HTTPRequest.Header)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(req.HTTPRequest.Body)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{
+		"iam_http_request_method": req.HTTPRequest.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(req.HTTPRequest.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+	}
+	if a.role != "" {
+		data["role"] = a.role
+	}
+	return data, nil
+}
+
+// CertTokenFetcher logs in with the client certificate of the TLS connection,
+// role being the name of a certificate role, the matching one when empty.
+type CertTokenFetcher struct {
+	role   string
+	path   string
+	logger logging.Logger
+}
+
+func (c CertTokenFetcher) fetchToken(ctx context.Context, client VaultClient) (string, error) {
+	return tokenOf(c.fetchAuth(ctx, client))
+}
+
+func (c CertTokenFetcher) fetchAuth(ctx context.Context, client VaultClient) (*vaultAuth, error) {
+	data := map[string]interface{}{}
+	if c.role != "" {
+		data["name"] = c.role
+	}
+	return login(ctx, client, c.logger, "CERT", "auth/"+c.path+"/login", data)
+}
+
+// JwtTokenFetcher logs in with a signed JWT, such as a CI OIDC token, read
+// from a file or an environment variable, or a GCP identity token requested
+// from the metadata server when no JWT is configured.
+type JwtTokenFetcher struct {
+	role string
+	path string
+	jwt  credential
+	// audience is the one of the identity tokens requested from the metadata server
+	audience   string
+	fileReader fileReader
+	httpClient *http.Client
+	logger     logging.Logger
+}
+
+func (j JwtTokenFetcher) fetchToken(ctx context.Context, client VaultClient) (string, error) {
+	return tokenOf(j.fetchAuth(ctx, client))
+}
+
+func (j JwtTokenFetcher) fetchAuth(ctx context.Context, client VaultClient) (*vaultAuth, error) {
+	var jwt string
+	var err error
+	if j.jwt.isSet() {
+		if jwt, err = j.jwt.read(j.fileReader); err != nil {
+			return nil, newError(ErrAuthFailed, "vault", err, "error reading JWT")
+		}
+	} else if jwt, err = gcpIdentityToken(ctx, j.httpClient, j.audience); err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{"jwt": jwt}
+	if j.role != "" {
+		data["role"] = j.role
+	}
+	return login(ctx, client, j.logger, "JWT", "auth/"+j.path+"/login", data)
+}
+
+const (
+	gcpAuthTypeGce = "gce"
+	gcpAuthTypeIam = "iam"
+
+	// gcpIamJwtLifetime is how long signed iam JWTs are valid, Vault rejects
+	// JWTs expiring more than 15 minutes later by default.
+	gcpIamJwtLifetime = 10 * time.Minute
+
+	iamCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+)
+
+// GcpTokenFetcher logs in with Vault's gcp auth method, either as the GCE
+// instance, with an instance identity token from the metadata server, or as
+// a service account, with a JWT signed by the IAM credentials API.
+type GcpTokenFetcher struct {
+	role           string
+	path           string
+	authType       string
+	serviceAccount string
+	// iamEndpoint and iamClient are the IAM credentials API and the client
+	// calling it, one using the application default credentials when nil
+	iamEndpoint string
+	iamClient   *http.Client
+	httpClient  *http.Client
+	logger      logging.Logger
+}
+
+func (g GcpTokenFetcher) fetchToken(ctx context.Context, client VaultClient) (string, error) {
+	return tokenOf(g.fetchAuth(ctx, client))
+}
+
+func (g GcpTokenFetcher) fetchAuth(ctx context.Context, client VaultClient) (*vaultAuth, error) {
+	var jwt string
+	var err error
+	if g.authType == gcpAuthTypeIam {
+		jwt, err = g.signJwt(ctx)
+	} else {
+		jwt, err = gcpIdentityToken(ctx, g.httpClient, "http://vault/"+g.role)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return login(ctx, client, g.logger, "GCP", "auth/"+g.path+"/login", map[string]interface{}{"role": g.role, "jwt": jwt})
+}
+
+// signJwt has the IAM credentials API sign a JWT for the Vault role as the
+// service account.
+func (g GcpTokenFetcher) signJwt(ctx context.Context) (string, error) {
+	iamClient := g.iamClient
+	if iamClient == nil {
+		var err error
+		if iamClient, err = google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform"); err != nil {
+			return "", newError(ErrAuthFailed, "vault", err, "unable to find GCP credentials")
+		}
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"aud": "vault/" + g.role,
+		"sub": g.serviceAccount,
+		"exp": time.Now().Add(gcpIamJwtLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"payload": string(payload)})
+	if err != nil {
+		return "", err
+	}
+	u := g.iamEndpoint + "/v1/projects/-/serviceAccounts/" + url.PathEscape(g.serviceAccount) + ":signJwt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := gcpRequest(iamClient, req, "a signed JWT from the IAM credentials API")
+	if err != nil {
+		return "", err
+	}
+	var signed struct {
+		SignedJwt string `json:"signedJwt"`
+	}
+	if err := json.Unmarshal(resp, &signed); err != nil || signed.SignedJwt == "" {
+		return "", newError(ErrAuthFailed, "vault", err, "error reading the JWT signed by the IAM credentials API")
+	}
+	return signed.SignedJwt, nil
+}
+
+// gcpIdentityToken requests an identity token for audience from the GCP
+// metadata server, the one of GCE_METADATA_HOST if set.
+func gcpIdentityToken(ctx context.Context, httpClient *http.Client, audience string) (string, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	u := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/identity?" +
+		url.Values{"audience": {audience}, "format": {"full"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	token, err := gcpRequest(httpClient, req, "an identity token from the GCP metadata server")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// gcpRequest returns the body of the successful response to req. Failures are
+// authentication failures unless they're transient.
+func gcpRequest(client *http.Client, req *http.Request, what string) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		kind := errorKind(err)
+		if kind != ErrTransient {
+			kind = ErrAuthFailed
+		}
+		return nil, newError(kind, "vault", err, "error requesting "+what)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newError(ErrTransient, "vault", err, "error requesting "+what)
+	}
+	if resp.StatusCode != http.StatusOK {
+		kind := ErrAuthFailed
+		if statusKind(resp.StatusCode) == ErrTransient {
+			kind = ErrTransient
+		}
+		return nil, newError(kind, "vault", nil, fmt.Sprintf("error requesting %s: %s: %s", what, resp.Status, strings.TrimSpace(string(body))))
+	}
+	return body, nil
+}
@@ -0,0 +1,357 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeVault starts an httptest stand-in for Vault answering each path, such
+// as "/v1/auth/approle/login", with its handler, and returns a client for it.
+// Unless handled, mounts can't be looked up, as with tokens not allowed to.
+func newFakeVault(t *testing.T, handlers map[string]http.HandlerFunc) *api.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := handlers[r.URL.Path]
+		if !ok && strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/") {
+			writeJSON(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		if !ok {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ClearToken()
+	return client
+}
+
+// decodeBody decodes the JSON body of r.
+func decodeBody(t *testing.T, r *http.Request) map[string]interface{} {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		t.Errorf("invalid request body: %v", err)
+	}
+	return body
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func loginResponse(token string) map[string]interface{} {
+	return map[string]interface{}{"auth": map[string]interface{}{"client_token": token}}
+}
+
+func TestAppRoleAuth(t *testing.T) {
+	roleIDFile := filepath.Join(t.TempDir(), "role-id")
+	assert.NoError(t, os.WriteFile(roleIDFile, []byte("my-role-id\n"), 0600))
+	t.Setenv("APPROLE_SECRET_ID", "wrapping-token")
+
+	var unwrapped bool
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/sys/wrapping/unwrap": func(w http.ResponseWriter, r *http.Request) {
+			// Vault only unwraps with the wrapping token as the client token
+			if r.Header.Get("X-Vault-Token") != "wrapping-token" {
+				writeJSON(w, 400, map[string]interface{}{"errors": []string{"missing client token"}})
+				return
+			}
+			unwrapped = true
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"secret_id": "my-secret-id"}})
+		},
+		"/v1/auth/ci-approle/login": func(w http.ResponseWriter, r *http.Request) {
+			body := decodeBody(t, r)
+			if body["role_id"] != "my-role-id" || body["secret_id"] != "my-secret-id" {
+				writeJSON(w, 400, map[string]interface{}{"errors": []string{"invalid role or secret ID"}})
+				return
+			}
+			writeJSON(w, 200, loginResponse("approle-token"))
+		},
+	})
+
+	cfg := VaultConfig{
+		Enabled:         true,
+		Url:             client.Address(),
+		AuthMethod:      "APPROLE",
+		Path:            "ci-approle",
+		RoleIdFile:      roleIDFile,
+		SecretIdEnv:     "APPROLE_SECRET_ID",
+		SecretIdWrapped: true,
+	}
+	assert.NoError(t, validateVaultConfig(cfg))
+	d := &VaultDecrypter{vaultConfig: cfg}
+	assert.NoError(t, d.setTokenFetcher())
+	clientToken := client.Token()
+	token, err := d.tokenFetcher.fetchToken(context.Background(), newLoginClient(client))
+	assert.NoError(t, err)
+	assert.Equal(t, "approle-token", token)
+	assert.True(t, unwrapped)
+	// the wrapping token isn't left on the client logins share
+	assert.Equal(t, clientToken, client.Token())
+
+	// without unwrapping, the wrapping token is sent as the secret ID
+	cfg.SecretIdWrapped = false
+	d = &VaultDecrypter{vaultConfig: cfg}
+	assert.NoError(t, d.setTokenFetcher())
+	_, err = d.tokenFetcher.fetchToken(context.Background(), client.Logical())
+	assert.True(t, errors.Is(err, ErrAuthFailed), "error was %v", err)
+}
+
+func TestAppRoleAuthDefaults(t *testing.T) {
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			body := decodeBody(t, r)
+			assert.Equal(t, map[string]interface{}{"role_id": "my-role-id"}, body)
+			writeJSON(w, 200, loginResponse("approle-token"))
+		},
+	})
+	d := &VaultDecrypter{vaultConfig: VaultConfig{AuthMethod: "APPROLE", RoleId: "my-role-id"}}
+	assert.NoError(t, d.setTokenFetcher())
+	token, err := d.tokenFetcher.fetchToken(context.Background(), client.Logical())
+	assert.NoError(t, err)
+	assert.Equal(t, "approle-token", token)
+
+	d = &VaultDecrypter{vaultConfig: VaultConfig{AuthMethod: "APPROLE", RoleIdEnv: "NOT_SET_ROLE_ID"}}
+	assert.NoError(t, d.setTokenFetcher())
+	_, err = d.tokenFetcher.fetchToken(context.Background(), client.Logical())
+	assert.EqualError(t, err, "error reading approle role ID: environment variable NOT_SET_ROLE_ID not set")
+}
+
+func TestValidateAppRoleConfig(t *testing.T) {
+	cfg := VaultConfig{Enabled: true, Url: "http://vault", AuthMethod: "APPROLE"}
+	assert.EqualError(t, validateVaultConfig(cfg), "one of roleId, roleIdFile or roleIdEnv is required for APPROLE auth method")
+	cfg.RoleIdEnv = "ROLE_ID"
+	assert.NoError(t, validateVaultConfig(cfg))
+	cfg.SecretIdWrapped = true
+	assert.EqualError(t, validateVaultConfig(cfg), "secretIdWrapped requires a secret ID for APPROLE auth method")
+}
+
+func TestAwsIamAuth(t *testing.T) {
+	decode := func(v interface{}) string {
+		b, err := base64.StdEncoding.DecodeString(v.(string))
+		assert.NoError(t, err)
+		return string(b)
+	}
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/aws-prod/login": func(w http.ResponseWriter, r *http.Request) {
+			body := decodeBody(t, r)
+			assert.Equal(t, "my-role", body["role"])
+			assert.Equal(t, "POST", body["iam_http_request_method"])
+			assert.Equal(t, "https://sts.amazonaws.com/", decode(body["iam_request_url"]))
+			assert.Equal(t, "Action=GetCallerIdentity&Version=2011-06-15", decode(body["iam_request_body"]))
+			var headers http.Header
+			assert.NoError(t, json.Unmarshal([]byte(decode(body["iam_request_headers"])), &headers))
+			assert.Equal(t, "vault.example.com", headers.Get("X-Vault-AWS-IAM-Server-ID"))
+			assert.Contains(t, headers.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/")
+			assert.Contains(t, headers.Get("Authorization"), "x-vault-aws-iam-server-id")
+			writeJSON(w, 200, loginResponse("aws-token"))
+		},
+	})
+
+	d := &VaultDecrypter{vaultConfig: VaultConfig{
+		AuthMethod:        "AWS_IAM",
+		Role:              "my-role",
+		Path:              "aws-prod",
+		IamServerIdHeader: "vault.example.com",
+	}}
+	assert.NoError(t, d.setTokenFetcher())
+	fetcher := d.tokenFetcher.(AwsIamTokenFetcher)
+	assert.Equal(t, "us-east-1", fetcher.region)
+	fetcher.credentials = credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")
+
+	token, err := fetcher.fetchToken(context.Background(), client.Logical())
+	assert.NoError(t, err)
+	assert.Equal(t, "aws-token", token)
+}
+
+// newFakeMetadataServer points GCE_METADATA_HOST to a stand-in for the GCP
+// metadata server issuing identity tokens named after their audience.
+func newFakeMetadataServer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/identity" || r.Header.Get("Metadata-Flavor") != "Google" {
+			http.NotFound(w, r)
+			return
+		}
+		assert.Equal(t, "full", r.URL.Query().Get("format"))
+		w.Write([]byte("identity-token-for-" + r.URL.Query().Get("audience")))
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+}
+
+func TestJwtAuth(t *testing.T) {
+	newFakeMetadataServer(t)
+	jwtFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(jwtFile, []byte("file-jwt\n"), 0600))
+	t.Setenv("CI_JWT", "env-jwt")
+
+	var logins []map[string]interface{}
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/jwt/login": func(w http.ResponseWriter, r *http.Request) {
+			logins = append(logins, decodeBody(t, r))
+			writeJSON(w, 200, loginResponse("jwt-token"))
+		},
+	})
+
+	cases := []VaultConfig{
+		{AuthMethod: "JWT", Role: "ci", JwtFile: jwtFile},
+		{AuthMethod: "JWT", JwtEnv: "CI_JWT"},
+		{AuthMethod: "JWT", Role: "gke", JwtAudience: "https://vault.example.com"},
+	}
+	for _, cfg := range cases {
+		d := &VaultDecrypter{vaultConfig: cfg}
+		assert.NoError(t, d.setTokenFetcher())
+		token, err := d.tokenFetcher.fetchToken(context.Background(), client.Logical())
+		assert.NoError(t, err)
+		assert.Equal(t, "jwt-token", token)
+	}
+	assert.Equal(t, []map[string]interface{}{
+		{"role": "ci", "jwt": "file-jwt"},
+		{"jwt": "env-jwt"},
+		{"role": "gke", "jwt": "identity-token-for-https://vault.example.com"},
+	}, logins)
+
+	cfg := VaultConfig{Enabled: true, Url: "http://vault", AuthMethod: "JWT"}
+	assert.EqualError(t, validateVaultConfig(cfg), "one of jwt, jwtFile, jwtEnv or jwtAudience is required for JWT auth method")
+}
+
+func TestGcpAuth(t *testing.T) {
+	newFakeMetadataServer(t)
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/projects/-/serviceAccounts/vault@project.iam.gserviceaccount.com:signJwt", r.URL.Path)
+		var payload map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(decodeBody(t, r)["payload"].(string)), &payload))
+		assert.Equal(t, "vault/my-role", payload["aud"])
+		assert.Equal(t, "vault@project.iam.gserviceaccount.com", payload["sub"])
+		writeJSON(w, 200, map[string]string{"keyId": "key", "signedJwt": "signed-jwt"})
+	}))
+	defer iam.Close()
+
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/gcp/login": func(w http.ResponseWriter, r *http.Request) {
+			body := decodeBody(t, r)
+			assert.Equal(t, "my-role", body["role"])
+			writeJSON(w, 200, loginResponse("gcp-token-with-"+body["jwt"].(string)))
+		},
+	})
+
+	d := &VaultDecrypter{vaultConfig: VaultConfig{AuthMethod: "GCP", Role: "my-role"}}
+	assert.NoError(t, d.setTokenFetcher())
+	token, err := d.tokenFetcher.fetchToken(context.Background(), client.Logical())
+	assert.NoError(t, err)
+	assert.Equal(t, "gcp-token-with-identity-token-for-http://vault/my-role", token)
+
+	d = &VaultDecrypter{vaultConfig: VaultConfig{AuthMethod: "GCP", Role: "my-role", GcpAuthType: "iam", GcpServiceAccount: "vault@project.iam.gserviceaccount.com"}}
+	assert.NoError(t, d.setTokenFetcher())
+	fetcher := d.tokenFetcher.(GcpTokenFetcher)
+	fetcher.iamEndpoint, fetcher.iamClient = iam.URL, iam.Client()
+	token, err = fetcher.fetchToken(context.Background(), client.Logical())
+	assert.NoError(t, err)
+	assert.Equal(t, "gcp-token-with-signed-jwt", token)
+
+	// the metadata server refusing to issue a token is an authentication failure
+	refusing := httptest.NewServer(http.NotFoundHandler())
+	defer refusing.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(refusing.URL, "http://"))
+	d = &VaultDecrypter{vaultConfig: VaultConfig{AuthMethod: "GCP", Role: "my-role"}}
+	assert.NoError(t, d.setTokenFetcher())
+	_, err = d.tokenFetcher.fetchToken(context.Background(), client.Logical())
+	assert.True(t, errors.Is(err, ErrAuthFailed), "error was %v", err)
+}
+
+func TestValidateGcpConfig(t *testing.T) {
+	cfg := VaultConfig{Enabled: true, Url: "http://vault", AuthMethod: "GCP"}
+	assert.EqualError(t, validateVaultConfig(cfg), "role required for GCP auth method")
+	cfg.Role = "my-role"
+	assert.NoError(t, validateVaultConfig(cfg))
+	cfg.GcpAuthType = "iam"
+	assert.EqualError(t, validateVaultConfig(cfg), "gcpServiceAccount required for GCP auth method of type iam")
+	cfg.GcpAuthType = "gke"
+	assert.EqualError(t, validateVaultConfig(cfg), `unknown gcpAuthType "gke", expected gce or iam`)
+}
+
+// testJwt returns an unsigned JWT expiring at exp.
+func testJwt(exp time.Time) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(fmt.Sprintf(`{"sub":"system:serviceaccount:ns:app","exp":%d}`, exp.Unix()))) + ".sig"
+}
+
+func TestJwtExpiry(t *testing.T) {
+	exp := time.Unix(1900000000, 0)
+	assert.Equal(t, exp, jwtExpiry(testJwt(exp)))
+	assert.True(t, jwtExpiry("mock-k8s-token").IsZero())
+	assert.True(t, jwtExpiry("a.!!!.c").IsZero())
+	assert.True(t, jwtExpiry("a."+base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"x"}`))+".c").IsZero())
+}
+
+func TestKubernetesProjectedToken(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "vault-token")
+	var logins, revoked []string
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/kubernetes/login": func(w http.ResponseWriter, r *http.Request) {
+			body := decodeBody(t, r)
+			logins = append(logins, body["jwt"].(string))
+			writeJSON(w, 200, loginResponse(fmt.Sprintf("token-%d", len(logins))))
+		},
+		"/v1/secret/db": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"password": r.Header.Get("X-Vault-Token")}})
+		},
+		"/v1/auth/token/revoke-self": func(w http.ResponseWriter, r *http.Request) {
+			revoked = append(revoked, r.Header.Get("X-Vault-Token"))
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	cfg := VaultConfig{
+		Enabled:                 true,
+		Url:                     client.Address(),
+		AuthMethod:              "KUBERNETES",
+		Role:                    "app",
+		Path:                    "kubernetes",
+		ServiceAccountTokenPath: tokenPath,
+	}
+	engines := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, cfg))
+	d, err := engines.NewDecrypter(context.Background(), "encrypted:vault!e:secret!p:db!k:password")
+	assert.NoError(t, err)
+
+	// a token about to expire is used for a single login
+	expiring := testJwt(time.Now().Add(30 * time.Second))
+	assert.NoError(t, os.WriteFile(tokenPath, []byte(expiring), 0600))
+	s, err := d.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", s)
+
+	// once rotated, the new token is read for the next login
+	rotated := testJwt(time.Now().Add(time.Hour))
+	assert.NoError(t, os.WriteFile(tokenPath, []byte(rotated), 0600))
+	s, err = d.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", s)
+	s, err = d.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", s)
+	assert.Equal(t, []string{expiring, rotated}, logins)
+	// the token of the first login is revoked when replaced
+	assert.Equal(t, []string{"token-1"}, revoked)
+}
@@ -0,0 +1,222 @@
+package secrets
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/armory/go-yaml-tools/pkg/logging"
+)
+
+// vaultConn is what the decrypters of a VaultConfig share: the token, an API
+// client and the KV version of the engines they read.
+type vaultConn struct {
+	tokens *tokenManager
+	logger logging.Logger
+
+	mu sync.Mutex
+	// client has no token, to log in, authClient is a copy of it using the
+	// token of authToken
+	client     *api.Client
+	authClient *api.Client
+	authToken  string
+	// kvVersions is the KV version of each engine, 0 when unknown
+	kvVersions map[string]int
+	// leases holds the dynamic secrets read, by path
+	leases map[string]*leaseEntry
+
+	// refs counts the registries whose vault engine uses the connection,
+	// guarded by vaultConns
+	refs int
+}
+
+func newVaultConn(token string, logger logging.Logger) *vaultConn {
+	return &vaultConn{
+		tokens:     newTokenManager(token, logger),
+		logger:     logger,
+		kvVersions: map[string]int{},
+		leases:     map[string]*leaseEntry{},
+	}
+}
+
+// vaultConns holds the connection of each registered VaultConfig.
+var vaultConns = struct {
+	sync.Mutex
+	m map[VaultConfig]*vaultConn
+}{m: map[VaultConfig]*vaultConn{}}
+
+// vaultCloseTimeout bounds the revocation of the leases and token of a
+// connection no registry uses anymore.
+const vaultCloseTimeout = 30 * time.Second
+
+// sharedVaultConn returns the connection of cfg, creating it if needed.
+func sharedVaultConn(cfg VaultConfig, logger logging.Logger) *vaultConn {
+	vaultConns.Lock()
+	defer vaultConns.Unlock()
+	return vaultConnLocked(cfg, logger)
+}
+
+// vaultConnLocked is sharedVaultConn, vaultConns being held.
+func vaultConnLocked(cfg VaultConfig, logger logging.Logger) *vaultConn {
+	c, ok := vaultConns.m[cfg]
+	if !ok {
+		c = newVaultConn(cfg.Token, logger)
+		vaultConns.m[cfg] = c
+	}
+	return c
+}
+
+// acquireVaultConn counts a registry using the connection of cfg.
+func acquireVaultConn(cfg VaultConfig, logger logging.Logger) {
+	vaultConns.Lock()
+	defer vaultConns.Unlock()
+	vaultConnLocked(cfg, logger).refs++
+}
+
+// releaseVaultConn uncounts a registry using the connection of cfg. Once no
+// registry uses it, such as when the vault configuration changed on reload,
+// the connection is dropped and its leases and token are revoked in the
+// background.
+func releaseVaultConn(cfg VaultConfig) {
+	vaultConns.Lock()
+	c, ok := vaultConns.m[cfg]
+	if ok {
+		c.refs--
+		if c.refs > 0 {
+			ok = false
+		} else {
+			delete(vaultConns.m, cfg)
+		}
+	}
+	vaultConns.Unlock()
+	if !ok {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), vaultCloseTimeout)
+		defer cancel()
+		if err := c.close(ctx); err != nil {
+			logging.OrDefault(c.logger).Warn("unable to close unused vault connection", "error", err)
+		}
+	}()
+}
+
+// CloseVault stops renewing the leases of dynamic secrets and the Vault tokens
+// obtained by logging in, and revokes them. Tokens given in the configuration or
+// by VAULT_TOKEN are left alone. Decrypting vault secrets afterwards logs in
+// again.
+func CloseVault(ctx context.Context) error {
+	vaultConns.Lock()
+	conns := vaultConns.m
+	vaultConns.m = map[VaultConfig]*vaultConn{}
+	vaultConns.Unlock()
+
+	var firstErr error
+	for _, c := range conns {
+		if err := c.close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// close revokes the leases of the dynamic secrets and the token of the
+// connection, if it was obtained by logging in.
+func (c *vaultConn) close(ctx context.Context) error {
+	// leases first, revoking them needs the token
+	leasesErr := c.closeLeases(ctx)
+	if err := c.tokens.close(ctx); err != nil && leasesErr == nil {
+		return err
+	}
+	return leasesErr
+}
+
+// apiClient returns the client without token, created by newClient on first
+// use.
+func (c *vaultConn) apiClient(ctx context.Context, newClient func(context.Context) (*api.Client, error)) (*api.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loginClient(ctx, newClient)
+}
+
+// loginClient is apiClient, c.mu being held.
+func (c *vaultConn) loginClient(ctx context.Context, newClient func(context.Context) (*api.Client, error)) (*api.Client, error) {
+	if c.client == nil {
+		client, err := newClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client.ClearToken()
+		c.client = client
+	}
+	return c.client, nil
+}
+
+// tokenClient returns a client using token, sharing the connections of the
+// client without token.
+func (c *vaultConn) tokenClient(ctx context.Context, newClient func(context.Context) (*api.Client, error), token string) (*api.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.authClient != nil && c.authToken == token {
+		return c.authClient, nil
+	}
+	client, err := c.loginClient(ctx, newClient)
+	if err != nil {
+		return nil, err
+	}
+	authClient, err := client.CloneWithHeaders()
+	if err != nil {
+		return nil, newError(nil, "vault", err, "error fetching vault client")
+	}
+	authClient.SetToken(token)
+	c.authClient, c.authToken = authClient, token
+	return authClient, nil
+}
+
+// kvVersion returns the version of the KV engine mounted at engine, asking
+// Vault the first time. It's 0 when Vault can't tell, such as when the token
+// isn't allowed to, or for engines other than KV.
+func (c *vaultConn) kvVersion(ctx context.Context, client VaultClient, engine string) int {
+	c.mu.Lock()
+	version, ok := c.kvVersions[engine]
+	c.mu.Unlock()
+	if ok {
+		return version
+	}
+
+	mount, err := client.ReadWithContext(ctx, "sys/internal/ui/mounts/"+engine)
+	if err != nil {
+		logging.OrDefault(c.logger).Debug("unable to detect the KV version of the engine", "engine", engine, "error", err)
+		if errorKind(err) == ErrTransient {
+			// ask again next time
+			return 0
+		}
+	}
+	version = mountKVVersion(mount)
+	c.mu.Lock()
+	c.kvVersions[engine] = version
+	c.mu.Unlock()
+	return version
+}
+
+// mountKVVersion returns the KV version of a mount as described by
+// sys/internal/ui/mounts, 0 if it isn't a KV engine.
+func mountKVVersion(mount *api.Secret) int {
+	if mount == nil {
+		return 0
+	}
+	switch mount.Data["type"] {
+	case "kv", "generic":
+	default:
+		return 0
+	}
+	if options, ok := mount.Data["options"].(map[string]interface{}); ok {
+		if v, _ := options["version"].(string); strings.TrimSpace(v) == "2" {
+			return 2
+		}
+	}
+	return 1
+}
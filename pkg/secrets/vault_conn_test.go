@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountKVVersion(t *testing.T) {
+	cases := map[string]struct {
+		mount    *api.Secret
+		expected int
+	}{
+		"unknown":  {mount: nil, expected: 0},
+		"kv v2":    {mount: &api.Secret{Data: map[string]interface{}{"type": "kv", "options": map[string]interface{}{"version": "2"}}}, expected: 2},
+		"kv v1":    {mount: &api.Secret{Data: map[string]interface{}{"type": "kv", "options": map[string]interface{}{"version": "1"}}}, expected: 1},
+		"kv":       {mount: &api.Secret{Data: map[string]interface{}{"type": "kv", "options": nil}}, expected: 1},
+		"generic":  {mount: &api.Secret{Data: map[string]interface{}{"type": "generic"}}, expected: 1},
+		"database": {mount: &api.Secret{Data: map[string]interface{}{"type": "database"}}, expected: 0},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.expected, mountKVVersion(c.mount))
+		})
+	}
+}
+
+func TestVaultKVVersionDetection(t *testing.T) {
+	var mountLookups, reads int32
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/sys/internal/ui/mounts/secret": func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&mountLookups, 1)
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+				"path": "secret/", "type": "kv", "options": map[string]interface{}{"version": "2"},
+			}})
+		},
+		// only the KV v2 path is read, there's no handler for secret/db
+		"/v1/secret/data/db": func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&reads, 1)
+			assert.Equal(t, "kv-token", r.Header.Get("X-Vault-Token"))
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+				"data": map[string]interface{}{"password": "s3cr3t"},
+			}})
+		},
+	})
+	engines := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, VaultConfig{
+		Enabled: true, Url: client.Address(), AuthMethod: "TOKEN", Token: "kv-token",
+	}))
+
+	var conns []*vaultConn
+	var clients []*api.Client
+	for i := 0; i < 3; i++ {
+		d, err := engines.NewDecrypter(context.Background(), "encrypted:vault!e:secret!p:db!k:password")
+		assert.NoError(t, err)
+		s, err := d.Decrypt()
+		assert.NoError(t, err)
+		assert.Equal(t, "s3cr3t", s)
+		vd := d.(*VaultDecrypter)
+		conns = append(conns, vd.conn)
+		clients = append(clients, vd.conn.authClient)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mountLookups))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&reads))
+	assert.Same(t, conns[0], conns[2])
+	assert.Same(t, clients[0], clients[2])
+}
+
+func TestVaultConnReleasedByRegistries(t *testing.T) {
+	var revoked int32
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, loginResponse("released-token"))
+		},
+		"/v1/secret/db": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"password": "s3cr3t"}})
+		},
+		"/v1/auth/token/revoke-self": func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "released-token", r.Header.Get("X-Vault-Token"))
+			atomic.AddInt32(&revoked, 1)
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	registered := func(cfg VaultConfig) bool {
+		vaultConns.Lock()
+		defer vaultConns.Unlock()
+		_, ok := vaultConns.m[cfg]
+		return ok
+	}
+	cfg := VaultConfig{Enabled: true, Url: client.Address(), AuthMethod: "APPROLE", RoleId: "released"}
+	r1 := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(r1, cfg))
+	r2 := r1.Clone()
+	d, err := r2.NewDecrypter(context.Background(), "encrypted:vault!e:secret!p:db!k:password")
+	assert.NoError(t, err)
+	s, err := d.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", s)
+
+	// registering the same configuration again, as every resolution does,
+	// keeps the connection
+	assert.NoError(t, RegisterVaultConfigIn(r1, cfg))
+	assert.Same(t, d.(*VaultDecrypter).conn, sharedVaultConn(cfg, nil))
+
+	// the connection of a replaced configuration is kept until released, the
+	// secrets decrypted with it being still in use
+	updated := cfg
+	updated.RoleId = "released-updated"
+	assert.NoError(t, RegisterVaultConfigIn(r1, updated))
+	r2.Unregister("vault")
+	assert.True(t, registered(cfg))
+
+	// and while another registry uses it
+	r2 = r1.Clone()
+	assert.NoError(t, RegisterVaultConfigIn(r2, cfg))
+	r1.ReleaseReplaced()
+	assert.True(t, registered(cfg))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&revoked))
+
+	// it's closed once no registry does
+	r2.Close()
+	assert.False(t, registered(cfg))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&revoked) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	r1.Close()
+	assert.False(t, registered(updated))
+	_, ok := r1.Lookup("vault")
+	assert.False(t, ok)
+}
@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// customMetadataPrefix prefixes the custom metadata fields of KV v2 secrets
+// in 'm' parameters, as in m:custom_metadata.owner.
+const customMetadataPrefix = "custom_metadata."
+
+// checkVaultKeys checks the 'k', 'm' and 'v' parameters of a vault reference
+// and returns what's wrong with them, if anything.
+func checkVaultKeys(key, metadataKey, version string) string {
+	switch {
+	case key == "" && metadataKey == "":
+		return "'k' for key is required, or 'm' for a metadata field"
+	case key != "" && metadataKey != "":
+		return "'k' and 'm' can't be used together"
+	}
+	if version != "" {
+		if n, err := strconv.Atoi(version); err != nil || n <= 0 {
+			return fmt.Sprintf("'v' for version must be a positive integer, not %q", version)
+		}
+	}
+	return ""
+}
+
+// deletedVersionError returns the error for a KV v2 secret whose version was
+// deleted or destroyed, nil if it wasn't.
+func (decrypter *VaultDecrypter) deletedVersionError(secret *api.Secret) error {
+	metadata, _ := secret.Data["metadata"].(map[string]interface{})
+	if metadata == nil {
+		return nil
+	}
+	secretPath := decrypter.engine + "/" + decrypter.path
+	if destroyed, _ := metadata["destroyed"].(bool); destroyed {
+		return newError(ErrNotFound, "vault", nil, fmt.Sprintf("version %v of vault secret %s was destroyed", metadata["version"], secretPath))
+	}
+	if deleted, _ := metadata["deletion_time"].(string); deleted != "" {
+		return newError(ErrNotFound, "vault", nil, fmt.Sprintf("version %v of vault secret %s was deleted at %s", metadata["version"], secretPath, deleted))
+	}
+	return nil
+}
+
+// metadataValue returns the metadata field of a KV v2 secret the decrypter
+// references, such as created_time or custom_metadata.owner.
+func (decrypter *VaultDecrypter) metadataValue(secret *api.Secret) (interface{}, error) {
+	metadata, _ := secret.Data["metadata"].(map[string]interface{})
+	field := decrypter.metadataKey
+	if strings.HasPrefix(field, customMetadataPrefix) {
+		metadata, _ = metadata["custom_metadata"].(map[string]interface{})
+		field = strings.TrimPrefix(field, customMetadataPrefix)
+	}
+	value, ok := metadata[field]
+	if !ok || value == nil {
+		return nil, newError(ErrNotFound, "vault", nil, fmt.Sprintf("metadata %q not found at engine: %s, path: %s", decrypter.metadataKey, decrypter.engine, decrypter.path))
+	}
+	return value, nil
+}
@@ -0,0 +1,190 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckVaultKeys(t *testing.T) {
+	cases := map[string]struct {
+		key, metadataKey, version string
+		expected                  string
+	}{
+		"key":             {key: "password"},
+		"metadata":        {metadataKey: "created_time"},
+		"versioned key":   {key: "password", version: "3"},
+		"neither":         {expected: "'k' for key is required, or 'm' for a metadata field"},
+		"both":            {key: "password", metadataKey: "created_time", expected: "'k' and 'm' can't be used together"},
+		"invalid version": {key: "password", version: "latest", expected: `'v' for version must be a positive integer, not "latest"`},
+		"zero version":    {key: "password", version: "0", expected: `'v' for version must be a positive integer, not "0"`},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.expected, checkVaultKeys(c.key, c.metadataKey, c.version))
+		})
+	}
+}
+
+func TestVaultKVVersionsAndMetadata(t *testing.T) {
+	metadata := func(version int) map[string]interface{} {
+		return map[string]interface{}{
+			"version":         version,
+			"created_time":    "2024-01-02T03:04:05Z",
+			"deletion_time":   "",
+			"destroyed":       false,
+			"custom_metadata": map[string]interface{}{"owner": "platform"},
+		}
+	}
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/sys/internal/ui/mounts/secret": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+				"path": "secret/", "type": "kv", "options": map[string]interface{}{"version": "2"},
+			}})
+		},
+		"/v1/secret/data/db": func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Query().Get("version") {
+			case "", "3":
+				writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+					"data": map[string]interface{}{"password": "v3"}, "metadata": metadata(3),
+				}})
+			case "1":
+				writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+					"data": map[string]interface{}{"password": "v1"}, "metadata": metadata(1),
+				}})
+			case "2":
+				m := metadata(2)
+				m["deletion_time"] = "2024-02-01T00:00:00Z"
+				writeJSON(w, 404, map[string]interface{}{"data": map[string]interface{}{"data": nil, "metadata": m}})
+			case "4":
+				m := metadata(4)
+				m["destroyed"] = true
+				writeJSON(w, 404, map[string]interface{}{"data": map[string]interface{}{"data": nil, "metadata": m}})
+			default:
+				writeJSON(w, 404, map[string]interface{}{"errors": []string{}})
+			}
+		},
+	})
+	engines := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, VaultConfig{
+		Enabled: true, Url: client.Address(), AuthMethod: "TOKEN", Token: "kv-token",
+	}))
+
+	cases := map[string]struct {
+		ref      string
+		expected string
+		err      string
+	}{
+		"latest":           {ref: "e:secret!p:db!k:password", expected: "v3"},
+		"pinned":           {ref: "e:secret!p:db!k:password!v:1", expected: "v1"},
+		"created time":     {ref: "e:secret!p:db!m:created_time!v:1", expected: "2024-01-02T03:04:05Z"},
+		"version":          {ref: "e:secret!p:db!m:version", expected: "3"},
+		"custom metadata":  {ref: "e:secret!p:db!m:custom_metadata.owner", expected: "platform"},
+		"missing metadata": {ref: "e:secret!p:db!m:custom_metadata.team", err: `metadata "custom_metadata.team" not found`},
+		"deleted":          {ref: "e:secret!p:db!k:password!v:2", err: "version 2 of vault secret secret/db was deleted at 2024-02-01T00:00:00Z"},
+		"destroyed":        {ref: "e:secret!p:db!k:password!v:4", err: "version 4 of vault secret secret/db was destroyed"},
+		"missing version":  {ref: "e:secret!p:db!k:password!v:9", err: "couldn't find version 9 of vault path db under engine secret"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			d, err := engines.NewDecrypter(context.Background(), "encrypted:vault!"+c.ref)
+			assert.NoError(t, err)
+			s, err := d.Decrypt()
+			if c.err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.err)
+					assert.True(t, errors.Is(err, ErrNotFound))
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, s)
+		})
+	}
+}
+
+func TestVaultKVMetadataOnV1(t *testing.T) {
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/sys/internal/ui/mounts/kv1": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"path": "kv1/", "type": "kv"}})
+		},
+	})
+	engines := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, VaultConfig{
+		Enabled: true, Url: client.Address(), AuthMethod: "TOKEN", Token: "kv-token",
+	}))
+	d, err := engines.NewDecrypter(context.Background(), "encrypted:vault!e:kv1!p:db!k:password!v:2")
+	assert.NoError(t, err)
+	_, err = d.Decrypt()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "'v' and 'm' require KV v2")
+		assert.True(t, errors.Is(err, ErrMalformedReference))
+	}
+}
+
+func TestVaultStructuredAndBinarySecrets(t *testing.T) {
+	keystore := []byte{0xfe, 0xed, 0xfe, 0xed, 0x00, 0x02}
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/sys/internal/ui/mounts/secret": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+				"path": "secret/", "type": "kv", "options": map[string]interface{}{"version": "2"},
+			}})
+		},
+		"/v1/secret/data/app": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+				"data": map[string]interface{}{
+					"db":       map[string]interface{}{"username": "admin", "port": 5432},
+					"port":     5432,
+					"keystore": "/u3+7QAC",
+					"text":     "aGVs\nbG8=",
+				},
+			}})
+		},
+	})
+	engines := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, VaultConfig{
+		Enabled: true, Url: client.Address(), AuthMethod: "TOKEN", Token: "kv-token",
+	}))
+	decrypt := func(ref string) (Decrypter, string, error) {
+		d, err := engines.NewDecrypter(context.Background(), ref)
+		if !assert.NoError(t, err) {
+			return nil, "", err
+		}
+		s, err := d.Decrypt()
+		return d, s, err
+	}
+
+	d, s, err := decrypt("encrypted:vault!e:secret!p:app!k:db")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"port":5432,"username":"admin"}`, s)
+	v, err := d.(StructuredDecrypter).DecryptValue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"username": "admin", "port": json.Number("5432")}, v)
+
+	_, s, err = decrypt("encrypted:vault!e:secret!p:app!k:port")
+	assert.NoError(t, err)
+	assert.Equal(t, "5432", s)
+
+	_, s, err = decrypt("encrypted:vault!e:secret!p:app!k:text!b:true")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", s)
+
+	_, file, err := decrypt("encryptedFile:vault!e:secret!p:app!k:keystore!b:true")
+	if assert.NoError(t, err) {
+		defer os.Remove(file)
+		content, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, keystore, content)
+	}
+
+	_, _, err = decrypt("encrypted:vault!e:secret!p:app!k:db!b:true")
+	assert.ErrorContains(t, err, "not a base64 string")
+
+	_, err = engines.NewDecrypter(context.Background(), "encrypted:vault!e:secret!p:app!k:db!b:yes")
+	assert.ErrorContains(t, err, `'b' for base64 must be true or false, not "yes"`)
+}
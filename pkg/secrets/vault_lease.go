@@ -0,0 +1,214 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/armory/go-yaml-tools/pkg/logging"
+)
+
+// checkDynamic checks the 'd' parameter of a vault reference and returns
+// what's wrong with it, if anything.
+func checkDynamic(dynamic, metadataKey, version string) string {
+	if msg := checkFlag("d", "dynamic secret", dynamic); msg != "" {
+		return msg
+	}
+	if d, _ := strconv.ParseBool(dynamic); d && (metadataKey != "" || version != "") {
+		return "'v' and 'm' can't be used with dynamic secrets"
+	}
+	return ""
+}
+
+// leaseEntry holds the dynamic secret read at a path. Its mutex is held while
+// reading the secret, so that the keys of a secret read at once, such as a
+// username and a password, come from the same lease.
+type leaseEntry struct {
+	mu      sync.Mutex
+	current *dynamicSecret
+}
+
+// dynamicSecret is a secret issued by Vault with a lease, such as database or
+// AWS credentials. Its lease is renewed in the background until it can't be
+// anymore, at which point done is closed and the next read issues a new secret.
+type dynamicSecret struct {
+	secret *api.Secret
+	done   chan struct{}
+	expire func()
+	// client is authenticated with the token that read the secret, to renew
+	// and revoke its lease
+	client *api.Client
+	stop   func()
+	logger logging.Logger
+}
+
+func newDynamicSecret(secret *api.Secret, client *api.Client, logger logging.Logger) *dynamicSecret {
+	ds := &dynamicSecret{secret: secret, done: make(chan struct{}), client: client, logger: logger}
+	var once sync.Once
+	ds.expire = func() {
+		once.Do(func() { close(ds.done) })
+	}
+	return ds
+}
+
+// expired tells whether the lease can't be renewed anymore.
+func (ds *dynamicSecret) expired() bool {
+	select {
+	case <-ds.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// renew keeps the lease alive for as long as Vault allows. Leases that can't
+// be renewed expire once two thirds of their duration have elapsed.
+func (ds *dynamicSecret) renew() {
+	lease := time.Duration(ds.secret.LeaseDuration) * time.Second
+	if ds.secret.LeaseID == "" || lease <= 0 {
+		return
+	}
+	logger := logging.OrDefault(ds.logger).With("leaseId", ds.secret.LeaseID)
+	if !ds.secret.Renewable {
+		timer := time.AfterFunc(lease*2/3, func() {
+			logger.Info("vault lease is about to expire, new credentials will be issued")
+			ds.expire()
+		})
+		ds.stop = func() { timer.Stop() }
+		return
+	}
+	watcher, err := ds.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: ds.secret})
+	if err != nil {
+		logger.Warn("unable to renew vault lease", "error", err)
+		timer := time.AfterFunc(lease*2/3, ds.expire)
+		ds.stop = func() { timer.Stop() }
+		return
+	}
+	stopped := make(chan struct{})
+	go watcher.Start()
+	go func() {
+		for {
+			select {
+			case err := <-watcher.DoneCh():
+				select {
+				case <-stopped:
+					return
+				default:
+				}
+				if err != nil {
+					logger.Warn("vault lease renewal failed, new credentials will be issued", "error", err)
+				} else {
+					logger.Info("vault lease can't be renewed anymore, new credentials will be issued")
+				}
+				ds.expire()
+				return
+			case <-watcher.RenewCh():
+				logger.Debug("renewed vault lease")
+			}
+		}
+	}()
+	ds.stop = func() {
+		close(stopped)
+		watcher.Stop()
+	}
+}
+
+// close stops renewing the lease and revokes it. done is closed, so that the
+// secret is issued again by the next read.
+func (ds *dynamicSecret) close(ctx context.Context) error {
+	if ds.stop != nil {
+		ds.stop()
+	}
+	expired := ds.expired()
+	ds.expire()
+	if expired || ds.secret.LeaseID == "" {
+		return nil
+	}
+	if err := ds.client.Sys().RevokeWithContext(ctx, ds.secret.LeaseID); err != nil {
+		return newError(errorKind(err), "vault", err, "error revoking vault lease")
+	}
+	return nil
+}
+
+// dynamicSecret returns the dynamic secret at path, reading it with client
+// unless its lease is still valid. authClient returns the client renewing the
+// lease.
+func (c *vaultConn) dynamicSecret(ctx context.Context, path string, client VaultClient, authClient func() (*api.Client, error)) (*dynamicSecret, error) {
+	c.mu.Lock()
+	entry, ok := c.leases[path]
+	if !ok {
+		entry = &leaseEntry{}
+		c.leases[path] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.current != nil && !entry.current.expired() {
+		return entry.current, nil
+	}
+	renewClient, err := authClient()
+	if err != nil {
+		return nil, err
+	}
+	logging.OrDefault(c.logger).Info("reading dynamic secret", "secretPath", path)
+	secret, err := client.ReadWithContext(ctx, path)
+	if err != nil {
+		return nil, newError(errorKind(err), "vault", err, "error fetching dynamic secret from vault")
+	}
+	if secret == nil {
+		return nil, newError(ErrNotFound, "vault", nil, fmt.Sprintf("couldn't find dynamic secret %s", path))
+	}
+	if entry.current != nil && entry.current.stop != nil {
+		entry.current.stop()
+	}
+	entry.current = newDynamicSecret(secret, renewClient, c.logger)
+	entry.current.renew()
+	return entry.current, nil
+}
+
+// closeLeases stops renewing the leases of the dynamic secrets and revokes them.
+func (c *vaultConn) closeLeases(ctx context.Context) error {
+	c.mu.Lock()
+	leases := c.leases
+	c.leases = map[string]*leaseEntry{}
+	c.mu.Unlock()
+
+	var firstErr error
+	for _, entry := range leases {
+		entry.mu.Lock()
+		if entry.current != nil {
+			if err := entry.current.close(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			entry.current = nil
+		}
+		entry.mu.Unlock()
+	}
+	return firstErr
+}
+
+// fetchDynamicValue returns the key of the dynamic secret at the engine and
+// path of the decrypter, such as database/creds/<role>. The decrypters of the
+// keys of a secret share its lease.
+func (decrypter *VaultDecrypter) fetchDynamicValue(ctx context.Context, client VaultClient) (interface{}, error) {
+	path := decrypter.engine + "/" + decrypter.path
+	ds, err := decrypter.connection().dynamicSecret(ctx, path, client, func() (*api.Client, error) {
+		return decrypter.connection().tokenClient(ctx, decrypter.newAPIClient, decrypter.vaultConfig.Token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := ds.secret.Data[decrypter.key]
+	if !ok || value == nil {
+		return nil, newError(ErrNotFound, "vault", nil, fmt.Sprintf("key %q not found at engine: %s, path: %s", decrypter.key, decrypter.engine, decrypter.path))
+	}
+	decrypter.leaseDuration = time.Duration(ds.secret.LeaseDuration) * time.Second
+	decrypter.leaseDone = ds.done
+	decrypter.log().Debug("successfully fetched dynamic secret", "secretPath", path, "leaseId", ds.secret.LeaseID)
+	return value, nil
+}
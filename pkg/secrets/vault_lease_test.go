@@ -0,0 +1,117 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDynamic(t *testing.T) {
+	assert.Equal(t, "", checkDynamic("", "", ""))
+	assert.Equal(t, "", checkDynamic("true", "", ""))
+	assert.Equal(t, `'d' for dynamic secret must be true or false, not "yes"`, checkDynamic("yes", "", ""))
+	assert.Equal(t, "'v' and 'm' can't be used with dynamic secrets", checkDynamic("true", "", "2"))
+	assert.Equal(t, "", checkDynamic("false", "created_time", ""))
+}
+
+func TestVaultDynamicSecrets(t *testing.T) {
+	// drop the connections of other tests, whose servers are closed
+	CloseVault(context.Background())
+	var reads, renewals int32
+	var mu sync.Mutex
+	var revoked []string
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/database/creds/app": func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&reads, 1)
+			writeJSON(w, 200, map[string]interface{}{
+				"lease_id":       fmt.Sprintf("database/creds/app/%d", n),
+				"lease_duration": 3600,
+				"renewable":      true,
+				"data":           map[string]interface{}{"username": fmt.Sprintf("user-%d", n), "password": fmt.Sprintf("pass-%d", n)},
+			})
+		},
+		"/v1/aws/creds/deploy": func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&reads, 1)
+			writeJSON(w, 200, map[string]interface{}{
+				"lease_id":       fmt.Sprintf("aws/creds/deploy/%d", n),
+				"lease_duration": 1,
+				"renewable":      false,
+				"data":           map[string]interface{}{"access_key": fmt.Sprintf("AKIA%d", n)},
+			})
+		},
+		"/v1/sys/leases/renew": func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&renewals, 1)
+			body := decodeBody(t, r)
+			writeJSON(w, 200, map[string]interface{}{"lease_id": body["lease_id"], "lease_duration": 3600, "renewable": true})
+		},
+		"/v1/sys/leases/revoke": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			revoked = append(revoked, decodeBody(t, r)["lease_id"].(string))
+			mu.Unlock()
+			w.WriteHeader(204)
+		},
+	})
+	engines := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, VaultConfig{
+		Enabled: true, Url: client.Address(), AuthMethod: "TOKEN", Token: "dynamic-token",
+	}))
+	decrypt := func(ref string) (*VaultDecrypter, string) {
+		d, err := engines.NewDecrypter(context.Background(), ref)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		s, err := d.Decrypt()
+		assert.NoError(t, err)
+		return d.(*VaultDecrypter), s
+	}
+
+	// the keys of a secret share its lease
+	user, username := decrypt("encrypted:vault!e:database!p:creds/app!k:username!d:true")
+	pass, password := decrypt("encrypted:vault!e:database!p:creds/app!k:password!d:true")
+	assert.Equal(t, "user-1", username)
+	assert.Equal(t, "pass-1", password)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reads))
+	assert.Equal(t, time.Hour, user.LeaseDuration())
+	assert.NotNil(t, user.LeaseDone())
+	assert.Equal(t, user.LeaseDone(), pass.LeaseDone())
+
+	// leases that can't be renewed are replaced before they expire
+	aws, key := decrypt("encrypted:vault!e:aws!p:creds/deploy!k:access_key!d:true")
+	assert.Equal(t, "AKIA2", key)
+	select {
+	case <-aws.LeaseDone():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease never expired")
+	}
+	_, key = decrypt("encrypted:vault!e:aws!p:creds/deploy!k:access_key!d:true")
+	assert.Equal(t, "AKIA3", key)
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&renewals) > 0 }, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-user.LeaseDone():
+		t.Fatal("renewed lease expired")
+	default:
+	}
+
+	// KV secrets aren't leased
+	kv := &VaultDecrypter{}
+	assert.Nil(t, kv.LeaseDone())
+
+	assert.NoError(t, CloseVault(context.Background()))
+	// the secrets of closed leases are issued again
+	select {
+	case <-user.LeaseDone():
+	default:
+		t.Fatal("closed lease not done")
+	}
+	// the expired AWS lease isn't revoked, the current one is
+	mu.Lock()
+	defer mu.Unlock()
+	assert.ElementsMatch(t, []string{"database/creds/app/1", "aws/creds/deploy/3"}, revoked)
+}
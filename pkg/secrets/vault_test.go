@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/sdk/helper/consts"
@@ -25,12 +26,12 @@ type MockVaultClient struct {
 	readData      map[string]interface{}
 }
 
-func (m *MockVaultClient) Write(path string, data map[string]interface{}) (*api.Secret, error) {
+func (m *MockVaultClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error) {
 	m.Called(path, data)
 	return m.writeResponse, m.writeErr
 }
 
-func (m *MockVaultClient) Read(path string) (*api.Secret, error) {
+func (m *MockVaultClient) ReadWithContext(ctx context.Context, path string) (*api.Secret, error) {
 	m.Called(path)
 	return &api.Secret{
 		Data:     m.readData,
@@ -38,6 +39,14 @@ func (m *MockVaultClient) Read(path string) (*api.Secret, error) {
 	}, nil
 }
 
+func (m *MockVaultClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*api.Secret, error) {
+	m.Called(path, data)
+	return &api.Secret{
+		Data:     m.readData,
+		Warnings: m.readWarnings,
+	}, nil
+}
+
 type versionedResponse struct {
 	expectedPath string
 	response     *api.Secret
@@ -49,11 +58,11 @@ type fakeVaultClient struct {
 	v2response versionedResponse
 }
 
-func (f *fakeVaultClient) Write(path string, data map[string]interface{}) (*api.Secret, error) {
+func (f *fakeVaultClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error) {
 	panic("implement me")
 }
 
-func (f *fakeVaultClient) Read(path string) (*api.Secret, error) {
+func (f *fakeVaultClient) ReadWithContext(ctx context.Context, path string) (*api.Secret, error) {
 	switch {
 	case path == f.v1response.expectedPath:
 		return f.v1response.response, f.v1response.err
@@ -65,6 +74,10 @@ func (f *fakeVaultClient) Read(path string) (*api.Secret, error) {
 	}
 }
 
+func (f *fakeVaultClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*api.Secret, error) {
+	panic("implement me")
+}
+
 func TestVaultDecrypter_fetchSecret(t *testing.T) {
 	engine := "t1"
 	path := "t2"
@@ -245,7 +258,7 @@ func TestVaultDecrypter_fetchSecret(t *testing.T) {
 		t.Run(testName, func(t *testing.T) {
 			c.vc.t = t
 			d := &VaultDecrypter{path: path, engine: engine, key: "key"}
-			s, err := d.fetchSecret(c.vc)
+			s, err := d.fetchSecret(context.Background(), c.vc)
 			if err != nil {
 				if c.expectedError != "" {
 					assert.Contains(t, err.Error(), c.expectedError)
@@ -258,6 +271,23 @@ func TestVaultDecrypter_fetchSecret(t *testing.T) {
 	}
 }
 
+func TestVaultDecrypter_leaseDuration(t *testing.T) {
+	vc := &fakeVaultClient{
+		t: t,
+		v1response: versionedResponse{
+			expectedPath: "secret/path",
+			response: &api.Secret{
+				LeaseDuration: 3600,
+				Data:          map[string]interface{}{"key": "value"},
+			},
+		},
+	}
+	d := &VaultDecrypter{engine: "secret", path: "path", key: "key"}
+	_, err := d.fetchSecret(context.Background(), vc)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, d.LeaseDuration())
+}
+
 func TestUserPassAuth(t *testing.T) {
 	cases := map[string]struct {
 		config       VaultConfig
@@ -324,13 +354,13 @@ func TestUserPassAuth(t *testing.T) {
 	}
 	for testName, c := range cases {
 		t.Run(testName, func(t *testing.T) {
-			c.client.On("Write", c.expectedPath, c.expectedData).Return(c.client.writeResponse, c.client.writeErr)
+			c.client.On("WriteWithContext", c.expectedPath, c.expectedData).Return(c.client.writeResponse, c.client.writeErr)
 
 			d := &VaultDecrypter{
 				vaultConfig: c.config,
 			}
 			d.setTokenFetcher()
-			token, err := d.tokenFetcher.fetchToken(c.client)
+			token, err := d.tokenFetcher.fetchToken(context.Background(), c.client)
 			assert.Equal(t, c.client.token, token)
 			if c.expectedError != "" {
 				assert.True(t, strings.Contains(err.Error(), c.expectedError))
@@ -338,7 +368,7 @@ func TestUserPassAuth(t *testing.T) {
 				assert.Nil(t, err)
 			}
 
-			// assert Write() method called with expected arguments
+			// assert WriteWithContext() method called with expected arguments
 			c.client.AssertExpectations(t)
 		})
 	}
@@ -425,21 +455,21 @@ func TestKubernetesAuth(t *testing.T) {
 	}
 	for testName, c := range cases {
 		t.Run(testName, func(t *testing.T) {
-			c.client.On("Write", c.expectedPath, c.expectedData).Return(c.client.writeResponse, c.client.writeErr)
+			c.client.On("WriteWithContext", c.expectedPath, c.expectedData).Return(c.client.writeResponse, c.client.writeErr)
 
 			tokenFetcher := KubernetesServiceAccountTokenFetcher{
 				role:       c.config.Role,
 				path:       c.config.Path,
 				fileReader: mockFileReader,
 			}
-			token, err := tokenFetcher.fetchToken(c.client)
+			token, err := tokenFetcher.fetchToken(context.Background(), c.client)
 			assert.Equal(t, c.expectedToken, token)
 			if c.expectedError != "" {
 				assert.True(t, strings.Contains(err.Error(), c.expectedError))
 			} else {
 				assert.Nil(t, err)
 			}
-			// assert Write() method called with expected arguments
+			// assert WriteWithContext() method called with expected arguments
 			c.client.AssertExpectations(t)
 		})
 	}
@@ -463,7 +493,7 @@ func TestTokenAuth(t *testing.T) {
 		t.Run(testName, func(t *testing.T) {
 			os.Setenv("VAULT_TOKEN", c.expectedToken)
 			tokenFetcher := EnvironmentVariableTokenFetcher{}
-			token, err := tokenFetcher.fetchToken(nil)
+			token, err := tokenFetcher.fetchToken(context.Background(), nil)
 			assert.Equal(t, c.expectError, err != nil)
 			assert.Equal(t, c.expectedToken, token)
 			os.Unsetenv("VAULT_TOKEN")
@@ -734,7 +764,7 @@ func TestSetToken(t *testing.T) {
 
 			assert.Equal(t, "", decrypter.vaultConfig.Token)
 
-			err = decrypter.setToken()
+			err = decrypter.setToken(context.Background())
 			assert.Equal(t, c.expectError, err != nil)
 			assert.Equal(t, c.expectedToken, decrypter.vaultConfig.Token)
 			os.Unsetenv("VAULT_TOKEN")
@@ -752,12 +782,12 @@ func TestNoSecret(t *testing.T) {
 }
 
 func TestNoVaultConfig(t *testing.T) {
-	e := Engines["vault"]
-	delete(Engines, "vault")
+	e, _ := Engines.Lookup("vault")
+	Engines.Unregister("vault")
 	decrypter, err := NewDecrypter(context.TODO(), "encrypted:vault!e:secret!n:test-secret!k:foo")
 	assert.NotNil(t, err)
 	assert.Nil(t, decrypter)
-	Engines["vault"] = e
+	Engines.Register("vault", e)
 }
 
 func TestNewClient(t *testing.T) {
@@ -804,7 +834,7 @@ func TestNewClient(t *testing.T) {
 				vaultConfig: c.cfg,
 			}
 
-			client, err := d.newAPIClient()
+			client, err := d.newAPIClient(context.Background())
 			assert.Nil(t, err)
 			assert.Equal(t, c.cfg.Token, client.Token())
 			assert.Equal(t, c.cfg.Url, client.Address())
@@ -852,6 +882,16 @@ func TestParseVaultSecret(t *testing.T) {
 			},
 			shouldError: false,
 		},
+		"dynamic secret": {
+			params: "e:database!p:creds/app!k:username!d:true",
+			expectedDecrypter: &VaultDecrypter{
+				engine:  "database",
+				path:    "creds/app",
+				key:     "username",
+				dynamic: true,
+			},
+			shouldError: false,
+		},
 		"missing engine": {
 			params: "n:path!k:key",
 			expectedDecrypter: &VaultDecrypter{
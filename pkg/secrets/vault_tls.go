@@ -0,0 +1,70 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// getTLSConfig returns the TLS settings of the vault client, nil when none are
+// configured. TLS files referencing other engines are decrypted on first use.
+func (decrypter *VaultDecrypter) getTLSConfig(ctx context.Context) (*api.TLSConfig, error) {
+	cfg := decrypter.vaultConfig
+	if cfg.CaCert == "" && cfg.CaPath == "" && cfg.ClientCert == "" && cfg.ClientKey == "" &&
+		cfg.TlsServerName == "" && !cfg.TlsSkipVerify {
+		return nil, nil
+	}
+	if decrypter.tlsConfig != nil {
+		return decrypter.tlsConfig, nil
+	}
+	tlsConfig := &api.TLSConfig{
+		CAPath:        cfg.CaPath,
+		TLSServerName: cfg.TlsServerName,
+		Insecure:      cfg.TlsSkipVerify,
+	}
+	for _, f := range []struct {
+		name  string
+		value string
+		path  *string
+	}{
+		{"caCert", cfg.CaCert, &tlsConfig.CACert},
+		{"clientCert", cfg.ClientCert, &tlsConfig.ClientCert},
+		{"clientKey", cfg.ClientKey, &tlsConfig.ClientKey},
+	} {
+		path, err := decrypter.tlsFile(ctx, f.value)
+		if err != nil {
+			return nil, newError(nil, "vault", err, fmt.Sprintf("error reading vault %s", f.name))
+		}
+		*f.path = path
+	}
+	decrypter.tlsConfig = tlsConfig
+	return tlsConfig, nil
+}
+
+// tlsFile returns the path of a TLS file, decrypting encryptedFile references.
+func (decrypter *VaultDecrypter) tlsFile(ctx context.Context, file string) (string, error) {
+	if !IsEncryptedSecret(file) {
+		return file, nil
+	}
+	ref, err := ParseReference(file)
+	if err != nil {
+		return "", err
+	}
+	if !ref.IsFile {
+		return "", malformed("vault", "no file referenced, use encryptedFile")
+	}
+	if ref.Engine == "vault" {
+		// vault would need this very file to connect to itself
+		return "", malformed("vault", "vault TLS files can't be stored in vault")
+	}
+	engines := decrypter.engines
+	if engines == nil {
+		engines = Engines
+	}
+	d, err := engines.NewDecrypter(ctx, file)
+	if err != nil {
+		return "", err
+	}
+	return DecryptContext(ctx, d)
+}
@@ -0,0 +1,125 @@
+package secrets
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeClientCert writes a self-signed client certificate and its key, and
+// returns their paths.
+func writeClientCert(t *testing.T, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestVaultTLSCertAuth(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/cert/login":
+			assert.Equal(t, "vault-client", r.TLS.PeerCertificates[0].Subject.CommonName)
+			assert.Equal(t, map[string]interface{}{"name": "web"}, decodeBody(t, r))
+			writeJSON(w, 200, loginResponse("cert-token"))
+		case "/v1/secret/db":
+			if r.Header.Get("X-Vault-Token") != "cert-token" {
+				writeJSON(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+				return
+			}
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"password": "s3cr3t"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	certFile, keyFile := writeClientCert(t, "vault-client")
+	cfg := VaultConfig{
+		Enabled:    true,
+		Url:        srv.URL,
+		AuthMethod: "CERT",
+		Role:       "web",
+		// the test server's certificate is issued for example.com
+		TlsServerName: "example.com",
+		CaCert:        "encryptedFile:noop!" + caCert,
+		ClientCert:    certFile,
+		ClientKey:     keyFile,
+	}
+	engines := NewDefaultRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, cfg))
+	d, err := engines.NewDecrypter(context.Background(), "encrypted:vault!e:secret!p:db!k:password")
+	assert.NoError(t, err)
+	secret, err := DecryptContext(context.Background(), d)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", secret)
+
+	// the server name doesn't match the certificate
+	cfg.TlsServerName = "vault.example.org"
+	assert.NoError(t, RegisterVaultConfigIn(engines, cfg))
+	d, err = engines.NewDecrypter(context.Background(), "encrypted:vault!e:secret!p:db!k:password")
+	assert.NoError(t, err)
+	_, err = DecryptContext(context.Background(), d)
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "certificate"), "error was %v", err)
+}
+
+func TestVaultTLSFiles(t *testing.T) {
+	d := &VaultDecrypter{vaultConfig: VaultConfig{CaCert: "encrypted:noop!cert"}}
+	_, err := d.getTLSConfig(context.Background())
+	assert.True(t, errors.Is(err, ErrMalformedReference), "error was %v", err)
+
+	d = &VaultDecrypter{vaultConfig: VaultConfig{ClientCert: "encryptedFile:vault!e:secret!p:tls!k:cert"}}
+	_, err = d.getTLSConfig(context.Background())
+	assert.EqualError(t, err, "error reading vault clientCert: vault TLS files can't be stored in vault")
+
+	d = &VaultDecrypter{vaultConfig: VaultConfig{CaPath: "/etc/ssl/vault", TlsSkipVerify: true}}
+	tlsConfig, err := d.getTLSConfig(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/ssl/vault", tlsConfig.CAPath)
+	assert.True(t, tlsConfig.Insecure)
+
+	d = &VaultDecrypter{}
+	tlsConfig, err = d.getTLSConfig(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	cfg := VaultConfig{Enabled: true, Url: "https://vault", AuthMethod: "CERT"}
+	assert.EqualError(t, validateVaultConfig(cfg), "clientCert and clientKey required for CERT auth method")
+	cfg.ClientKey = "client.key"
+	assert.EqualError(t, validateVaultConfig(cfg), "clientCert and clientKey must be set together")
+}
@@ -0,0 +1,188 @@
+package secrets
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/armory/go-yaml-tools/pkg/logging"
+)
+
+// tokenExpiryMargin is how long before a token, or the credentials it was
+// obtained with, expires we log in again.
+const tokenExpiryMargin = time.Minute
+
+// tokenManager shares the Vault token of a configuration between its
+// decrypters. It logs in once, keeps renewable tokens alive with a lifetime
+// watcher and logs in again when they expire or can't be renewed anymore.
+type tokenManager struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+	// owned is set for the tokens of a login, the ones to renew and revoke
+	owned bool
+	// rejected is set once Vault rejected the token, to log in again
+	rejected bool
+	// client is authenticated with the token, to renew and revoke it
+	client      *api.Client
+	stopWatcher func()
+	logger      logging.Logger
+}
+
+func newTokenManager(token string, logger logging.Logger) *tokenManager {
+	return &tokenManager{token: token, logger: logger}
+}
+
+// get returns the current token, logging in with fetcher when there's none or
+// when it's about to expire. client is the one to log in with.
+func (m *tokenManager) get(ctx context.Context, client *api.Client, fetcher TokenFetcher) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && !m.rejected && (m.expiry.IsZero() || time.Now().Add(tokenExpiryMargin).Before(m.expiry)) {
+		return m.token, nil
+	}
+	return m.login(ctx, client, fetcher)
+}
+
+// invalidate marks token as rejected by Vault, so that the next get revokes
+// it and logs in again.
+func (m *tokenManager) invalidate(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token == token {
+		m.rejected = true
+	}
+}
+
+// login replaces the token by a new one, revoking the previous one if it was
+// obtained by logging in. m.mu must be held.
+func (m *tokenManager) login(ctx context.Context, client *api.Client, fetcher TokenFetcher) (string, error) {
+	if err := m.revoke(ctx); err != nil {
+		logging.OrDefault(m.logger).Warn("unable to revoke replaced vault token", "error", err)
+	}
+	auth := &vaultAuth{}
+	var err error
+	if f, ok := fetcher.(authFetcher); ok {
+		auth, err = f.fetchAuth(ctx, newLoginClient(client))
+		m.owned = err == nil
+	} else {
+		auth.token, err = fetcher.fetchToken(ctx, newLoginClient(client))
+	}
+	if err != nil {
+		return "", err
+	}
+	m.token = auth.token
+	m.expiry = auth.credentialsExpiry
+	if !auth.renewable && auth.ttl > 0 {
+		m.expire(time.Now().Add(auth.ttl))
+	}
+	if m.owned {
+		if m.client, err = client.CloneWithHeaders(); err != nil {
+			return "", newError(nil, "vault", err, "error fetching vault client")
+		}
+		m.client.SetToken(auth.token)
+		if auth.renewable && auth.ttl > 0 {
+			m.watch(auth)
+		}
+	}
+	return m.token, nil
+}
+
+// watch renews the token until it can't be renewed anymore. m.mu must be held.
+func (m *tokenManager) watch(auth *vaultAuth) {
+	expiry := time.Now().Add(auth.ttl)
+	watcher, err := m.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{
+		Secret: &api.Secret{Auth: &api.SecretAuth{
+			ClientToken:   auth.token,
+			Renewable:     true,
+			LeaseDuration: int(auth.ttl / time.Second),
+		}},
+		RenewBehavior: api.RenewBehaviorErrorOnErrors,
+	})
+	if err != nil {
+		logging.OrDefault(m.logger).Warn("unable to renew vault token", "error", err)
+		m.expire(expiry)
+		return
+	}
+	stopped := make(chan struct{})
+	go watcher.Start()
+	go func() {
+		for {
+			select {
+			case err := <-watcher.DoneCh():
+				select {
+				case <-stopped:
+				default:
+					m.renewalDone(auth.token, expiry, err)
+				}
+				return
+			case r := <-watcher.RenewCh():
+				if r.Secret != nil && r.Secret.Auth != nil {
+					expiry = r.RenewedAt.Add(time.Duration(r.Secret.Auth.LeaseDuration) * time.Second)
+				}
+				logging.OrDefault(m.logger).Debug("renewed vault token")
+			}
+		}
+	}()
+	m.stopWatcher = func() {
+		close(stopped)
+		watcher.Stop()
+	}
+}
+
+// renewalDone is called once token can't be renewed anymore, because the
+// renewal failed or the token reached its max TTL. The next get logs in again
+// before expiry, when the token lapses.
+func (m *tokenManager) renewalDone(token string, expiry time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != token {
+		return
+	}
+	if err != nil {
+		logging.OrDefault(m.logger).Warn("vault token renewal failed, it will be replaced by a new login", "error", err)
+	} else {
+		logging.OrDefault(m.logger).Info("vault token can't be renewed anymore, it will be replaced by a new login")
+	}
+	m.stopWatcher = nil
+	m.expire(expiry)
+}
+
+// expire makes the token expire at expiry at the latest. m.mu must be held.
+func (m *tokenManager) expire(expiry time.Time) {
+	if m.expiry.IsZero() || expiry.Before(m.expiry) {
+		m.expiry = expiry
+	}
+}
+
+// reset stops renewing the token and drops it. m.mu must be held.
+func (m *tokenManager) reset() {
+	if m.stopWatcher != nil {
+		m.stopWatcher()
+		m.stopWatcher = nil
+	}
+	m.token, m.expiry, m.owned, m.rejected, m.client = "", time.Time{}, false, false, nil
+}
+
+// close revokes the token if it was obtained by logging in.
+func (m *tokenManager) close(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.revoke(ctx)
+}
+
+// revoke drops the token, revoking it if it was obtained by logging in and
+// hasn't expired yet. m.mu must be held.
+func (m *tokenManager) revoke(ctx context.Context) error {
+	client, owned, expiry := m.client, m.owned, m.expiry
+	m.reset()
+	if !owned || client == nil || (!expiry.IsZero() && time.Now().After(expiry)) {
+		return nil
+	}
+	if err := client.Auth().Token().RevokeSelfWithContext(ctx, ""); err != nil {
+		return newError(errorKind(err), "vault", err, "error revoking vault token")
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func renewableLoginResponse(token string, ttl int) map[string]interface{} {
+	return map[string]interface{}{"auth": map[string]interface{}{
+		"client_token": token, "renewable": true, "lease_duration": ttl,
+	}}
+}
+
+func TestTokenManagerSharedLogin(t *testing.T) {
+	var logins int32
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&logins, 1)
+			writeJSON(w, 200, loginResponse(fmt.Sprintf("token-%d", n)))
+		},
+		"/v1/secret/db": func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != "token-1" {
+				writeJSON(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+				return
+			}
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"password": "s3cr3t"}})
+		},
+	})
+	engines := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, VaultConfig{
+		Enabled: true, Url: client.Address(), AuthMethod: "APPROLE", RoleId: "shared-login",
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := engines.NewDecrypter(context.Background(), "encrypted:vault!e:secret!p:db!k:password")
+			assert.NoError(t, err)
+			s, err := d.Decrypt()
+			assert.NoError(t, err)
+			assert.Equal(t, "s3cr3t", s)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logins))
+}
+
+func TestTokenManagerForbiddenPath(t *testing.T) {
+	var logins int32
+	var valid atomic.Value
+	valid.Store("token-1")
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&logins, 1)
+			writeJSON(w, 200, loginResponse(fmt.Sprintf("token-%d", n)))
+		},
+		"/v1/auth/token/lookup-self": func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != valid.Load().(string) {
+				writeJSON(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+				return
+			}
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"id": r.Header.Get("X-Vault-Token")}})
+		},
+		"/v1/auth/token/revoke-self": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+		"/v1/sys/internal/ui/mounts/secret": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{
+				"path": "secret/", "type": "kv", "options": map[string]interface{}{"version": "1"},
+			}})
+		},
+		// the policies of the token don't grant access to this path
+		"/v1/secret/admin": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+		},
+		"/v1/secret/db": func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != valid.Load().(string) {
+				writeJSON(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+				return
+			}
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]interface{}{"password": "s3cr3t"}})
+		},
+	})
+	engines := NewRegistry()
+	assert.NoError(t, RegisterVaultConfigIn(engines, VaultConfig{
+		Enabled: true, Url: client.Address(), AuthMethod: "APPROLE", RoleId: "forbidden-path",
+	}))
+	decrypt := func(params string) (string, error) {
+		d, err := engines.NewDecrypter(context.Background(), "encrypted:vault!e:secret!"+params)
+		if !assert.NoError(t, err) {
+			return "", err
+		}
+		return d.Decrypt()
+	}
+
+	_, err := decrypt("p:admin!k:password")
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	s, err := decrypt("p:db!k:password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", s)
+	// the token is kept, it isn't the one Vault rejects
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logins))
+
+	// once revoked behind our back, the token is replaced
+	valid.Store("token-2")
+	s, err = decrypt("p:db!k:password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", s)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&logins))
+}
+
+func TestTokenManagerRenewal(t *testing.T) {
+	var logins, renewals int32
+	var mu sync.Mutex
+	var revoked []string
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&logins, 1)
+			writeJSON(w, 200, renewableLoginResponse(fmt.Sprintf("token-%d", n), 2))
+		},
+		"/v1/auth/token/renew-self": func(w http.ResponseWriter, r *http.Request) {
+			// the first token is renewed once, and then revoked behind our back
+			if r.Header.Get("X-Vault-Token") == "token-1" && atomic.AddInt32(&renewals, 1) == 1 {
+				writeJSON(w, 200, renewableLoginResponse("token-1", 2))
+				return
+			}
+			writeJSON(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+		},
+		"/v1/auth/token/revoke-self": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			revoked = append(revoked, r.Header.Get("X-Vault-Token"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	revokedTokens := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), revoked...)
+	}
+	d := &VaultDecrypter{vaultConfig: VaultConfig{AuthMethod: "APPROLE", RoleId: "renewal"}}
+	assert.NoError(t, d.setTokenFetcher())
+	m := newTokenManager("", nil)
+
+	token, err := m.get(context.Background(), client, d.tokenFetcher)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// once renewed, the token can't be renewed anymore and expires within
+	// tokenExpiryMargin, so the next get logs in again
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&renewals) == 2 }, 10*time.Second, 50*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		token, err = m.get(context.Background(), client, d.tokenFetcher)
+		return err == nil && token == "token-2"
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&logins))
+	// token-1 is revoked when replaced, unless it had already expired
+	assert.NotContains(t, revokedTokens(), "token-2")
+
+	assert.NoError(t, m.close(context.Background()))
+	before := len(revokedTokens())
+	assert.Equal(t, "token-2", revokedTokens()[before-1])
+	// closing again has nothing left to revoke
+	assert.NoError(t, m.close(context.Background()))
+	assert.Len(t, revokedTokens(), before)
+}
+
+func TestTokenManagerExpiry(t *testing.T) {
+	var logins int32
+	var mu sync.Mutex
+	var revoked []string
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&logins, 1)
+			// a non renewable token expiring within tokenExpiryMargin
+			writeJSON(w, 200, map[string]interface{}{"auth": map[string]interface{}{
+				"client_token": fmt.Sprintf("token-%d", n), "lease_duration": 30,
+			}})
+		},
+		"/v1/auth/token/revoke-self": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			revoked = append(revoked, r.Header.Get("X-Vault-Token"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	d := &VaultDecrypter{vaultConfig: VaultConfig{AuthMethod: "APPROLE", RoleId: "expiry"}}
+	assert.NoError(t, d.setTokenFetcher())
+	m := newTokenManager("", nil)
+	for _, expected := range []string{"token-1", "token-2"} {
+		token, err := m.get(context.Background(), client, d.tokenFetcher)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, token)
+	}
+	// the token replaced before its expiry is revoked
+	mu.Lock()
+	assert.Equal(t, []string{"token-1"}, revoked)
+	mu.Unlock()
+
+	// so is a token rejected by Vault
+	m.invalidate("token-2")
+	token, err := m.get(context.Background(), client, d.tokenFetcher)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+	mu.Lock()
+	assert.Equal(t, []string{"token-1", "token-2"}, revoked)
+	mu.Unlock()
+
+	// tokens that weren't obtained by logging in are never revoked
+	m = newTokenManager("configured-token", nil)
+	token, err = m.get(context.Background(), client, d.tokenFetcher)
+	assert.NoError(t, err)
+	assert.Equal(t, "configured-token", token)
+	assert.NoError(t, m.close(context.Background()))
+
+	m = newTokenManager("configured-token", nil)
+	m.invalidate("configured-token")
+	token, err = m.get(context.Background(), client, d.tokenFetcher)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-4", token)
+	mu.Lock()
+	assert.Equal(t, []string{"token-1", "token-2"}, revoked)
+	mu.Unlock()
+}
+
+func TestCloseVault(t *testing.T) {
+	// drop the tokens of other tests, whose servers are gone
+	CloseVault(context.Background())
+
+	var revoked int32
+	client := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, loginResponse("close-token"))
+		},
+		"/v1/auth/token/revoke-self": func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "close-token", r.Header.Get("X-Vault-Token"))
+			atomic.AddInt32(&revoked, 1)
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	cfg := VaultConfig{Enabled: true, Url: client.Address(), AuthMethod: "APPROLE", RoleId: "close"}
+	d := &VaultDecrypter{vaultConfig: cfg, conn: sharedVaultConn(cfg, nil)}
+	assert.NoError(t, d.setTokenFetcher())
+	assert.NoError(t, d.setToken(context.Background()))
+	assert.Equal(t, "close-token", d.vaultConfig.Token)
+
+	assert.NoError(t, CloseVault(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&revoked))
+	assert.NotSame(t, d.conn, sharedVaultConn(cfg, nil))
+}
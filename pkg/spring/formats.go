@@ -0,0 +1,495 @@
+package spring
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yamlParse "gopkg.in/yaml.v2"
+
+	"github.com/armory/go-yaml-tools/pkg/yaml"
+)
+
+// configFormat is a supported configuration file format.
+type configFormat struct {
+	ext   string
+	parse func(data []byte) (map[interface{}]interface{}, error)
+	// locate returns where values are defined in a file, nil if unsupported
+	locate func(file string, data []byte) (yaml.Locations, error)
+	// fallbackOf is the extension of an earlier format, this one is only read
+	// when that file is missing or empty
+	fallbackOf string
+}
+
+// configFormats are the extensions looked up for every property name and
+// profile, from lowest to highest precedence. All the files found for a name
+// are merged, so gate.yaml overrides gate.properties, and profile files still
+// override the files without a profile whatever their format. As it always
+// was, gate.yml is only read when gate.yaml is missing or empty.
+var configFormats = []configFormat{
+	{ext: "env", parse: parseEnv, locate: locateFlat(readEnv)},
+	{ext: "properties", parse: parseProperties, locate: locateFlat(readProperties)},
+	{ext: "toml", parse: parseTOML},
+	{ext: "json", parse: parseJSON, locate: yaml.Locate},
+	{ext: "yaml", parse: parseYAML, locate: yaml.Locate},
+	{ext: "yml", parse: parseYAML, locate: yaml.Locate, fallbackOf: "yaml"},
+}
+
+// formatOf returns the format of a file from its extension, yaml if unknown.
+func formatOf(file string) configFormat {
+	ext := strings.TrimPrefix(filepath.Ext(file), ".")
+	for _, f := range configFormats {
+		if f.ext == ext {
+			return f
+		}
+	}
+	return configFormats[len(configFormats)-2]
+}
+
+// lineError is a parse error at a known line, so that the line can be
+// reported without looking into the error message.
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e *lineError) Error() string {
+	return e.err.Error()
+}
+
+func (e *lineError) Unwrap() error {
+	return e.err
+}
+
+// errorAt returns err prefixed with the line it occurred at.
+func errorAt(line int, err error) error {
+	return &lineError{line: line, err: fmt.Errorf("line %d: %w", line, err)}
+}
+
+// errorLine returns the line a parser error occurred at, 0 if unknown.
+func errorLine(err error) int {
+	var le *lineError
+	if errors.As(err, &le) {
+		return le.line
+	}
+	return 0
+}
+
+// yamlErrorLine matches the line yaml.v2 starts its syntax errors and the
+// entries of its type errors with.
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+):`)
+
+func parseYAML(data []byte) (map[interface{}]interface{}, error) {
+	s := map[interface{}]interface{}{}
+	err := yamlParse.Unmarshal(data, &s)
+	if err == nil {
+		return s, nil
+	}
+	msg := err.Error()
+	var te *yamlParse.TypeError
+	if errors.As(err, &te) && len(te.Errors) > 0 {
+		msg = te.Errors[0]
+	}
+	if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		err = &lineError{line: line, err: err}
+	}
+	return s, err
+}
+
+func parseJSON(data []byte) (map[interface{}]interface{}, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return map[interface{}]interface{}{}, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as written, 1e3 shouldn't turn into 1000
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) {
+			return nil, errorAt(lineAt(data, se.Offset), err)
+		}
+		return nil, err
+	}
+	if d.More() {
+		return nil, errorAt(lineAt(data, d.InputOffset()), errors.New("unexpected content after the top level object"))
+	}
+	m, ok := objectValue(v).(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("top level value must be an object")
+	}
+	return m, nil
+}
+
+// lineAt returns the line of a byte offset.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func parseTOML(data []byte) (map[interface{}]interface{}, error) {
+	var v map[string]interface{}
+	if err := toml.Unmarshal(data, &v); err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			return nil, &lineError{line: pe.Position.Line, err: err}
+		}
+		return nil, err
+	}
+	return objectValue(v).(map[interface{}]interface{}), nil
+}
+
+// objectValue converts decoded JSON and TOML values to the types yaml produces.
+func objectValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			m[k] = objectValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = objectValue(e)
+		}
+		return l
+	case []map[string]interface{}:
+		// TOML arrays of tables
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = objectValue(e)
+		}
+		return l
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
+
+// flatEntry is a key=value line of a .properties or .env file.
+type flatEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+func parseProperties(data []byte) (map[interface{}]interface{}, error) {
+	entries, err := readProperties(data)
+	if err != nil {
+		return nil, err
+	}
+	return expandKeys(entries)
+}
+
+func parseEnv(data []byte) (map[interface{}]interface{}, error) {
+	entries, err := readEnv(data)
+	if err != nil {
+		return nil, err
+	}
+	return expandKeys(entries)
+}
+
+// readProperties reads a java .properties file: "key=value", "key: value" or
+// "key value" lines, "#" and "!" comments, backslash line continuations and
+// escapes.
+func readProperties(data []byte) ([]flatEntry, error) {
+	var entries []flatEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		start := lineNum
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		for continues(line) && scanner.Scan() {
+			lineNum++
+			line = line[:len(line)-1] + strings.TrimLeft(scanner.Text(), " \t\f")
+		}
+		if continues(line) {
+			line = line[:len(line)-1]
+		}
+
+		end := len(line)
+		for i := 0; i < len(line); i++ {
+			if line[i] == '\\' {
+				i++
+				continue
+			}
+			if strings.IndexByte("=: \t\f", line[i]) >= 0 {
+				end = i
+				break
+			}
+		}
+		key, err := unescapeProperty(line[:end])
+		if err != nil {
+			return nil, errorAt(start, err)
+		}
+		rest := strings.TrimLeft(line[end:], " \t\f")
+		if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+			rest = strings.TrimLeft(rest[1:], " \t\f")
+		}
+		value, err := unescapeProperty(rest)
+		if err != nil {
+			return nil, errorAt(start, err)
+		}
+		entries = append(entries, flatEntry{key: key, value: value, line: start})
+	}
+	return entries, scanner.Err()
+}
+
+// continues tells whether a properties line ends with an odd number of backslashes.
+func continues(line string) bool {
+	n := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+func unescapeProperty(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+5 > len(s) {
+				return "", fmt.Errorf("malformed \\u escape in %q", s)
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("malformed \\u escape in %q", s)
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// readEnv reads a dotenv file: "KEY=value" lines, optionally prefixed with
+// "export", with "#" comments. Values can be single quoted, taken literally,
+// or double quoted, where \n, \t, \" and \\ are unescaped.
+func readEnv(data []byte) ([]flatEntry, error) {
+	var entries []flatEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return nil, errorAt(lineNum, errors.New("expected KEY=value"))
+		}
+		key := strings.TrimSpace(line[:i])
+		value, err := envValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, errorAt(lineNum, err)
+		}
+		entries = append(entries, flatEntry{key: key, value: value, line: lineNum})
+	}
+	return entries, scanner.Err()
+}
+
+func envValue(s string) (string, error) {
+	if s == "" {
+		return s, nil
+	}
+	switch s[0] {
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated single quoted value")
+		}
+		return s[1 : end+1], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '"':
+				return b.String(), nil
+			case '\\':
+				if i+1 < len(s) {
+					i++
+					switch s[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(s[i])
+					}
+					continue
+				}
+			}
+			b.WriteByte(s[i])
+		}
+		return "", errors.New("unterminated double quoted value")
+	}
+	// unquoted values end at an inline comment
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s, nil
+}
+
+// indexedList is a list being built from flat keys, which can come in any order.
+type indexedList map[int]interface{}
+
+// expandKeys turns flat keys into nested maps and lists, so that "a.b[0]=x"
+// gives the same configuration as the yaml "a: {b: [x]}", see yaml.ParsePath.
+// Later entries override earlier ones. Unlike yaml.Unflatten, conflicting keys
+// are reported since they are most likely mistakes.
+func expandKeys(entries []flatEntry) (map[interface{}]interface{}, error) {
+	root := map[interface{}]interface{}{}
+	for _, e := range entries {
+		path, err := yaml.ParsePath(e.key)
+		if err != nil {
+			return nil, errorAt(e.line, err)
+		}
+		if path[0].IsIndex {
+			return nil, errorAt(e.line, fmt.Errorf("key %q can't start with a list index", e.key))
+		}
+		if err := setPath(root, path, e.value); err != nil {
+			return nil, errorAt(e.line, fmt.Errorf("key %q %w", e.key, err))
+		}
+	}
+	m, err := finishLists(root, "")
+	if err != nil {
+		return nil, err
+	}
+	return m.(map[interface{}]interface{}), nil
+}
+
+func setPath(root map[interface{}]interface{}, path []yaml.PathElement, value string) error {
+	var container interface{} = root
+	for i, elem := range path {
+		last := i == len(path)-1
+		var child interface{}
+		switch c := container.(type) {
+		case map[interface{}]interface{}:
+			if elem.IsIndex {
+				return errors.New("indexes a map")
+			}
+			child = c[elem.Key]
+		case indexedList:
+			if !elem.IsIndex {
+				return errors.New("has a key in a list")
+			}
+			child = c[elem.Index]
+		}
+		if last {
+			switch child.(type) {
+			case map[interface{}]interface{}, indexedList:
+				return errors.New("sets a value that also has nested keys")
+			}
+			child = value
+		} else if child == nil {
+			if path[i+1].IsIndex {
+				child = indexedList{}
+			} else {
+				child = map[interface{}]interface{}{}
+			}
+		} else if _, ok := child.(string); ok {
+			return errors.New("nests keys under a value")
+		}
+		switch c := container.(type) {
+		case map[interface{}]interface{}:
+			c[elem.Key] = child
+		case indexedList:
+			c[elem.Index] = child
+		}
+		container = child
+	}
+	return nil
+}
+
+// finishLists converts the indexed lists to slices, their indexes must be contiguous.
+func finishLists(v interface{}, path string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			p := fmt.Sprintf("%v", k)
+			if path != "" {
+				p = path + "." + p
+			}
+			f, err := finishLists(e, p)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = f
+		}
+		return v, nil
+	case indexedList:
+		indexes := make([]int, 0, len(v))
+		for i := range v {
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+		l := make([]interface{}, len(indexes))
+		for pos, i := range indexes {
+			if pos != i {
+				return nil, fmt.Errorf("list %s has no element at index %d", path, pos)
+			}
+			f, err := finishLists(v[i], fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			l[i] = f
+		}
+		return l, nil
+	default:
+		return v, nil
+	}
+}
+
+// locateFlat returns a locate function for flat formats.
+func locateFlat(read func([]byte) ([]flatEntry, error)) func(string, []byte) (yaml.Locations, error) {
+	return func(file string, data []byte) (yaml.Locations, error) {
+		entries, err := read(data)
+		if err != nil {
+			return nil, err
+		}
+		locs := yaml.Locations{}
+		for _, e := range entries {
+			locs[e.key] = yaml.Location{File: file, Line: e.line}
+		}
+		return locs, nil
+	}
+}
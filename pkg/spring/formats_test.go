@@ -0,0 +1,159 @@
+package spring
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFormats(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		data     string
+		expected map[interface{}]interface{}
+	}{
+		{
+			name: "json",
+			file: "gate.json",
+			data: `{"server": {"port": 8080, "ratio": 1e3}, "hosts": ["a", "b"], "tls": true}`,
+			expected: map[interface{}]interface{}{
+				"server": map[interface{}]interface{}{"port": json.Number("8080"), "ratio": json.Number("1e3")},
+				"hosts":  []interface{}{"a", "b"},
+				"tls":    true,
+			},
+		},
+		{
+			name: "toml",
+			file: "gate.toml",
+			data: "tls = true\n[server]\nport = 8080\n[[hosts]]\nname = \"a\"\n[[hosts]]\nname = \"b\"\n",
+			expected: map[interface{}]interface{}{
+				"server": map[interface{}]interface{}{"port": int64(8080)},
+				"hosts": []interface{}{
+					map[interface{}]interface{}{"name": "a"},
+					map[interface{}]interface{}{"name": "b"},
+				},
+				"tls": true,
+			},
+		},
+		{
+			name: "properties",
+			file: "gate.properties",
+			data: "# comment\n! comment\nserver.port=8080\nserver.host : localhost\n" +
+				"hosts[1].name b\nhosts[0].name=a\nmessage=hello \\\n    world\\u0021\nmap[a.b]=c\n",
+			expected: map[interface{}]interface{}{
+				"server":  map[interface{}]interface{}{"port": "8080", "host": "localhost"},
+				"hosts":   []interface{}{map[interface{}]interface{}{"name": "a"}, map[interface{}]interface{}{"name": "b"}},
+				"message": "hello world!",
+				"map":     map[interface{}]interface{}{"a.b": "c"},
+			},
+		},
+		{
+			name: "env",
+			file: "gate.env",
+			data: "# comment\nexport DB_USER=admin\nDB_PASSWORD='p#ss $x'\nGREETING=\"hello\\nworld\"\nPORT=8080 # inline\nserver.port=9090\n",
+			expected: map[interface{}]interface{}{
+				"DB_USER":     "admin",
+				"DB_PASSWORD": "p#ss $x",
+				"GREETING":    "hello\nworld",
+				"PORT":        "8080",
+				"server":      map[interface{}]interface{}{"port": "9090"},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := formatOf(c.file).parse([]byte(c.data))
+			if assert.NoError(t, err) {
+				assert.Equal(t, c.expected, m)
+			}
+		})
+	}
+}
+
+func TestParseFormatErrors(t *testing.T) {
+	cases := []struct {
+		file string
+		data string
+		err  string
+		line int
+	}{
+		{file: "gate.json", data: "{\n\"a\": 1,\n}", err: "line 3", line: 3},
+		{file: "gate.json", data: "[1]", err: "must be an object"},
+		{file: "gate.toml", data: "a = 1\nb = ?\nc = 2\n", err: "toml: line 2", line: 2},
+		{file: "gate.yml", data: "a: 'line 9: x'\nb: [", err: "yaml: line 2", line: 2},
+		{file: "gate.yml", data: "# list\n- a", err: "line 2: cannot unmarshal", line: 2},
+		{file: "gate.properties", data: "a=1\na.b=2", err: `line 2: key "a.b" nests keys under a value`, line: 2},
+		{file: "gate.properties", data: "a.b=1\na=2", err: `line 2: key "a" sets a value that also has nested keys`, line: 2},
+		{file: "gate.properties", data: "a[1]=x", err: "list a has no element at index 0"},
+		{file: "gate.properties", data: "a..b=x", err: `line 1: invalid path "a..b": empty key`, line: 1},
+		{file: "gate.env", data: "A=1\nB", err: "line 2: expected KEY=value", line: 2},
+		{file: "gate.env", data: "A=\"open", err: "line 1: unterminated", line: 1},
+	}
+	for _, c := range cases {
+		_, err := formatOf(c.file).parse([]byte(c.data))
+		if assert.Error(t, err, c.data) {
+			assert.Contains(t, err.Error(), c.err)
+			assert.Equal(t, c.line, errorLine(err), c.data)
+		}
+	}
+}
+
+func TestLoadFormatsPrecedence(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	files := map[string]string{
+		"/config/gate.env":              "a=env\nb=env\nc=env\nd=env\ne=env\nf=env\ng=env",
+		"/config/gate.properties":       "b=properties\nc=properties\nd=properties\ne=properties\nf=properties\ng=properties",
+		"/config/gate.toml":             "c = \"toml\"\nd = \"toml\"\ne = \"toml\"\nf = \"toml\"\ng = \"toml\"",
+		"/config/gate.json":             `{"d": "json", "e": "json", "f": "json", "g": "json"}`,
+		"/config/gate.yml":              "e: yml\nf: yml\ng: yml",
+		"/config/gate.yaml":             "f: yaml\ng: yaml",
+		"/config/gate-local.properties": "g=local",
+	}
+	for name, data := range files {
+		assert.NoError(t, afero.WriteFile(mfs, name, []byte(data), 0644))
+	}
+
+	l := NewLoader(WithFs(mfs), WithConfigDir("/config"), WithProfiles("local"))
+	c, files2, err := l.loadProperties(context.Background(), []string{"gate"}, "/config")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"a": "env", "b": "properties", "c": "toml", "d": "json", "e": "json", "f": "yaml", "g": "local",
+	}, c)
+	assert.Equal(t, []string{
+		"/config/gate.env", "/config/gate.properties", "/config/gate.toml", "/config/gate.json",
+		"/config/gate.yaml", "/config/gate-local.properties",
+	}, files2)
+
+	locs := l.locate(files2)
+	assert.Equal(t, "/config/gate-local.properties:1", locs.Find("g").String())
+	assert.Equal(t, "/config/gate.env:1", locs.Find("a").String())
+}
+
+func TestLoadYmlFallback(t *testing.T) {
+	cases := []struct {
+		name  string
+		yaml  string
+		files []string
+		want  map[string]interface{}
+	}{
+		{name: "yaml wins", yaml: "a: yaml", files: []string{"/config/gate.yaml"}, want: map[string]interface{}{"a": "yaml"}},
+		{name: "empty yaml", yaml: "", files: []string{"/config/gate.yml"}, want: map[string]interface{}{"a": "yml", "b": "yml"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mfs := afero.NewMemMapFs()
+			assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yaml", []byte(c.yaml), 0644))
+			assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("a: yml\nb: yml"), 0644))
+
+			l := NewLoader(WithFs(mfs), WithConfigDir("/config"))
+			cfg, files, err := l.loadProperties(context.Background(), []string{"gate"}, "/config")
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, cfg)
+			assert.Equal(t, c.files, files)
+		})
+	}
+}
@@ -0,0 +1,471 @@
+package spring
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/armory/go-yaml-tools/pkg/logging"
+	"github.com/armory/go-yaml-tools/pkg/secrets"
+	"github.com/armory/go-yaml-tools/pkg/yaml"
+)
+
+// Loader loads spring style property files. Unlike the package level functions,
+// it keeps all of its settings on the instance so that loaders with different
+// settings can be used side by side. Use NewLoader to create one.
+type Loader struct {
+	fs         afero.Fs
+	configDir  string
+	configDirs []string
+	profiles   []string
+	env        map[string]string
+	logger     logging.Logger
+	engines    *secrets.Registry
+	ownEngines bool
+	sources    []PropertySource
+	schema     *yaml.Schema
+	tracker    *yaml.SecretTracker
+	funcs      map[string]yaml.PlaceholderFunc
+	expandKeys bool
+	collect    bool
+
+	refreshInterval time.Duration
+	// shortest lease among the secrets of the last resolution, in nanoseconds
+	minLease atomic.Int64
+
+	leasesMu sync.Mutex
+	// leasesDone is closed once a dynamic secret of the last resolution must
+	// be issued again, stopLeases stops watching its leases
+	leasesDone chan struct{}
+	stopLeases chan struct{}
+
+	secretsMu sync.Mutex
+	// secrets are the decrypted values of the last resolution, by path, to
+	// tell whether a refresh changed any
+	secrets map[string]string
+}
+
+// Option configures a Loader.
+type Option func(*Loader)
+
+// PropertySource provides properties that are merged on top of the ones read
+// from files, in the order the sources were given.
+type PropertySource interface {
+	Properties() (map[interface{}]interface{}, error)
+}
+
+// MapPropertySource is a PropertySource backed by an in-memory map.
+type MapPropertySource map[interface{}]interface{}
+
+func (m MapPropertySource) Properties() (map[interface{}]interface{}, error) {
+	// resolving mutates nested values, hand out a copy so the source can be reused
+	return copyValue(map[interface{}]interface{}(m)).(map[interface{}]interface{}), nil
+}
+
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		c := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			c[k] = copyValue(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyValue(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// WithFs sets the file system files are read from, the OS file system by default.
+func WithFs(fs afero.Fs) Option {
+	return func(l *Loader) {
+		l.fs = fs
+	}
+}
+
+// WithConfigDir forces the directory files are loaded from, without checking
+// that it exists.
+func WithConfigDir(dir string) Option {
+	return func(l *Loader) {
+		l.configDir = dir
+	}
+}
+
+// WithConfigDirs sets the candidate config directories, the first one that
+// exists is used. Defaults to the same directories as LoadDefault.
+func WithConfigDirs(dirs ...string) Option {
+	return func(l *Loader) {
+		l.configDirs = dirs
+	}
+}
+
+// WithProfiles sets the active profiles. When not set, profiles are read from
+// SPRING_PROFILES_ACTIVE or PROFILES_ACTIVE in the loader's environment and
+// default to "armory" and "local".
+func WithProfiles(profiles ...string) Option {
+	return func(l *Loader) {
+		// never nil, so that no profiles can be requested explicitly
+		l.profiles = append([]string{}, profiles...)
+	}
+}
+
+// WithEnv sets the environment used to resolve placeholders, os.Environ() by default.
+func WithEnv(env map[string]string) Option {
+	return func(l *Loader) {
+		l.env = env
+	}
+}
+
+// WithEnviron is like WithEnv but takes KEY=value pairs as returned by os.Environ().
+func WithEnviron(keyPairs []string) Option {
+	return WithEnv(keyPairToMap(keyPairs))
+}
+
+// WithLogger sets the logger of the loader, also used by the resolver and the
+// secret engines. Defaults to logging.Default().
+func WithLogger(logger logging.Logger) Option {
+	return func(l *Loader) {
+		l.logger = logger
+	}
+}
+
+// WithSecretEngines sets the registry of the secret engines used to decrypt
+// secrets. By default each loader has its own copy of secrets.Engines, so that
+// loaders don't share the vault configuration found in their files.
+func WithSecretEngines(engines *secrets.Registry) Option {
+	return func(l *Loader) {
+		l.engines = engines
+	}
+}
+
+// WithSecretRefresh makes LoadDynamic re-resolve the configuration, secrets
+// included, every interval so that rotated secrets are picked up. Secrets with a
+// shorter lease, such as some Vault secrets, are refreshed before their lease
+// expires. The update callback is only invoked when a value changed.
+func WithSecretRefresh(interval time.Duration) Option {
+	return func(l *Loader) {
+		l.refreshInterval = interval
+	}
+}
+
+// WithSchema validates the resolved configuration against a JSON Schema, see
+// yaml.CompileSchema. Loading fails with a *yaml.SchemaError listing every
+// violation along with the file and line of the offending values.
+func WithSchema(schema *yaml.Schema) Option {
+	return func(l *Loader) {
+		l.schema = schema
+	}
+}
+
+// WithSecretTracker records the secrets decrypted by the loader in t, so that
+// they can be redacted when encoding the configuration, see yaml.WithRedaction.
+func WithSecretTracker(t *yaml.SecretTracker) Option {
+	return func(l *Loader) {
+		l.tracker = t
+	}
+}
+
+// WithPlaceholderFunc registers a placeholder function used by this loader
+// only, see yaml.PlaceholderFunc.
+func WithPlaceholderFunc(name string, fn yaml.PlaceholderFunc) Option {
+	return func(l *Loader) {
+		if l.funcs == nil {
+			l.funcs = map[string]yaml.PlaceholderFunc{}
+		}
+		l.funcs[name] = fn
+	}
+}
+
+// WithKeyExpansion also replaces placeholders in keys, see yaml.WithKeyExpansion.
+func WithKeyExpansion() Option {
+	return func(l *Loader) {
+		l.expandKeys = true
+	}
+}
+
+// WithCollectErrors makes loading carry on past unparsable files, secrets that
+// can't be decrypted and unresolved placeholders, and fail with a
+// *yaml.MultiError listing all of them along with their file and key.
+func WithCollectErrors() Option {
+	return func(l *Loader) {
+		l.collect = true
+	}
+}
+
+// WithPropertySources adds property sources merged on top of the files.
+func WithPropertySources(sources ...PropertySource) Option {
+	return func(l *Loader) {
+		l.sources = append(l.sources, sources...)
+	}
+}
+
+func NewLoader(opts ...Option) *Loader {
+	l := &Loader{
+		fs:     afero.NewOsFs(),
+		logger: logging.Default(),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.engines == nil {
+		l.engines = secrets.Engines.Clone()
+		l.ownEngines = true
+	}
+	if l.configDirs == nil {
+		l.configDirs = defaultConfigDirs()
+	}
+	if l.env == nil {
+		l.env = keyPairToMap(os.Environ())
+	}
+	return l
+}
+
+// ConfigDir returns the directory files are loaded from, or an empty string
+// if none of the candidate directories exist.
+func (l *Loader) ConfigDir() string {
+	if l.configDir != "" {
+		return l.configDir
+	}
+	for _, dir := range l.configDirs {
+		if _, err := l.fs.Stat(dir); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Profiles returns the active profiles.
+func (l *Loader) Profiles() []string {
+	if l.profiles != nil {
+		return l.profiles
+	}
+	for _, key := range []string{"SPRING_PROFILES_ACTIVE", "PROFILES_ACTIVE"} {
+		if p := l.env[key]; len(p) > 0 {
+			return strings.Split(p, ",")
+		}
+	}
+	return []string{"armory", "local"}
+}
+
+// Load loads and resolves the properties named propNames, see LoadProperties.
+func (l *Loader) Load(propNames []string) (map[string]interface{}, error) {
+	return l.LoadContext(context.Background(), propNames)
+}
+
+// LoadContext is like Load, secrets being decrypted with ctx so that their
+// fetching can be cancelled or given a deadline.
+func (l *Loader) LoadContext(ctx context.Context, propNames []string) (map[string]interface{}, error) {
+	confDir := l.ConfigDir()
+	if confDir == "" {
+		return nil, errors.New("could not find config directory")
+	}
+	config, _, err := l.loadProperties(ctx, propNames, confDir)
+	if err == nil {
+		l.engines.ReleaseReplaced()
+	}
+	return config, err
+}
+
+// LoadDynamic is like Load but invokes updateFn whenever the loaded files
+// change, or new dynamic secrets are issued once the lease of the previous ones
+// can't be renewed anymore, see LoadDefaultDynamic. Secrets are decrypted with
+// ctx, which also stops the watching once done.
+func (l *Loader) LoadDynamic(ctx context.Context, propNames []string, updateFn func(map[string]interface{}, error)) (map[string]interface{}, error) {
+	confDir := l.ConfigDir()
+	if confDir == "" {
+		return nil, errors.New("could not find config directory")
+	}
+	config, files, err := l.loadProperties(ctx, propNames, confDir)
+	if err == nil {
+		l.engines.ReleaseReplaced()
+	}
+	if len(files) > 0 {
+		go l.watchConfigFiles(ctx, files, config, updateFn)
+	}
+	return config, err
+}
+
+// Close releases the vault connection of the loader's copy of
+// secrets.Engines, revoking its leases and token once no other registry uses
+// it. The registry given WithSecretEngines is left alone.
+func (l *Loader) Close() {
+	if l.ownEngines {
+		l.engines.Close()
+	}
+}
+
+func (l *Loader) resolver(opts ...yaml.ResolverOption) *yaml.Resolver {
+	base := []yaml.ResolverOption{yaml.WithSecretEngines(l.engines), yaml.WithLogger(l.logger), yaml.WithFs(l.fs)}
+	if l.tracker != nil {
+		base = append(base, yaml.WithSecretTracker(l.tracker))
+	}
+	if l.expandKeys {
+		base = append(base, yaml.WithKeyExpansion())
+	}
+	for name, fn := range l.funcs {
+		base = append(base, yaml.WithPlaceholderFunc(name, fn))
+	}
+	return yaml.NewResolver(append(base, opts...)...)
+}
+
+// resolve merges the file configs with the property sources, resolves and
+// validates the result. files are the files propMaps were read from.
+func (l *Loader) resolve(ctx context.Context, propMaps []map[interface{}]interface{}, files []string) (map[string]interface{}, error) {
+	for _, source := range l.sources {
+		props, err := source.Properties()
+		if err != nil {
+			return nil, err
+		}
+		propMaps = append(propMaps, props)
+	}
+
+	var minLease time.Duration
+	var leases []<-chan struct{}
+	var secretPaths []string
+	trackLeases := yaml.WithDecryptHook(func(path string, d secrets.Decrypter) {
+		secretPaths = append(secretPaths, path)
+		if la, ok := d.(secrets.LeaseAware); ok {
+			if lease := la.LeaseDuration(); lease > 0 && (minLease == 0 || lease < minLease) {
+				minLease = lease
+			}
+		}
+		if lw, ok := d.(secrets.LeaseWatcher); ok {
+			if done := lw.LeaseDone(); done != nil {
+				leases = append(leases, done)
+			}
+		}
+	})
+	opts := []yaml.ResolverOption{trackLeases}
+	if l.collect {
+		opts = append(opts, yaml.WithCollectErrors(l.locate(files)))
+	}
+	m, err := l.resolver(opts...).ResolveContext(ctx, propMaps, l.env)
+	if err != nil {
+		return nil, err
+	}
+	l.minLease.Store(int64(minLease))
+	l.watchLeases(leases)
+
+	if l.schema != nil {
+		if err := l.schema.Validate(m, l.locate(files)); err != nil {
+			return nil, err
+		}
+	}
+	l.secretsMu.Lock()
+	l.secrets = secretValues(m, secretPaths)
+	l.secretsMu.Unlock()
+	return m, nil
+}
+
+// secretValues returns the leaves of m found at or under the given secret
+// paths, structured secrets having several.
+func secretValues(m map[string]interface{}, paths []string) map[string]string {
+	values := map[string]string{}
+	if len(paths) == 0 {
+		return values
+	}
+	for k, v := range yaml.Flatten(m) {
+		for _, p := range paths {
+			if k == p || strings.HasPrefix(k, p+".") || strings.HasPrefix(k, p+"[") {
+				values[k] = v
+				break
+			}
+		}
+	}
+	return values
+}
+
+// lastSecrets returns the decrypted values of the last resolution.
+func (l *Loader) lastSecrets() map[string]string {
+	l.secretsMu.Lock()
+	defer l.secretsMu.Unlock()
+	return l.secrets
+}
+
+// locate returns where the values of the given files are defined, files
+// coming last taking precedence.
+func (l *Loader) locate(files []string) yaml.Locations {
+	locs := yaml.Locations{}
+	for _, f := range files {
+		data, err := afero.ReadFile(l.fs, f)
+		if err != nil {
+			continue
+		}
+		locate := formatOf(f).locate
+		if locate == nil {
+			continue
+		}
+		fileLocs, err := locate(f, data)
+		if err != nil {
+			continue
+		}
+		locs.Merge(fileLocs)
+	}
+	return locs
+}
+
+// watchLeases replaces the leases watched by leasesDone.
+func (l *Loader) watchLeases(leases []<-chan struct{}) {
+	l.leasesMu.Lock()
+	defer l.leasesMu.Unlock()
+	if l.stopLeases != nil {
+		close(l.stopLeases)
+	}
+	l.leasesDone, l.stopLeases = nil, nil
+	if len(leases) == 0 {
+		return
+	}
+	done, stop := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	seen := map[<-chan struct{}]bool{}
+	for _, lease := range leases {
+		// the keys of a dynamic secret share its lease
+		if seen[lease] {
+			continue
+		}
+		seen[lease] = true
+		go func(lease <-chan struct{}) {
+			select {
+			case <-lease:
+				once.Do(func() { close(done) })
+			case <-stop:
+			}
+		}(lease)
+	}
+	l.leasesDone, l.stopLeases = done, stop
+}
+
+// expiredLeases returns a channel closed once a dynamic secret of the last
+// resolution must be issued again, nil when there's none.
+func (l *Loader) expiredLeases() <-chan struct{} {
+	l.leasesMu.Lock()
+	defer l.leasesMu.Unlock()
+	return l.leasesDone
+}
+
+// minRefreshInterval keeps short leases from turning the refresh into a busy loop.
+const minRefreshInterval = time.Second
+
+// nextRefresh returns when secrets should be refreshed next: after the refresh
+// interval, or once two thirds of the shortest lease have elapsed if sooner.
+func (l *Loader) nextRefresh() time.Duration {
+	next := l.refreshInterval
+	if lease := time.Duration(l.minLease.Load()); lease > 0 && lease*2/3 < next {
+		next = lease * 2 / 3
+	}
+	if next < minRefreshInterval {
+		next = minRefreshInterval
+	}
+	return next
+}
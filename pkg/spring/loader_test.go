@@ -0,0 +1,422 @@
+package spring
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/armory/go-yaml-tools/pkg/logging"
+	"github.com/armory/go-yaml-tools/pkg/secrets"
+	"github.com/armory/go-yaml-tools/pkg/yaml"
+)
+
+func TestLoadersAreIndependent(t *testing.T) {
+	fs1 := afero.NewMemMapFs()
+	fs2 := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs1, "/one/gate.yml", []byte("name: ${NAME}"), 0644))
+	assert.NoError(t, afero.WriteFile(fs2, "/two/gate.yml", []byte("name: two"), 0644))
+	assert.NoError(t, afero.WriteFile(fs2, "/two/gate-prod.yml", []byte("env: prod"), 0644))
+
+	l1 := NewLoader(WithFs(fs1), WithConfigDirs("/missing", "/one"), WithEnv(map[string]string{"NAME": "one"}))
+	l2 := NewLoader(WithFs(fs2), WithConfigDirs("/two"), WithEnviron([]string{"SPRING_PROFILES_ACTIVE=prod"}))
+
+	assert.Equal(t, "/one", l1.ConfigDir())
+	assert.Equal(t, []string{"armory", "local"}, l1.Profiles())
+	assert.Equal(t, []string{"prod"}, l2.Profiles())
+
+	c1, err := l1.Load([]string{"gate"})
+	assert.NoError(t, err)
+	c2, err := l2.Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "one"}, c1)
+	assert.Equal(t, map[string]interface{}{"name": "two", "env": "prod"}, c2)
+}
+
+func TestLoaderMissingConfigDir(t *testing.T) {
+	l := NewLoader(WithFs(afero.NewMemMapFs()), WithConfigDirs("/missing"))
+	_, err := l.Load([]string{"gate"})
+	assert.Error(t, err)
+	_, err = l.LoadDynamic(context.TODO(), []string{"gate"}, func(map[string]interface{}, error) {})
+	assert.Error(t, err)
+}
+
+func TestLoaderPropertySources(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("a: file\nb: file"), 0644))
+	source := MapPropertySource{"b": "source", "list": []interface{}{1}}
+
+	l := NewLoader(WithFs(mfs), WithConfigDir("/config"), WithPropertySources(source))
+	c, err := l.Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Equal(t, "file", c["a"])
+	assert.Equal(t, "source", c["b"])
+	assert.Equal(t, []interface{}{"1"}, c["list"])
+	// the source is left untouched by resolution
+	assert.Equal(t, []interface{}{1}, source["list"])
+}
+
+func TestLoaderSecretEngines(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("password: encrypted:custom!s3cr3t"), 0644))
+	engines := secrets.NewRegistry()
+	engines.Register("custom", func(ctx context.Context, isFile bool, params string) (secrets.Decrypter, error) {
+		return secrets.NewNoopDecrypter(ctx, isFile, "decrypted-"+params)
+	})
+
+	c, err := NewLoader(WithFs(mfs), WithConfigDir("/config"), WithSecretEngines(engines)).Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Equal(t, "decrypted-s3cr3t", c["password"])
+
+	// the global engines don't know about the custom engine
+	_, err = NewLoader(WithFs(mfs), WithConfigDir("/config")).Load([]string{"gate"})
+	assert.Error(t, err)
+
+	// loaders copy the global engines when created
+	secrets.Engines.Register("custom", func(ctx context.Context, isFile bool, params string) (secrets.Decrypter, error) {
+		return secrets.NewNoopDecrypter(ctx, isFile, "global-"+params)
+	})
+	defer secrets.Engines.Unregister("custom")
+	c, err = NewLoader(WithFs(mfs), WithConfigDir("/config")).Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Equal(t, "global-s3cr3t", c["password"])
+}
+
+func TestLoaderPlaceholderFunc(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("region: ${region.of(gate)}"), 0644))
+	regionOf := func(service string) (string, error) { return service + "-us-west-2", nil }
+
+	c, err := NewLoader(WithFs(mfs), WithConfigDir("/config"), WithPlaceholderFunc("region.of", regionOf)).Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Equal(t, "gate-us-west-2", c["region"])
+}
+
+func TestLoaderFilePlaceholder(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("token: ${file(/secrets/token)}"), 0644))
+	assert.NoError(t, afero.WriteFile(mfs, "/secrets/token", []byte("in-memory"), 0600))
+
+	c, err := NewLoader(WithFs(mfs), WithConfigDir("/config")).Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Equal(t, "in-memory", c["token"])
+}
+
+func TestLoaderCollectErrors(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("name: gate\ndb:\n  password: encrypted:unknown!s3cr3t\n  url: ${db.host}/${name}\n"), 0644))
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.properties", []byte("a=1\na.b=2\n"), 0644))
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate-local.yml", []byte("foo: [\n"), 0644))
+
+	_, err := NewLoader(WithFs(mfs), WithConfigDir("/config"), WithProfiles("local")).Load([]string{"gate"})
+	var multi *yaml.MultiError
+	assert.False(t, errors.As(err, &multi), "only the first error is returned by default")
+
+	_, err = NewLoader(WithFs(mfs), WithConfigDir("/config"), WithProfiles("local"), WithCollectErrors()).Load([]string{"gate"})
+	if !assert.True(t, errors.As(err, &multi), "error was %v", err) {
+		return
+	}
+	var found []string
+	for _, p := range multi.Problems {
+		found = append(found, p.Location.String()+" "+p.Path)
+	}
+	assert.Equal(t, []string{
+		"/config/gate.properties:2 ",
+		"/config/gate-local.yml:1 ",
+		"/config/gate.yml:3 db.password",
+		"/config/gate.yml:4 db.url",
+	}, found)
+	assert.True(t, errors.Is(err, yaml.ErrUnresolvedPlaceholder))
+	assert.Contains(t, err.Error(), "4 problem(s) in configuration")
+	assert.Contains(t, err.Error(), "/config/gate.yml:4: db.url: unresolved placeholder ${db.host}")
+}
+
+func TestLoaderLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("a: b"), 0644))
+
+	_, err := NewLoader(WithFs(mfs), WithConfigDir("/config"), WithLogger(logging.NewLogrus(l))).Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `msg="configured with settings from file" file=/config/gate.yml`)
+}
+
+type leasedDecrypter struct {
+	secrets.Decrypter
+	lease time.Duration
+}
+
+func (l leasedDecrypter) LeaseDuration() time.Duration {
+	return l.lease
+}
+
+func TestLoaderSecretRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spring-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(dir+"/gate.yml", []byte("password: encrypted:rotating!"), 0644))
+
+	var mu sync.Mutex
+	values := []string{"v1", "v1", "v2"}
+	engines := secrets.NewRegistry()
+	engines.Register("rotating", func(ctx context.Context, isFile bool, params string) (secrets.Decrypter, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		v := values[0]
+		if len(values) > 1 {
+			values = values[1:]
+		}
+		return secrets.NewNoopDecrypter(ctx, isFile, v)
+	})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	updates := make(chan map[string]interface{}, 1)
+	l := NewLoader(WithConfigDir(dir), WithSecretEngines(engines), WithSecretRefresh(time.Second))
+	c, err := l.LoadDynamic(ctx, []string{"gate"}, func(cfg map[string]interface{}, err error) {
+		assert.NoError(t, err)
+		updates <- cfg
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", c["password"])
+
+	select {
+	case cfg := <-updates:
+		// the unchanged refresh in between didn't trigger the callback
+		assert.Equal(t, "v2", cfg["password"])
+	case <-ctx.Done():
+		t.Fatal("secret refresh never happened")
+	}
+}
+
+func TestLoaderSecretRefreshIgnoresRandomValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spring-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(dir+"/gate.yml", []byte("password: encrypted:noop!s3cr3t\nid: ${random.uuid}"), 0644))
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 3500*time.Millisecond)
+	defer cancel()
+	var updates int32
+	l := NewLoader(WithConfigDir(dir), WithSecretRefresh(time.Second))
+	_, err = l.LoadDynamic(ctx, []string{"gate"}, func(cfg map[string]interface{}, err error) {
+		atomic.AddInt32(&updates, 1)
+	})
+	assert.NoError(t, err)
+
+	// every refresh gives a new id, but the secret didn't change
+	<-ctx.Done()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&updates))
+}
+
+// watchedDecrypter is a decrypter whose lease ends when done is closed.
+type watchedDecrypter struct {
+	secrets.Decrypter
+	done chan struct{}
+}
+
+func (w watchedDecrypter) LeaseDone() <-chan struct{} {
+	return w.done
+}
+
+func TestLoaderDynamicSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spring-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(dir+"/gate.yml", []byte("db:\n  username: encrypted:creds!u\n  password: encrypted:creds!p\n"), 0644))
+
+	var mu sync.Mutex
+	issued := 0
+	lease := make(chan struct{})
+	engines := secrets.NewRegistry()
+	engines.Register("creds", func(ctx context.Context, isFile bool, params string) (secrets.Decrypter, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		// password is resolved first
+		if params == "p" {
+			issued++
+		}
+		d, _ := secrets.NewNoopDecrypter(ctx, isFile, fmt.Sprintf("%s%d", params, issued))
+		return watchedDecrypter{Decrypter: d, done: lease}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	updates := make(chan map[string]interface{}, 1)
+	l := NewLoader(WithConfigDir(dir), WithSecretEngines(engines))
+	c, err := l.LoadDynamic(ctx, []string{"gate"}, func(cfg map[string]interface{}, err error) {
+		assert.NoError(t, err)
+		updates <- cfg
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"username": "u1", "password": "p1"}, c["db"])
+
+	mu.Lock()
+	close(lease)
+	lease = make(chan struct{})
+	mu.Unlock()
+	select {
+	case cfg := <-updates:
+		assert.Equal(t, map[string]interface{}{"username": "u2", "password": "p2"}, cfg["db"])
+	case <-ctx.Done():
+		t.Fatal("dynamic secrets were never issued again")
+	}
+}
+
+func TestLoaderReleasesReplacedVaultConfig(t *testing.T) {
+	var mu sync.Mutex
+	var issued int
+	var revoked []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/database/creds/app":
+			issued++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"lease_id":       fmt.Sprintf("database/creds/app/%d", issued),
+				"lease_duration": 3600,
+				"data":           map[string]interface{}{"password": fmt.Sprintf("pass-%d", issued)},
+			})
+		case "/v1/sys/leases/revoke":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			revoked = append(revoked, body["lease_id"])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	revokedLeases := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), revoked...)
+	}
+	config := func(token, extra string) []byte {
+		return []byte(fmt.Sprintf("secrets:\n  vault:\n    enabled: true\n    url: %s\n    authMethod: TOKEN\n    token: %s\n"+
+			"password: encrypted:vault!e:database!p:creds/app!k:password!d:true\n%s", srv.URL, token, extra))
+	}
+
+	dir, err := ioutil.TempDir("", "spring-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(dir+"/gate.yml", config("token-1", ""), 0644))
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	type update struct {
+		cfg map[string]interface{}
+		err error
+	}
+	updates := make(chan update, 1)
+	next := func() update {
+		select {
+		case u := <-updates:
+			return u
+		case <-ctx.Done():
+			t.Fatal("configuration never reloaded")
+			return update{}
+		}
+	}
+	l := NewLoader(WithConfigDir(dir))
+	c, err := l.LoadDynamic(ctx, []string{"gate"}, func(cfg map[string]interface{}, err error) {
+		updates <- update{cfg, err}
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "pass-1", c["password"])
+
+	// the last known good configuration keeps its credentials when the
+	// reload with a new vault configuration fails
+	time.Sleep(500 * time.Millisecond)
+	assert.NoError(t, ioutil.WriteFile(dir+"/gate.yml", config("token-2", "broken: encrypted:missing!x"), 0644))
+	u := next()
+	assert.Error(t, u.err)
+	assert.Equal(t, "pass-1", u.cfg["password"])
+	assert.Never(t, func() bool { return len(revokedLeases()) > 0 }, 500*time.Millisecond, 10*time.Millisecond)
+
+	// they're revoked once the new configuration is delivered
+	assert.NoError(t, ioutil.WriteFile(dir+"/gate.yml", config("token-2", ""), 0644))
+	u = next()
+	assert.NoError(t, u.err)
+	assert.NotEqual(t, "pass-1", u.cfg["password"])
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"database/creds/app/1"}, revokedLeases())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and the current ones once the loader is closed
+	l.Close()
+	assert.Eventually(t, func() bool { return len(revokedLeases()) == 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNextRefresh(t *testing.T) {
+	engines := secrets.NewRegistry()
+	engines.Register("leased", func(ctx context.Context, isFile bool, params string) (secrets.Decrypter, error) {
+		d, _ := secrets.NewNoopDecrypter(ctx, isFile, params)
+		return leasedDecrypter{Decrypter: d, lease: 30 * time.Second}, nil
+	})
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("a: b"), 0644))
+
+	l := NewLoader(WithFs(mfs), WithConfigDir("/config"), WithSecretEngines(engines), WithSecretRefresh(time.Minute))
+	_, err := l.Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, l.nextRefresh())
+
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("a: encrypted:leased!b"), 0644))
+	_, err = l.Load([]string{"gate"})
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Second, l.nextRefresh())
+
+	l = NewLoader(WithFs(mfs), WithConfigDir("/config"), WithSecretEngines(engines), WithSecretRefresh(time.Millisecond))
+	assert.Equal(t, minRefreshInterval, l.nextRefresh())
+}
+
+func TestLoaderSchema(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("services:\n  echo:\n    port: 8089\n"), 0644))
+	assert.NoError(t, afero.WriteFile(mfs, "/config/gate-local.yml", []byte("servcies:\n  echo:\n    port: 8090\n"), 0644))
+	schema, err := yaml.CompileSchema([]byte(`{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {"services": {"type": "object"}}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = LoadProperties([]string{"gate"}, "/config", []string{"SPRING_PROFILES_ACTIVE=local"}, WithFs(mfs), WithSchema(schema))
+	var schemaErr *yaml.SchemaError
+	if assert.ErrorAs(t, err, &schemaErr) && assert.Len(t, schemaErr.Violations, 1) {
+		assert.Equal(t, "servcies", schemaErr.Violations[0].Path)
+		assert.Equal(t, yaml.Location{File: "/config/gate-local.yml", Line: 1}, schemaErr.Violations[0].Location)
+	}
+
+	c, err := LoadProperties([]string{"gate"}, "/config", []string{"SPRING_PROFILES_ACTIVE=prod"}, WithFs(mfs), WithSchema(schema))
+	assert.NoError(t, err)
+	assert.NotNil(t, c["services"])
+}
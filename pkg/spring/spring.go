@@ -6,16 +6,18 @@ import (
 	"fmt"
 	"github.com/go-bongo/go-dotaccess"
 
+	"github.com/armory/go-yaml-tools/pkg/logging"
+	"github.com/armory/go-yaml-tools/pkg/secrets"
+	"github.com/armory/go-yaml-tools/pkg/yaml"
 	"github.com/fsnotify/fsnotify"
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 	yamlParse "gopkg.in/yaml.v2"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
 	"strings"
-
-	"github.com/armory/go-yaml-tools/pkg/yaml"
+	"time"
 )
 
 type SpringEnv struct {
@@ -33,6 +35,10 @@ func (s *SpringEnv) initialize() {
 }
 
 func (s *SpringEnv) buildConfigDirs() {
+	s.DefaultConfigDirs = defaultConfigDirs()
+}
+
+func defaultConfigDirs() []string {
 	paths := []string{
 		// The order matters.
 		"/home/spinnaker/config",
@@ -45,7 +51,7 @@ func (s *SpringEnv) buildConfigDirs() {
 		paths = append(paths, filepath.Join(usr.HomeDir, ".spinnaker"))
 		paths = append(paths, filepath.Join(usr.HomeDir, ".armory"))
 	}
-	s.DefaultConfigDirs = paths
+	return paths
 }
 
 func (s *SpringEnv) configDirectory() string {
@@ -73,41 +79,64 @@ func (s *SpringEnv) profiles() []string {
 // OS's file system. This will allow us to test our package.
 var fs = afero.NewOsFs()
 
-func loadConfig(configFile string) (map[interface{}]interface{}, error) {
+// newLoader returns a loader reading from the package file system. Like before
+// loaders existed, it registers the vault configuration it finds in the global
+// secrets.Engines.
+func newLoader(opts ...Option) *Loader {
+	return NewLoader(append([]Option{WithFs(fs), WithSecretEngines(secrets.Engines)}, opts...)...)
+}
+
+// errUnreadableConfig is returned by readConfig for a file that exists but
+// can't be read.
+var errUnreadableConfig = errors.New("unable to read config file")
+
+// loadConfig reads a config file, skipping it if it can't be read.
+func (l *Loader) loadConfig(configFile string) (map[interface{}]interface{}, error) {
+	s, err := l.readConfig(configFile)
+	if errors.Is(err, errUnreadableConfig) {
+		return nil, nil
+	}
+	return s, err
+}
+
+// readConfig reads a config file. A missing file gives an empty config, a file
+// that can't be read an error wrapping errUnreadableConfig.
+func (l *Loader) readConfig(configFile string) (map[interface{}]interface{}, error) {
 	s := map[interface{}]interface{}{}
-	if _, err := fs.Stat(configFile); err == nil {
-		bytes, err := afero.ReadFile(fs, configFile)
+	if _, err := l.fs.Stat(configFile); err == nil {
+		bytes, err := afero.ReadFile(l.fs, configFile)
 		if err != nil {
-			log.Errorf("Unable to open config file %s: %v", configFile, err)
-			return nil, nil
+			l.logger.Error("unable to open config file", logging.FileKey, configFile, logging.ErrorKey, err)
+			return nil, fmt.Errorf("%w %s: %v", errUnreadableConfig, configFile, err)
 		}
-		if err = yamlParse.Unmarshal(bytes, &s); err != nil {
+		if s, err = formatOf(configFile).parse(bytes); err != nil {
 			return s, fmt.Errorf("unable to parse config file %s: %w", configFile, err)
 		}
 		importRef, err := dotaccess.Get(s, "spring.config.import")
 		if importRef != nil {
 			importVal := fmt.Sprintf("%v", importRef)
-			log.Info("Found spring import... loading from ", importVal)
-			bytes, err = afero.ReadFile(fs, importVal)
+			l.logger.Info("found spring import", logging.FileKey, configFile, "import", importVal)
+			bytes, err = afero.ReadFile(l.fs, importVal)
 			err := yamlParse.UnmarshalStrict(bytes, &s)
 			if err != nil {
-				log.Error("Unable to import spring import... ", err)
+				l.logger.Error("unable to load spring import", logging.FileKey, importVal, logging.ErrorKey, err)
 				return s, err
 			}
 		}
-		log.Info("Configured with settings from file: ", configFile)
+		l.logger.Info("configured with settings from file", logging.FileKey, configFile)
 	} else {
-		logFsStatError(err, "Config file ", configFile, " not present; falling back to default settings")
+		l.logFsStatError(err, "config file not present, falling back to default settings", logging.FileKey, configFile)
 	}
 	return s, nil
 }
 
-func logFsStatError(err error, args ...interface{}) {
+func (l *Loader) logFsStatError(err error, msg string, keysAndValues ...interface{}) {
+	keysAndValues = append(keysAndValues, logging.ErrorKey, err)
 	if os.IsNotExist(err) {
-		log.WithError(err).Debug(args...)
+		l.logger.Debug(msg, keysAndValues...)
 		return
 	}
-	log.WithError(err).Error(args...)
+	l.logger.Error(msg, keysAndValues...)
 }
 
 // LoadProperties tries to do what spring properties manages by loading files
@@ -129,49 +158,161 @@ func logFsStatError(err error, args ...interface{}) {
 // and you'll need to make sure your envKeyPairs has the following key pair as one of it's variables
 //
 //	SPRING_PROFILES_ACTIVE="armory,local"
-func LoadProperties(propNames []string, configDir string, envKeyPairs []string) (map[string]interface{}, error) {
+//
+// Besides yaml, files can be written in json, toml, java .properties or dotenv
+// (.env) format. When a name has files in several formats they are all
+// merged, from lowest to highest precedence: .env, .properties, .toml, .json,
+// .yml and .yaml. In .properties and .env files, keys such as "a.b[0]" are
+// expanded to nested maps and lists.
+//
+// Additional options, such as WithSchema, can be given with opts.
+func LoadProperties(propNames []string, configDir string, envKeyPairs []string, opts ...Option) (map[string]interface{}, error) {
 	envMap := keyPairToMap(envKeyPairs)
 	profStr := envMap["SPRING_PROFILES_ACTIVE"]
 	profs := strings.Split(profStr, ",")
-	config, _, err := loadProperties(propNames, configDir, profs, envMap)
+	l := newLoader(append([]Option{WithConfigDir(configDir), WithProfiles(profs...), WithEnv(envMap)}, opts...)...)
+	config, _, err := l.loadProperties(context.Background(), propNames, configDir)
 	return config, err
 }
 
 // Similar to LoadDefault but provides a callback function that will be invoked when a configuration change
-// is detected. Parsing errors are also provided to the callback, so check for these as well.
+// is detected. Reloads are all or nothing: if any tracked file fails to parse or the merged configuration
+// fails to resolve, the callback receives the last good configuration along with a *ReloadError.
 // This works by keeping track of files parsed during the initial parsing, it means that files will only
 // be tracked if they contain something. e.g. you cannot dynamically add a profile.
 // Environment variables are frozen on the initial run. This is by design
-func LoadDefaultDynamic(ctx context.Context, propNames []string, updateFn func(map[string]interface{}, error)) (map[string]interface{}, error) {
+func LoadDefaultDynamic(ctx context.Context, propNames []string, updateFn func(map[string]interface{}, error), opts ...Option) (map[string]interface{}, error) {
 	env := SpringEnv{}
 	env.initialize()
-	return LoadDefaultDynamicWithEnv(env, ctx, propNames, updateFn)
+	return LoadDefaultDynamicWithEnv(env, ctx, propNames, updateFn, opts...)
 }
 
-func LoadDefaultDynamicWithEnv(env SpringEnv, ctx context.Context, propNames []string, updateFn func(map[string]interface{}, error)) (map[string]interface{}, error) {
+func LoadDefaultDynamicWithEnv(env SpringEnv, ctx context.Context, propNames []string, updateFn func(map[string]interface{}, error), opts ...Option) (map[string]interface{}, error) {
 	if env.ConfigDir == "" {
 		return nil, errors.New("could not find config directory")
 	}
 
-	config, files, err := loadProperties(propNames, env.ConfigDir, env.profiles(), env.EnvMap)
-	if len(files) > 0 {
-		go watchConfigFiles(ctx, files, env.EnvMap, updateFn)
+	return env.loader(opts...).LoadDynamic(ctx, propNames, updateFn)
+}
+
+func (s *SpringEnv) loader(opts ...Option) *Loader {
+	return newLoader(append([]Option{WithConfigDir(s.ConfigDir), WithProfiles(s.profiles()...), WithEnv(s.EnvMap)}, opts...)...)
+}
+
+// ReloadError is handed to the update callback of LoadDefaultDynamic when a
+// configuration change could not be applied. When a reload fails, the callback
+// receives the last configuration that loaded successfully alongside the error.
+type ReloadError struct {
+	// File is the tracked file that failed to load, empty if the failure
+	// happened while resolving the merged configuration.
+	File string
+	// Line is the line reported by the parser, 0 if unknown.
+	Line int
+	// ConsecutiveFailures counts the failed reloads since the last successful one.
+	ConsecutiveFailures int
+	Err                 error
+}
+
+func (e *ReloadError) Error() string {
+	switch {
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("reload failed (%d consecutive) in %s at line %d: %v", e.ConsecutiveFailures, e.File, e.Line, e.Err)
+	case e.File != "":
+		return fmt.Sprintf("reload failed (%d consecutive) in %s: %v", e.ConsecutiveFailures, e.File, e.Err)
+	default:
+		return fmt.Sprintf("reload failed (%d consecutive): %v", e.ConsecutiveFailures, e.Err)
 	}
-	return config, err
 }
 
-func watchConfigFiles(ctx context.Context, files []string, envMap map[string]string, updateFn func(map[string]interface{}, error)) {
+func (e *ReloadError) Unwrap() error {
+	return e.Err
+}
+
+func newReloadError(file string, err error) *ReloadError {
+	return &ReloadError{File: file, Line: errorLine(err), Err: err}
+}
+
+// reloadConfig reads and resolves every tracked file. It fails as a whole if any
+// of them is missing, unparsable or cannot be resolved, so that a partial
+// configuration never reaches the update callback.
+func (l *Loader) reloadConfig(ctx context.Context, files []string) (map[string]interface{}, *ReloadError) {
+	var cfgs []map[interface{}]interface{}
+	for _, f := range files {
+		if _, err := l.fs.Stat(f); err != nil {
+			return nil, newReloadError(f, err)
+		}
+		config, err := l.readConfig(f)
+		if err != nil {
+			l.logger.Error("unable to load config file", logging.FileKey, f, logging.ErrorKey, err)
+			return nil, newReloadError(f, err)
+		}
+		cfgs = append(cfgs, config)
+	}
+	m, err := l.resolve(ctx, cfgs, files)
+	if err != nil {
+		return nil, &ReloadError{Err: err}
+	}
+	return m, nil
+}
+
+// settleDelay is how long file events must stop before reloading. Editors
+// commonly truncate a file before writing it, reloading on the first event
+// would load an empty or half written file.
+const settleDelay = 100 * time.Millisecond
+
+// reissueDelay is how long to wait before trying again to issue dynamic
+// secrets whose lease expired.
+const reissueDelay = 10 * time.Second
+
+func (l *Loader) watchConfigFiles(ctx context.Context, files []string, current map[string]interface{}, updateFn func(map[string]interface{}, error)) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.WithError(err).Errorf("unable to watch any file")
+		l.logger.Error("unable to watch any file", logging.ErrorKey, err)
 		return
 	}
 	defer watcher.Close()
 
+	// refresh stays nil, and never fires, unless secret refresh is enabled
+	var refresh <-chan time.Time
+	var refreshTimer *time.Timer
+	if l.refreshInterval > 0 {
+		refreshTimer = time.NewTimer(l.nextRefresh())
+		defer refreshTimer.Stop()
+		refresh = refreshTimer.C
+	}
+
+	// settle fires once file events stopped for settleDelay
+	var settle <-chan time.Time
+	failures := 0
+	// reissue fires to try again issuing dynamic secrets after a failure
+	var reissue <-chan time.Time
+	// deliver hands m to updateFn, the connections of the vault
+	// configurations it replaced aren't used anymore
+	deliver := func(m map[string]interface{}) {
+		failures = 0
+		current = m
+		updateFn(m, nil)
+		l.engines.ReleaseReplaced()
+	}
+	reissueSecrets := func() {
+		reissue = nil
+		m, rErr := l.reloadConfig(ctx, files)
+		if rErr != nil {
+			failures++
+			rErr.ConsecutiveFailures = failures
+			l.logger.Error("unable to issue new dynamic secrets", logging.FileKey, rErr.File, logging.ErrorKey, rErr)
+			// the expired leases are forgotten, retry later instead
+			l.watchLeases(nil)
+			reissue = time.After(reissueDelay)
+			updateFn(current, rErr)
+			return
+		}
+		deliver(m)
+	}
 	for {
 		for _, f := range files {
 			if err = watcher.Add(f); err != nil {
-				log.WithError(err).Errorf("unable to watch file changes for %s", f)
+				l.logger.Error("unable to watch file changes", logging.FileKey, f, logging.ErrorKey, err)
 			}
 		}
 		select {
@@ -182,24 +323,44 @@ func watchConfigFiles(ctx context.Context, files []string, envMap map[string]str
 				return
 			}
 			shouldRebuild := isAnyType(event, fsnotify.Write, fsnotify.Chmod, fsnotify.Rename)
-			log.Debugf("fs event %s, rebuilding config = %v", event.String(), shouldRebuild)
+			l.logger.Debug("fs event", logging.FileKey, event.Name, "op", event.Op.String(), "rebuild", shouldRebuild)
 			if shouldRebuild {
-				var cfgs []map[interface{}]interface{}
-				for _, f := range files {
-					config, err := loadConfig(f)
-					if err != nil {
-						log.Errorf("file %s had error %s", f, err.Error())
-					}
-					cfgs = append(cfgs, config)
-				}
-				m, err := yaml.Resolve(cfgs, envMap)
-				updateFn(m, err)
+				settle = time.After(settleDelay)
+			}
+		case <-settle:
+			settle = nil
+			m, rErr := l.reloadConfig(ctx, files)
+			if rErr != nil {
+				failures++
+				rErr.ConsecutiveFailures = failures
+				l.logger.Error("keeping last known good configuration", logging.FileKey, rErr.File, logging.ErrorKey, rErr)
+				updateFn(current, rErr)
+				continue
 			}
+			deliver(m)
+		case <-refresh:
+			// only the secrets are compared, placeholders such as
+			// ${random.uuid} give a new config on every resolution
+			before := l.lastSecrets()
+			m, rErr := l.reloadConfig(ctx, files)
+			switch {
+			case rErr != nil:
+				l.logger.Error("unable to refresh secrets", logging.FileKey, rErr.File, logging.ErrorKey, rErr)
+			case !reflect.DeepEqual(before, l.lastSecrets()):
+				l.logger.Info("secrets changed, reloading configuration")
+				deliver(m)
+			}
+			refreshTimer.Reset(l.nextRefresh())
+		case <-l.expiredLeases():
+			l.logger.Info("dynamic secrets can't be renewed anymore, reloading configuration")
+			reissueSecrets()
+		case <-reissue:
+			reissueSecrets()
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
 			}
-			log.Println("error:", err)
+			l.logger.Error("file watcher error", logging.ErrorKey, err)
 		}
 	}
 }
@@ -229,19 +390,18 @@ func isAnyType(event fsnotify.Event, _types ...fsnotify.Op) bool {
 //
 //	Pulls os.Environ()
 //
-// Specify propNames in the same way as LoadProperties().
-func LoadDefault(propNames []string) (map[string]interface{}, error) {
+// Specify propNames and opts in the same way as LoadProperties().
+func LoadDefault(propNames []string, opts ...Option) (map[string]interface{}, error) {
 	env := SpringEnv{}
 	env.initialize()
-	return LoadDefaultWithEnv(env, propNames)
+	return LoadDefaultWithEnv(env, propNames, opts...)
 }
 
-func LoadDefaultWithEnv(env SpringEnv, propNames []string) (map[string]interface{}, error) {
+func LoadDefaultWithEnv(env SpringEnv, propNames []string, opts ...Option) (map[string]interface{}, error) {
 	if env.ConfigDir == "" {
 		return nil, errors.New("could not find config directory")
 	}
-	config, _, err := loadProperties(propNames, env.ConfigDir, env.profiles(), env.EnvMap)
-	return config, err
+	return env.loader(opts...).Load(propNames)
 }
 
 func keyPairToMap(keyPairs []string) map[string]string {
@@ -253,21 +413,24 @@ func keyPairToMap(keyPairs []string) map[string]string {
 	return m
 }
 
-func loadProperties(propNames []string, confDir string, profiles []string, envMap map[string]string) (map[string]interface{}, []string, error) {
+func (l *Loader) loadProperties(ctx context.Context, propNames []string, confDir string) (map[string]interface{}, []string, error) {
+	profiles := l.Profiles()
 	var propMaps []map[interface{}]interface{}
 	var filePaths []string
+	// unparsable files are only recorded when collecting errors
+	var problems *[]yaml.Problem
+	if l.collect {
+		problems = &[]yaml.Problem{}
+	}
 	//first load the main props, i.e. gate.yml/yaml with no profile extensions
 	for _, prop := range propNames {
-		// yaml is "official"
-		config, filePath, err := loadPropertyFromFile(fmt.Sprintf("%s/%s", confDir, prop))
+		configs, files, err := l.loadPropertyFromFile(fmt.Sprintf("%s/%s", confDir, prop), problems)
 		// file might have been unparsable
 		if err != nil {
 			return nil, filePaths, err
 		}
-		if len(config) > 0 {
-			propMaps = append(propMaps, config)
-			filePaths = append(filePaths, filePath)
-		}
+		propMaps = append(propMaps, configs...)
+		filePaths = append(filePaths, files...)
 	}
 
 	for _, prop := range propNames {
@@ -276,34 +439,57 @@ func loadProperties(propNames []string, confDir string, profiles []string, envMa
 		for i := range profiles {
 			p := profiles[i]
 			pTrim := strings.TrimSpace(p)
-			config, filePath, err := loadPropertyFromFile(fmt.Sprintf("%s/%s-%s", confDir, prop, pTrim))
+			configs, files, err := l.loadPropertyFromFile(fmt.Sprintf("%s/%s-%s", confDir, prop, pTrim), problems)
 			if err != nil {
 				return nil, filePaths, err
 			}
-			if len(config) > 0 {
-				propMaps = append(propMaps, config)
-				filePaths = append(filePaths, filePath)
-			}
+			propMaps = append(propMaps, configs...)
+			filePaths = append(filePaths, files...)
 		}
 	}
-	m, err := yaml.Resolve(propMaps, envMap)
-	return m, filePaths, err
-}
-
-func loadPropertyFromFile(pathPrefix string) (map[interface{}]interface{}, string, error) {
-	filePath := fmt.Sprintf("%s.yaml", pathPrefix)
-	config, err := loadConfig(filePath)
-	if err != nil {
-		return config, filePath, err
+	m, err := l.resolve(ctx, propMaps, filePaths)
+	if problems == nil || len(*problems) == 0 {
+		return m, filePaths, err
 	}
-	if len(config) > 0 {
-		return config, filePath, nil
+	var multi *yaml.MultiError
+	switch {
+	case errors.As(err, &multi):
+		*problems = append(*problems, multi.Problems...)
+	case err != nil:
+		*problems = append(*problems, yaml.Problem{Err: err})
 	}
+	return nil, filePaths, &yaml.MultiError{Problems: *problems}
+}
 
-	// but people also use "yml" too, if we don't get anything let's try this
-	filePath = fmt.Sprintf("%s.yml", pathPrefix)
-	config, err = loadConfig(filePath)
-	return config, filePath, err
+// loadPropertyFromFile loads the files of every supported format found for
+// pathPrefix, see configFormats for their precedence. When problems isn't nil,
+// files that fail to load are recorded there and skipped.
+func (l *Loader) loadPropertyFromFile(pathPrefix string, problems *[]yaml.Problem) ([]map[interface{}]interface{}, []string, error) {
+	var configs []map[interface{}]interface{}
+	var filePaths []string
+	// found holds the extensions of the files that had settings or errors
+	found := map[string]bool{}
+	for _, format := range configFormats {
+		if format.fallbackOf != "" && found[format.fallbackOf] {
+			continue
+		}
+		filePath := fmt.Sprintf("%s.%s", pathPrefix, format.ext)
+		config, err := l.loadConfig(filePath)
+		if err != nil {
+			if problems == nil {
+				return nil, nil, err
+			}
+			*problems = append(*problems, yaml.Problem{Location: yaml.Location{File: filePath, Line: errorLine(err)}, Err: err})
+			found[format.ext] = true
+			continue
+		}
+		if len(config) > 0 {
+			configs = append(configs, config)
+			filePaths = append(filePaths, filePath)
+			found[format.ext] = true
+		}
+	}
+	return configs, filePaths, nil
 }
 
 // Bool is a helper routine that allocates a new bool value
@@ -176,7 +176,15 @@ func TestWatchParseError(t *testing.T) {
 		if ctx.Err() != nil {
 			return
 		}
-		assert.Contains(t, buf.String(), "file "+file3+" had error ")
+		assert.Contains(t, buf.String(), "unable to load config file")
+		assert.Contains(t, buf.String(), "file="+file3)
+		assert.Equal(t, "baz", cfg["foo"])
+		var rErr *ReloadError
+		if assert.ErrorAs(t, err, &rErr) {
+			assert.Equal(t, file3, rErr.File)
+			assert.Equal(t, 5, rErr.Line)
+			assert.Equal(t, 1, rErr.ConsecutiveFailures)
+		}
 		cancel()
 	})
 
@@ -203,6 +211,85 @@ kubernetes:
 	}
 }
 
+func TestReloadConfig(t *testing.T) {
+	prevfs := fs
+	defer func() { fs = prevfs }()
+	fs = afero.NewMemMapFs()
+
+	if !assert.NoError(t, writeFileWithContents("/config/gate.yml", "foo: bar")) {
+		return
+	}
+	if !assert.NoError(t, writeFileWithContents("/config/gate-local.yml", "foo: baz\nbar: [")) {
+		return
+	}
+	files := []string{"/config/gate.yml", "/config/gate-local.yml"}
+
+	l := newLoader(WithEnv(map[string]string{}))
+	m, rErr := l.reloadConfig(context.Background(), files)
+	assert.Nil(t, m)
+	if assert.NotNil(t, rErr) {
+		assert.Equal(t, "/config/gate-local.yml", rErr.File)
+		assert.Equal(t, 2, rErr.Line)
+	}
+
+	if !assert.NoError(t, writeFileWithContents("/config/gate-local.yml", "foo: baz")) {
+		return
+	}
+	m, rErr = l.reloadConfig(context.Background(), files)
+	assert.Nil(t, rErr)
+	assert.Equal(t, "baz", m["foo"])
+
+	// a tracked file that disappeared fails the whole reload
+	if !assert.NoError(t, fs.Remove("/config/gate.yml")) {
+		return
+	}
+	m, rErr = l.reloadConfig(context.Background(), files)
+	assert.Nil(t, m)
+	if assert.NotNil(t, rErr) {
+		assert.Equal(t, "/config/gate.yml", rErr.File)
+	}
+}
+
+// unreadableFs fails to open the files it lists, as if they had no read
+// permission.
+type unreadableFs struct {
+	afero.Fs
+	files map[string]bool
+}
+
+func (u unreadableFs) Open(name string) (afero.File, error) {
+	if u.files[name] {
+		return nil, os.ErrPermission
+	}
+	return u.Fs.Open(name)
+}
+
+func TestUnreadableConfig(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	if !assert.NoError(t, afero.WriteFile(mfs, "/config/gate.yml", []byte("foo: bar"), 0644)) {
+		return
+	}
+	if !assert.NoError(t, afero.WriteFile(mfs, "/config/gate-local.yml", []byte("foo: baz"), 0644)) {
+		return
+	}
+	ufs := unreadableFs{Fs: mfs, files: map[string]bool{"/config/gate-local.yml": true}}
+	l := NewLoader(WithFs(ufs), WithConfigDir("/config"), WithEnv(map[string]string{}))
+
+	// the initial load skips unreadable files
+	c, err := l.Load([]string{"gate"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", c["foo"])
+	}
+
+	// a reload fails instead, it would drop settings from the running config
+	m, rErr := l.reloadConfig(context.Background(), []string{"/config/gate.yml", "/config/gate-local.yml"})
+	assert.Nil(t, m)
+	if assert.NotNil(t, rErr) {
+		assert.Equal(t, "/config/gate-local.yml", rErr.File)
+		assert.Contains(t, rErr.Error(), "unable to read config file")
+	}
+}
+
 func TestWatchSymLink(t *testing.T) {
 	dir, err := ioutil.TempDir("", "spring-test")
 	if !assert.Nil(t, err) {
@@ -261,7 +348,7 @@ func Test_logFsStatError(t *testing.T) {
 	if !assert.True(t, os.IsNotExist(err)) {
 		return
 	}
-	logFsStatError(err, "")
+	newLoader().logFsStatError(err, "")
 	if !assert.Len(t, buf.String(), 0) {
 		return
 	}
@@ -287,7 +374,7 @@ func Test_logFsStatError(t *testing.T) {
 	if !assert.Error(t, err) {
 		return
 	}
-	logFsStatError(err, "")
+	newLoader().logFsStatError(err, "")
 	if !assert.Contains(t, buf.String(), "level=error") {
 		return
 	}
@@ -314,7 +401,7 @@ kubernetes:
 	}
 
 	// Test
-	config, paths, err := loadProperties([]string{"kubesvc"}, "", []string{}, map[string]string{})
+	config, paths, err := newLoader(WithProfiles(), WithEnv(map[string]string{})).loadProperties(context.Background(), []string{"kubesvc"}, "")
 
 	const expectedMessage = "unable to parse config file"
 	if !assert.Len(t, paths, 0) {
@@ -353,7 +440,7 @@ key: value
 		return
 	}
 	// Test
-	config, _, err := loadProperties([]string{"kubesvc"}, "/tmp", []string{}, map[string]string{})
+	config, _, err := newLoader(WithProfiles(), WithEnv(map[string]string{})).loadProperties(context.Background(), []string{"kubesvc"}, "/tmp")
 	configImport, _ := dotaccess.Get(config, "spring.config.import")
 	assert.Equal(t, "/tmp/other-config.yaml", configImport)
 	configImport, _ = dotaccess.Get(config, "key")
@@ -385,7 +472,7 @@ valueInConflictingFile: someValue
 		return
 	}
 	// Test
-	config, _, err := loadProperties([]string{"kubesvc"}, "/tmp", []string{}, map[string]string{})
+	config, _, err := newLoader(WithProfiles(), WithEnv(map[string]string{})).loadProperties(context.Background(), []string{"kubesvc"}, "/tmp")
 	configImport, _ := dotaccess.Get(config, "conflicting")
 	assert.Nil(t, configImport)
 	configImport, _ = dotaccess.Get(config, "spring")
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"github.com/armory/go-yaml-tools/pkg/logging"
 	tls2 "github.com/armory/go-yaml-tools/pkg/tls"
 	"io/ioutil"
 	"net/http"
@@ -13,12 +14,28 @@ import (
 type Server struct {
 	config *ServerConfig
 	server *http.Server
+	logger logging.Logger
 }
 
-func NewServer(config *ServerConfig) *Server {
-	return &Server{
+// Option configures a Server.
+type Option func(*Server)
+
+// WithLogger sets the logger of the server, logging.Default() by default.
+func WithLogger(logger logging.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+func NewServer(config *ServerConfig, opts ...Option) *Server {
+	s := &Server{
 		config: config,
+		logger: logging.Default(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Start starts the server on the configured port
@@ -38,12 +55,14 @@ func (s *Server) startHttp(router http.Handler) error {
 		Addr:    s.config.GetAddr(),
 		Handler: router,
 	}
+	s.logger.Info("starting server", "addr", s.server.Addr, "tls", false)
 	return s.server.ListenAndServe()
 }
 
 func (s *Server) startTls(router http.Handler) error {
 	tlsConfig, err := s.tlsConfig()
 	if err != nil {
+		s.logger.Error("unable to configure TLS", logging.FileKey, s.config.Ssl.CertFile, logging.ErrorKey, err)
 		return err
 	}
 
@@ -80,6 +99,7 @@ func (s *Server) startTls(router http.Handler) error {
 	}
 
 	// Listen to HTTPS connections with the server certificate and wait
+	s.logger.Info("starting server", "addr", s.server.Addr, "tls", true, "clientAuth", string(s.config.Ssl.ClientAuth))
 	return s.server.ListenAndServeTLS("", "")
 }
 
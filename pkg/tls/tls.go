@@ -13,15 +13,21 @@ import (
 )
 
 func CheckFileExists(filename string) error {
+	return CheckFileExistsContext(context.Background(), filename)
+}
+
+// CheckFileExistsContext is like CheckFileExists, encrypted files being
+// decrypted with ctx.
+func CheckFileExistsContext(ctx context.Context, filename string) error {
 	if secrets.IsEncryptedSecret(filename) {
-		d, err := secrets.NewDecrypter(context.TODO(), filename)
+		d, err := secrets.NewDecrypter(ctx, filename)
 		if err != nil {
 			return err
 		}
 		if !d.IsFile() {
 			return errors.New("no file referenced, use encryptedFile")
 		}
-		filename, err = d.Decrypt()
+		filename, err = secrets.DecryptContext(ctx, d)
 		if err != nil {
 			return err
 		}
@@ -34,7 +40,13 @@ func CheckFileExists(filename string) error {
 }
 
 func GetX509KeyPair(certFile, keyFile, keyPassword string) (tls.Certificate, error) {
-	if err := CheckFileExists(certFile); err != nil {
+	return GetX509KeyPairContext(context.Background(), certFile, keyFile, keyPassword)
+}
+
+// GetX509KeyPairContext is like GetX509KeyPair, encrypted files and passwords
+// being decrypted with ctx.
+func GetX509KeyPairContext(ctx context.Context, certFile, keyFile, keyPassword string) (tls.Certificate, error) {
+	if err := CheckFileExistsContext(ctx, certFile); err != nil {
 		return tls.Certificate{}, fmt.Errorf("error with certificate file %s: %w", certFile, err)
 	}
 
@@ -43,11 +55,11 @@ func GetX509KeyPair(certFile, keyFile, keyPassword string) (tls.Certificate, err
 		return tls.Certificate{}, err
 	}
 
-	pemBlocks, pkey, err := readAndDecryptPEM(b, keyPassword)
+	pemBlocks, pkey, err := readAndDecryptPEM(ctx, b, keyPassword)
 
 	// If private key not in the cert file, we look for it in the key file
 	if pkey == nil {
-		pkey, err = getPrivateKey(keyFile, keyPassword)
+		pkey, err = getPrivateKey(ctx, keyFile, keyPassword)
 		if err != nil {
 			return tls.Certificate{}, err
 		}
@@ -56,21 +68,21 @@ func GetX509KeyPair(certFile, keyFile, keyPassword string) (tls.Certificate, err
 }
 
 // getPrivateKey attempts to load and decrypt the private key if needed
-func getPrivateKey(keyFile, keyPassword string) ([]byte, error) {
-	if err := CheckFileExists(keyFile); err != nil {
+func getPrivateKey(ctx context.Context, keyFile, keyPassword string) ([]byte, error) {
+	if err := CheckFileExistsContext(ctx, keyFile); err != nil {
 		return nil, fmt.Errorf("error with key file %s: %w", keyFile, err)
 	}
 	b, err := ioutil.ReadFile(keyFile)
 	if err != nil {
 		return nil, err
 	}
-	_, pkey, err := readAndDecryptPEM(b, keyPassword)
+	_, pkey, err := readAndDecryptPEM(ctx, b, keyPassword)
 	return pkey, err
 }
 
 // readAndDecryptPEM reads PEM data and attempts to decrypt if a private key is found encrypted
 // using ssl.keyPassword provided in the config
-func readAndDecryptPEM(data []byte, keyPassword string) ([]*pem.Block, []byte, error) {
+func readAndDecryptPEM(ctx context.Context, data []byte, keyPassword string) ([]*pem.Block, []byte, error) {
 	var pemBlocks []*pem.Block
 	var v *pem.Block
 	var pkey []byte
@@ -82,7 +94,7 @@ func readAndDecryptPEM(data []byte, keyPassword string) ([]*pem.Block, []byte, e
 		}
 		if v.Type == "RSA PRIVATE KEY" {
 			if x509.IsEncryptedPEMBlock(v) {
-				pass, err := getKeyPassword(keyPassword)
+				pass, err := getKeyPassword(ctx, keyPassword)
 				if err != nil {
 					return nil, nil, err
 				}
@@ -101,13 +113,13 @@ func readAndDecryptPEM(data []byte, keyPassword string) ([]*pem.Block, []byte, e
 	return pemBlocks, pkey, nil
 }
 
-func getKeyPassword(keyPassword string) (string, error) {
+func getKeyPassword(ctx context.Context, keyPassword string) (string, error) {
 	if secrets.IsEncryptedSecret(keyPassword) {
-		d, err := secrets.NewDecrypter(context.TODO(), keyPassword)
+		d, err := secrets.NewDecrypter(ctx, keyPassword)
 		if err != nil {
 			return "", err
 		}
-		return d.Decrypt()
+		return secrets.DecryptContext(ctx, d)
 	}
 	if keyPassword == "" {
 		return "", fmt.Errorf("encrypted pem found but no password provided")
@@ -1,6 +1,7 @@
 package tls
 
 import (
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -36,7 +37,7 @@ func TestEncryptedKey(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			p, err := getKeyPassword(c.password)
+			p, err := getKeyPassword(context.Background(), c.password)
 			if assert.Equal(t, c.errExpected, err != nil) {
 				assert.Equal(t, c.expected, p)
 			}
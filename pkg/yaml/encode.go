@@ -0,0 +1,167 @@
+package yaml
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// The encoders write a resolved configuration in a stable form: keys are
+// sorted so that the output of two configurations can be diffed.
+
+// EncodeOption configures the encoders.
+type EncodeOption func(*encodeOptions)
+
+type encodeOptions struct {
+	tracker *SecretTracker
+}
+
+// WithRedaction replaces the secrets recorded by t with Redacted in the output.
+func WithRedaction(t *SecretTracker) EncodeOption {
+	return func(o *encodeOptions) {
+		o.tracker = t
+	}
+}
+
+func prepare(m OutputMap, opts []EncodeOption) OutputMap {
+	o := &encodeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.tracker != nil {
+		return o.tracker.Redact(m)
+	}
+	return m
+}
+
+// EncodeYAML writes m as YAML.
+func EncodeYAML(w io.Writer, m OutputMap, opts ...EncodeOption) error {
+	out, err := yamlv2.Marshal(prepare(m, opts))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// EncodeJSON writes m as indented JSON.
+func EncodeJSON(w io.Writer, m OutputMap, opts ...EncodeOption) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(prepare(m, opts))
+}
+
+// EncodeProperties writes m as a java .properties file with one line per
+// leaf, keyed by its flat path such as "a.b[2].c".
+func EncodeProperties(w io.Writer, m OutputMap, opts ...EncodeOption) error {
+	flat := Flatten(prepare(m, opts))
+	bw := bufio.NewWriter(w)
+	for _, k := range sortedKeys(flat) {
+		fmt.Fprintf(bw, "%s=%s\n", escapeProperty(k, true), escapeProperty(flat[k], false))
+	}
+	return bw.Flush()
+}
+
+func escapeProperty(s string, key bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '=', ':', '#', '!':
+			if key {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		case ' ':
+			// spaces end keys, and leading spaces of values are trimmed
+			if key || i == 0 {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// EncodeEnv writes m as KEY=value lines. Keys are the relaxed names Spring
+// binds environment variables to: "services.echo.base-url" is written as
+// SERVICES_ECHO_BASEURL and "hosts[0].name" as HOSTS_0_NAME. Values that
+// aren't plain words are double quoted, dotenv style.
+func EncodeEnv(w io.Writer, m OutputMap, opts ...EncodeOption) error {
+	flat := Flatten(prepare(m, opts))
+	env := make(map[string]string, len(flat))
+	paths := make(map[string]string, len(flat))
+	for _, k := range sortedKeys(flat) {
+		name := EnvName(k)
+		if other, ok := paths[name]; ok {
+			return fmt.Errorf("keys %q and %q are both written as %s", other, k, name)
+		}
+		paths[name] = k
+		env[name] = flat[k]
+	}
+	bw := bufio.NewWriter(w)
+	for _, name := range sortedKeys(env) {
+		fmt.Fprintf(bw, "%s=%s\n", name, quoteEnv(env[name]))
+	}
+	return bw.Flush()
+}
+
+var invalidEnvChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// EnvName returns the environment variable name of a flat path.
+func EnvName(path string) string {
+	name := strings.NewReplacer("-", "", "]", "", ".", "_", "[", "_").Replace(path)
+	return invalidEnvChars.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+var plainEnvValue = regexp.MustCompile(`^[A-Za-z0-9_./:@,+=-]*$`)
+
+func quoteEnv(s string) string {
+	if plainEnvValue.MatchString(s) {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+package yaml
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeTestConfig() OutputMap {
+	return OutputMap{
+		"services": OutputMap{
+			"echo": OutputMap{
+				"base-url": "http://echo:8089",
+				"enabled":  "true",
+			},
+		},
+		"hosts": []interface{}{
+			OutputMap{"name": "a"},
+			OutputMap{"name": "b c"},
+		},
+		"map":     OutputMap{"x.y": "dotted"},
+		"message": "say \"hi\"\n",
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	cases := []struct {
+		name     string
+		encode   func(*bytes.Buffer, OutputMap) error
+		expected string
+	}{
+		{
+			name:   "yaml",
+			encode: func(b *bytes.Buffer, m OutputMap) error { return EncodeYAML(b, m) },
+			expected: `hosts:
+- name: a
+- name: b c
+map:
+  x.y: dotted
+message: |
+  say "hi"
+services:
+  echo:
+    base-url: http://echo:8089
+    enabled: "true"
+`,
+		},
+		{
+			name:   "json",
+			encode: func(b *bytes.Buffer, m OutputMap) error { return EncodeJSON(b, m) },
+			expected: `{
+  "hosts": [
+    {
+      "name": "a"
+    },
+    {
+      "name": "b c"
+    }
+  ],
+  "map": {
+    "x.y": "dotted"
+  },
+  "message": "say \"hi\"\n",
+  "services": {
+    "echo": {
+      "base-url": "http://echo:8089",
+      "enabled": "true"
+    }
+  }
+}
+`,
+		},
+		{
+			name:   "properties",
+			encode: func(b *bytes.Buffer, m OutputMap) error { return EncodeProperties(b, m) },
+			expected: `hosts[0].name=a
+hosts[1].name=b c
+map[x.y]=dotted
+message=say "hi"\n
+services.echo.base-url=http://echo:8089
+services.echo.enabled=true
+`,
+		},
+		{
+			name:   "env",
+			encode: func(b *bytes.Buffer, m OutputMap) error { return EncodeEnv(b, m) },
+			expected: `HOSTS_0_NAME=a
+HOSTS_1_NAME="b c"
+MAP_X_Y=dotted
+MESSAGE="say \"hi\"\n"
+SERVICES_ECHO_BASEURL=http://echo:8089
+SERVICES_ECHO_ENABLED=true
+`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if assert.NoError(t, c.encode(&b, encodeTestConfig())) {
+				assert.Equal(t, c.expected, b.String())
+			}
+		})
+	}
+}
+
+func TestEncodeEnvCollision(t *testing.T) {
+	var b bytes.Buffer
+	err := EncodeEnv(&b, OutputMap{"a": OutputMap{"b": "1"}, "a_b": "2"})
+	assert.EqualError(t, err, `keys "a.b" and "a_b" are both written as A_B`)
+}
+
+func TestEncodeRedaction(t *testing.T) {
+	tracker := NewSecretTracker()
+	m, err := NewResolver(WithSecretTracker(tracker)).Resolve([]ObjectMap{{
+		"db": ObjectMap{
+			"password": "encrypted:noop!s3cr3t",
+			"short":    "encrypted:noop!ab",
+		},
+		"label": "ab",
+	}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db.password", "db.short"}, tracker.Paths())
+
+	// secrets copied elsewhere are redacted too
+	m["db"].(OutputMap)["url"] = "postgres://admin:s3cr3t@db"
+	var b bytes.Buffer
+	assert.NoError(t, EncodeProperties(&b, m, WithRedaction(tracker)))
+	assert.Equal(t, `db.password=<redacted>
+db.short=<redacted>
+db.url=postgres://admin:<redacted>@db
+label=ab
+`, b.String())
+	// the resolved configuration is left untouched
+	assert.Equal(t, "s3cr3t", m["db"].(OutputMap)["password"])
+}
@@ -0,0 +1,80 @@
+package yaml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnresolvedPlaceholder is reported, when collecting errors, for
+// placeholders found neither in the configuration nor in the environment and
+// without a default.
+var ErrUnresolvedPlaceholder = errors.New("unresolved placeholder")
+
+// Problem is one of the errors found while loading a configuration.
+type Problem struct {
+	// Path is the dotted path of the value that failed, empty for problems
+	// affecting a whole file.
+	Path string
+	// Location is where the value, or the file, is defined, zero if unknown.
+	Location Location
+	Err      error
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.Location.File != "" {
+		b.WriteString(p.Location.String())
+		b.WriteString(": ")
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path)
+		b.WriteString(": ")
+	}
+	b.WriteString(p.Err.Error())
+	return b.String()
+}
+
+// MultiError lists every problem found while loading a configuration when
+// errors are collected, see WithCollectErrors.
+type MultiError struct {
+	Problems []Problem
+}
+
+func (e *MultiError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		lines = append(lines, p.String())
+	}
+	return fmt.Sprintf("%d problem(s) in configuration:\n  %s", len(e.Problems), strings.Join(lines, "\n  "))
+}
+
+// Unwrap returns the errors of the problems, for Go 1.20 and later.
+func (e *MultiError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		errs = append(errs, p.Err)
+	}
+	return errs
+}
+
+// Is tells whether the error of any problem matches target, so that errors.Is
+// looks through them with the Go versions that ignore Unwrap() []error.
+func (e *MultiError) Is(target error) bool {
+	for _, p := range e.Problems {
+		if errors.Is(p.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first problem error that matches target, see Is.
+func (e *MultiError) As(target interface{}) bool {
+	for _, p := range e.Problems {
+		if errors.As(p.Err, target) {
+			return true
+		}
+	}
+	return false
+}
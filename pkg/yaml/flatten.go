@@ -0,0 +1,152 @@
+package yaml
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Flatten returns the leaves of m keyed by their path, such as "a.b[2].c",
+// see ParsePath. Empty maps and lists have no leaves and are left out.
+func Flatten(m OutputMap) map[string]string {
+	flat := map[string]string{}
+	flattenValue(flat, "", m)
+	return flat
+}
+
+func flattenValue(flat map[string]string, path string, v interface{}) {
+	switch v := v.(type) {
+	case OutputMap:
+		for k, e := range v {
+			flattenValue(flat, joinPath(path, k), e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenValue(flat, indexPath(path, i), e)
+		}
+	default:
+		flat[path] = scalarString(v)
+	}
+}
+
+// scalarString formats a leaf value the way Resolve does.
+func scalarString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// Unflatten is the inverse of Flatten, it nests the values of flat according
+// to their paths. Keys are applied in sorted order: when a value and nested
+// keys share a path, the nested keys win. Keys that aren't valid paths are
+// kept as is, and list elements missing from flat are nil.
+func Unflatten(flat map[string]string) OutputMap {
+	keys := make([]string, 0, len(flat))
+	for k := range flat {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	root := OutputMap{}
+	for _, k := range keys {
+		path, err := ParsePath(k)
+		if err != nil || path[0].IsIndex {
+			root[k] = flat[k]
+			continue
+		}
+		var container interface{} = root
+		for i, elem := range path {
+			var child interface{}
+			if i == len(path)-1 {
+				switch getElement(container, elem).(type) {
+				case OutputMap, sparseList:
+					// nested keys win
+					continue
+				}
+				child = flat[k]
+			} else {
+				child = getElement(container, elem)
+				switch child.(type) {
+				case OutputMap:
+					if path[i+1].IsIndex {
+						child = sparseList{}
+					}
+				case sparseList:
+					if !path[i+1].IsIndex {
+						child = OutputMap{}
+					}
+				default:
+					if path[i+1].IsIndex {
+						child = sparseList{}
+					} else {
+						child = OutputMap{}
+					}
+				}
+			}
+			setElement(container, elem, child)
+			container = child
+		}
+	}
+	return denseLists(root).(OutputMap)
+}
+
+// sparseList is a list being built from paths, which can come in any order.
+type sparseList map[int]interface{}
+
+func getElement(container interface{}, elem PathElement) interface{} {
+	switch c := container.(type) {
+	case OutputMap:
+		return c[elem.Key]
+	case sparseList:
+		return c[elem.Index]
+	}
+	return nil
+}
+
+func setElement(container interface{}, elem PathElement, v interface{}) {
+	switch c := container.(type) {
+	case OutputMap:
+		c[elem.Key] = v
+	case sparseList:
+		c[elem.Index] = v
+	}
+}
+
+func denseLists(v interface{}) interface{} {
+	switch v := v.(type) {
+	case OutputMap:
+		for k, e := range v {
+			v[k] = denseLists(e)
+		}
+		return v
+	case sparseList:
+		size := 0
+		for i := range v {
+			if i+1 > size {
+				size = i + 1
+			}
+		}
+		l := make([]interface{}, size)
+		for i, e := range v {
+			l[i] = denseLists(e)
+		}
+		return l
+	default:
+		return v
+	}
+}
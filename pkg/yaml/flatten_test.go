@@ -0,0 +1,98 @@
+package yaml
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatten(t *testing.T) {
+	m := OutputMap{
+		"a": OutputMap{
+			"b": []interface{}{
+				"zero",
+				OutputMap{"c": "one"},
+				[]interface{}{"nested"},
+			},
+		},
+		"annotations": OutputMap{"example.com/team": "core"},
+		"x.y":         "dotted",
+		"port":        8080,
+	}
+	flat := Flatten(m)
+	assert.Equal(t, map[string]string{
+		"a.b[0]":                        "zero",
+		"a.b[1].c":                      "one",
+		"a.b[2][0]":                     "nested",
+		"annotations[example.com/team]": "core",
+		"[x.y]":                         "dotted",
+		"port":                          "8080",
+	}, flat)
+
+	m["port"] = "8080"
+	assert.Equal(t, m, Unflatten(flat))
+}
+
+func TestUnflatten(t *testing.T) {
+	cases := []struct {
+		name     string
+		flat     map[string]string
+		expected OutputMap
+	}{
+		{
+			name:     "nested keys win over values",
+			flat:     map[string]string{"a": "1", "a.b": "2"},
+			expected: OutputMap{"a": OutputMap{"b": "2"}},
+		},
+		{
+			name:     "missing list elements",
+			flat:     map[string]string{"a[2]": "2", "a[0]": "0"},
+			expected: OutputMap{"a": []interface{}{"0", nil, "2"}},
+		},
+		{
+			name:     "invalid paths are kept",
+			flat:     map[string]string{"a..b": "1", "[0]": "2", "a[b": "3"},
+			expected: OutputMap{"a..b": "1", "[0]": "2", "a[b": "3"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, Unflatten(c.flat))
+		})
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	path, err := ParsePath("a.b[2].c[x.y][0]")
+	assert.NoError(t, err)
+	assert.Equal(t, []PathElement{
+		{Key: "a"}, {Key: "b"}, {Index: 2, IsIndex: true}, {Key: "c"}, {Key: "x.y"}, {Index: 0, IsIndex: true},
+	}, path)
+	assert.Equal(t, "a.b[2].c[x.y][0]", formatPath(path))
+
+	for _, invalid := range []string{"", "a..b", "a.", ".a", "a[b", "a[99999999999999999999]"} {
+		_, err := ParsePath(invalid)
+		assert.True(t, errors.Is(err, ErrInvalidPath), invalid)
+	}
+
+	assert.Equal(t, "a", parentPath("a[x.y]"))
+	assert.Equal(t, "a[x.y]", parentPath("a[x.y].b"))
+	assert.Equal(t, "a.b", parentPath("a.b[0]"))
+}
+
+func TestPlaceholderPaths(t *testing.T) {
+	m, err := Resolve([]ObjectMap{{
+		"hosts":       []interface{}{"a", ObjectMap{"name": "b"}},
+		"annotations": ObjectMap{"example.com/team": "core"},
+		"first":       "${hosts[0]}",
+		"second":      "${hosts[1].name}",
+		"team":        "${annotations[example.com/team]}",
+		"missing":     "${hosts[2]:none}",
+	}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", m["first"])
+	assert.Equal(t, "b", m["second"])
+	assert.Equal(t, "core", m["team"])
+	assert.Equal(t, "none", m["missing"])
+}
@@ -0,0 +1,167 @@
+package yaml
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+)
+
+// PlaceholderFunc computes the value of a function placeholder from its
+// argument. Functions are called as ${name(arg)}, or as ${name} with an empty
+// argument when no configuration key or environment variable has that name.
+// ${name:value} always is the key name with a default value, as in Spring.
+// Placeholders in the argument are expanded before the call, as in
+// ${base64decode(${encoded.value})}.
+type PlaceholderFunc func(arg string) (string, error)
+
+var (
+	placeholderFuncsMu sync.RWMutex
+	// placeholderFuncs are available to every resolver. The "env" and "file"
+	// functions are added by each resolver since they depend on its
+	// environment and file system.
+	placeholderFuncs = map[string]PlaceholderFunc{
+		"random.uuid":  randomUUID,
+		"random.int":   randomInt,
+		"random.long":  randomLong,
+		"random.value": randomValue,
+		"base64":       encodeBase64,
+		"base64decode": decodeBase64,
+		"trim":         trim,
+	}
+)
+
+// RegisterPlaceholderFunc makes a placeholder function available to every
+// resolver, replacing any function with the same name. Configuration keys
+// take precedence over functions called without argument.
+func RegisterPlaceholderFunc(name string, fn PlaceholderFunc) {
+	placeholderFuncsMu.Lock()
+	defer placeholderFuncsMu.Unlock()
+	placeholderFuncs[name] = fn
+}
+
+// WithPlaceholderFunc registers a placeholder function on this resolver only,
+// it takes precedence over the functions registered with RegisterPlaceholderFunc.
+func WithPlaceholderFunc(name string, fn PlaceholderFunc) ResolverOption {
+	return func(r *Resolver) {
+		if r.funcs == nil {
+			r.funcs = map[string]PlaceholderFunc{}
+		}
+		r.funcs[name] = fn
+	}
+}
+
+// placeholderFuncs returns the functions available when resolving with env.
+func (r *Resolver) placeholderFuncs(env StringMap) map[string]PlaceholderFunc {
+	placeholderFuncsMu.RLock()
+	defer placeholderFuncsMu.RUnlock()
+	funcs := make(map[string]PlaceholderFunc, len(placeholderFuncs)+len(r.funcs)+2)
+	funcs["file"] = func(path string) (string, error) {
+		return readFile(r.fs, path)
+	}
+	for name, fn := range placeholderFuncs {
+		funcs[name] = fn
+	}
+	funcs["env"] = func(name string) (string, error) {
+		v, ok := env[name]
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+		return v, nil
+	}
+	for name, fn := range r.funcs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+func randomUUID(string) (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// randomInt returns a random int: any non-negative int32 without argument,
+// in [0, max) with "max" and in [min, max) with "min,max".
+func randomInt(arg string) (string, error) {
+	return randomBetween(arg, math.MaxInt32)
+}
+
+// randomLong is like randomInt with int64 bounds.
+func randomLong(arg string) (string, error) {
+	return randomBetween(arg, math.MaxInt64)
+}
+
+func randomBetween(arg string, max int64) (string, error) {
+	var min int64
+	if arg != "" {
+		bounds := strings.Split(arg, ",")
+		if len(bounds) > 2 {
+			return "", fmt.Errorf("expected (max) or (min,max), got (%s)", arg)
+		}
+		var err error
+		if max, err = strconv.ParseInt(strings.TrimSpace(bounds[len(bounds)-1]), 10, 64); err != nil {
+			return "", err
+		}
+		if len(bounds) == 2 {
+			if min, err = strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 64); err != nil {
+				return "", err
+			}
+		}
+		if max <= min {
+			return "", fmt.Errorf("empty range (%s)", arg)
+		}
+	}
+	n, err := rand.Int(rand.Reader, new(big.Int).Sub(big.NewInt(max), big.NewInt(min)))
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(min+n.Int64(), 10), nil
+}
+
+// randomValue returns 32 random hexadecimal characters.
+func randomValue(string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func readFile(fs afero.Fs, path string) (string, error) {
+	if path == "" {
+		return "", errors.New("missing file path")
+	}
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func encodeBase64(s string) (string, error) {
+	return base64.StdEncoding.EncodeToString([]byte(s)), nil
+}
+
+func decodeBase64(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func trim(s string) (string, error) {
+	return strings.TrimSpace(s), nil
+}
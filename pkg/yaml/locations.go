@@ -0,0 +1,92 @@
+package yaml
+
+import (
+	"fmt"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Location is where a value is defined in a configuration file.
+type Location struct {
+	File string
+	Line int
+}
+
+func (l Location) String() string {
+	if l.Line > 0 {
+		return fmt.Sprintf("%s:%d", l.File, l.Line)
+	}
+	return l.File
+}
+
+// Locations maps the dotted path of configuration values to where they are defined.
+type Locations map[string]Location
+
+// Locate parses a yaml document and returns the location of every value in it.
+func Locate(file string, data []byte) (Locations, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	locs := Locations{}
+	for _, n := range doc.Content {
+		locs.add(file, "", n)
+	}
+	return locs, nil
+}
+
+func (l Locations) add(file, path string, n *yamlv3.Node) {
+	if n.Kind == yamlv3.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	switch n.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			p := joinPath(path, key.Value)
+			l[p] = Location{File: file, Line: key.Line}
+			l.add(file, p, value)
+		}
+	case yamlv3.SequenceNode:
+		for i, item := range n.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			l[p] = Location{File: file, Line: item.Line}
+			l.add(file, p, item)
+		}
+	}
+}
+
+// Merge adds the locations of other, which take precedence, to l.
+func (l Locations) Merge(other Locations) {
+	for k, v := range other {
+		l[k] = v
+	}
+}
+
+// Find returns the location of path, or of its closest ancestor if path itself
+// isn't known, for instance because it is missing.
+func (l Locations) Find(path string) Location {
+	for {
+		if loc, ok := l[path]; ok {
+			return loc
+		}
+		if path == "" {
+			return Location{}
+		}
+		path = parentPath(path)
+	}
+}
+
+// parentPath strips the last key or index off a path.
+func parentPath(path string) string {
+	if strings.HasSuffix(path, "]") {
+		if i := strings.LastIndexByte(path, '['); i >= 0 {
+			return path[:i]
+		}
+	}
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
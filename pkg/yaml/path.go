@@ -0,0 +1,105 @@
+package yaml
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Paths address values of a configuration the same way placeholders do: keys
+// are separated by dots and list elements are selected with "[n]", as in
+// "services.echo.hosts[2].name". A key containing dots or brackets is written
+// between brackets, "annotations[example.com/team]".
+
+// PathElement is a map key or a list index of a path.
+type PathElement struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// ErrInvalidPath is wrapped by the errors of ParsePath.
+var ErrInvalidPath = errors.New("invalid path")
+
+// ParsePath splits a path into its keys and list indexes.
+func ParsePath(path string) ([]PathElement, error) {
+	var elems []PathElement
+	i := 0
+	for i < len(path) {
+		if path[i] == '[' {
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%w %q: unterminated [", ErrInvalidPath, path)
+			}
+			inner := path[i+1 : i+end]
+			if isIndex(inner) {
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("%w %q: %v", ErrInvalidPath, path, err)
+				}
+				elems = append(elems, PathElement{Index: n, IsIndex: true})
+			} else {
+				elems = append(elems, PathElement{Key: inner})
+			}
+			i += end + 1
+		} else {
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%w %q: empty key", ErrInvalidPath, path)
+			}
+			elems = append(elems, PathElement{Key: path[i : i+end]})
+			i += end
+		}
+		if i < len(path) && path[i] == '.' {
+			i++
+			if i == len(path) {
+				return nil, fmt.Errorf("%w %q: empty key", ErrInvalidPath, path)
+			}
+		}
+	}
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("%w: empty path", ErrInvalidPath)
+	}
+	return elems, nil
+}
+
+func isIndex(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// joinPath appends key to the path of its parent.
+func joinPath(path, key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]") {
+		return path + "[" + key + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// indexPath appends a list index to the path of its list.
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+func formatPath(path []PathElement) string {
+	s := ""
+	for _, elem := range path {
+		if elem.IsIndex {
+			s = indexPath(s, elem.Index)
+		} else {
+			s = joinPath(s, elem.Key)
+		}
+	}
+	return s
+}
@@ -0,0 +1,407 @@
+package yaml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/armory/go-yaml-tools/pkg/secrets"
+)
+
+// ErrPlaceholderCycle is returned when values reference each other through
+// placeholders, such as a: ${b} and b: ${a}.
+var ErrPlaceholderCycle = errors.New("placeholder cycle")
+
+// ErrKeyCollision is returned when a key expands to the same name as another
+// key of its map, see WithKeyExpansion.
+var ErrKeyCollision = errors.New("key collision")
+
+// substitution resolves the placeholders and secrets of a configuration.
+// Values are resolved on demand, so that a placeholder referencing another
+// value gets its resolved value whatever the order they are visited in.
+type substitution struct {
+	ctx   context.Context
+	r     *Resolver
+	root  OutputMap
+	env   StringMap
+	funcs map[string]PlaceholderFunc
+	done  map[string]bool
+	// paths of the secrets decrypted as a subtree
+	structured map[string]bool
+	// paths being resolved, a path appearing twice is a cycle
+	stack []string
+	// problems found when collecting errors
+	problems []Problem
+}
+
+// subValues resolves in place the placeholders and secrets of m.
+func (r *Resolver) subValues(ctx context.Context, m OutputMap, env StringMap) error {
+	s := &substitution{ctx: ctx, r: r, root: m, env: env, done: map[string]bool{}, structured: map[string]bool{}}
+	s.funcs = r.placeholderFuncs(env)
+	if r.expandKeys {
+		if err := s.expandKeys(m, nil); err != nil {
+			return err
+		}
+	}
+	if err := s.walk(m, nil); err != nil {
+		return err
+	}
+	if len(s.problems) > 0 {
+		return &MultiError{Problems: s.problems}
+	}
+	return nil
+}
+
+// fail reports the error of the value at path. When collecting errors, it is
+// recorded and nil is returned so that resolution carries on.
+func (s *substitution) fail(path string, err error) error {
+	if !s.r.collect {
+		return err
+	}
+	s.problems = append(s.problems, Problem{Path: path, Location: s.r.locations.Find(path), Err: err})
+	return nil
+}
+
+// current returns the path of the value being resolved.
+func (s *substitution) current() string {
+	if len(s.stack) == 0 {
+		return ""
+	}
+	return s.stack[len(s.stack)-1]
+}
+
+// expandKeys replaces the placeholders of the keys of the maps found in v,
+// parents first.
+func (s *substitution) expandKeys(v interface{}, path []PathElement) error {
+	switch v := v.(type) {
+	case OutputMap:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		renamed := map[string]string{}
+		for _, k := range keys {
+			if !strings.Contains(k, "${") {
+				continue
+			}
+			expanded, err := s.expand(k)
+			if err != nil {
+				return err
+			}
+			if expanded != k {
+				renamed[k] = expanded
+			}
+		}
+		// every final key must come from a single key
+		from := map[string]string{}
+		for _, k := range keys {
+			final := k
+			if r, ok := renamed[k]; ok {
+				final = r
+			}
+			if other, ok := from[final]; ok {
+				return fmt.Errorf("%w: %s and %s both expand to %s", ErrKeyCollision,
+					formatPath(appendElement(path, PathElement{Key: other})),
+					formatPath(appendElement(path, PathElement{Key: k})),
+					formatPath(appendElement(path, PathElement{Key: final})))
+			}
+			from[final] = k
+		}
+		for _, k := range keys {
+			if r, ok := renamed[k]; ok {
+				v[r] = v[k]
+				delete(v, k)
+				s.moveDone(formatPath(appendElement(path, PathElement{Key: k})), formatPath(appendElement(path, PathElement{Key: r})))
+			}
+		}
+		for k, e := range v {
+			if err := s.expandKeys(e, appendElement(path, PathElement{Key: k})); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if err := s.expandKeys(e, appendElement(path, PathElement{Index: i, IsIndex: true})); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// moveDone carries over the values already resolved under a renamed key, so
+// that they aren't expanded twice.
+func (s *substitution) moveDone(from, to string) {
+	for p := range s.done {
+		if p == from || strings.HasPrefix(p, from+".") || strings.HasPrefix(p, from+"[") {
+			delete(s.done, p)
+			s.done[to+p[len(from):]] = true
+		}
+	}
+}
+
+func (s *substitution) walk(v interface{}, path []PathElement) error {
+	switch v := v.(type) {
+	case OutputMap:
+		// sorted, so that errors don't depend on map ordering
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := s.walk(v[k], appendElement(path, PathElement{Key: k})); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			if err := s.walk(v[i], appendElement(path, PathElement{Index: i, IsIndex: true})); err != nil {
+				return err
+			}
+		}
+	case string:
+		_, err := s.resolveLeaf(path)
+		return err
+	}
+	return nil
+}
+
+func appendElement(path []PathElement, elem PathElement) []PathElement {
+	return append(path[:len(path):len(path)], elem)
+}
+
+// resolveLeaf resolves the string found at path, if it wasn't already.
+func (s *substitution) resolveLeaf(path []PathElement) (string, error) {
+	key := formatPath(path)
+	v, _ := getValue(s.root, path)
+	value, ok := v.(string)
+	if !ok || s.done[key] {
+		return value, nil
+	}
+	for i, p := range s.stack {
+		if p == key {
+			return "", fmt.Errorf("%w: %s", ErrPlaceholderCycle, strings.Join(append(s.stack[i:], key), " -> "))
+		}
+	}
+	s.stack = append(s.stack, key)
+	defer func() { s.stack = s.stack[:len(s.stack)-1] }()
+
+	raw := value
+	// secret references are expanded too, before the engine is picked
+	value, err := s.expand(value)
+	var resolved interface{} = value
+	if err == nil && secrets.IsEncryptedSecret(raw) {
+		resolved, err = s.r.decrypt(s.ctx, value, key)
+	}
+	s.done[key] = true
+	if err != nil {
+		// the failing value is left as is
+		return raw, s.fail(key, err)
+	}
+	setValue(s.root, path, resolved)
+	if value, ok := resolved.(string); ok {
+		return value, nil
+	}
+	// structured secrets replace the reference with their subtree, which is
+	// left as is
+	s.structured[key] = true
+	s.markDone(resolved, path)
+	return secrets.FormatValue(resolved)
+}
+
+// markDone marks the values of a decrypted subtree as resolved.
+func (s *substitution) markDone(v interface{}, path []PathElement) {
+	switch v := v.(type) {
+	case OutputMap:
+		for k, e := range v {
+			s.markDone(e, appendElement(path, PathElement{Key: k}))
+		}
+	case []interface{}:
+		for i, e := range v {
+			s.markDone(e, appendElement(path, PathElement{Index: i, IsIndex: true}))
+		}
+	default:
+		s.done[formatPath(path)] = true
+	}
+}
+
+// expand replaces the placeholders of value.
+func (s *substitution) expand(value string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			break
+		}
+		end := closingBrace(value, start+2)
+		if end < 0 {
+			break
+		}
+		b.WriteString(value[:start])
+		sub, err := s.evaluate(value[start+2 : end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(sub)
+		value = value[end+1:]
+	}
+	b.WriteString(value)
+	return b.String(), nil
+}
+
+// closingBrace returns the index of the brace closing a placeholder starting
+// before from, skipping nested placeholders, or -1.
+func closingBrace(s string, from int) int {
+	depth := 0
+	for i := from; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "${"):
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// splitDefault splits "key:default" on the first colon outside of nested placeholders.
+func splitDefault(expr string) (string, string, bool) {
+	// colons in nested placeholders and function arguments aren't defaults
+	depth, parens := 0, 0
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case strings.HasPrefix(expr[i:], "${"):
+			depth++
+			i++
+		case expr[i] == '}':
+			depth--
+		case expr[i] == '(' && depth == 0:
+			parens++
+		case expr[i] == ')' && depth == 0 && parens > 0:
+			parens--
+		case expr[i] == ':' && depth == 0 && parens == 0:
+			return expr[:i], expr[i+1:], true
+		}
+	}
+	return expr, "", false
+}
+
+// evaluate returns the value of the placeholder ${expr}: a function call such
+// as "random.int(1,10)" or "base64(value)", or a key looked up in the
+// configuration then in the environment, falling back to the default after the
+// colon. Without a default, the key can also be a function without argument,
+// such as "random.uuid", and an unresolved placeholder evaluates to its key.
+func (s *substitution) evaluate(expr string) (string, error) {
+	key, def, hasDefault := splitDefault(expr)
+	key, err := s.expand(key)
+	if err != nil {
+		return "", err
+	}
+
+	if open := strings.IndexByte(key, '('); open > 0 && strings.HasSuffix(key, ")") {
+		if fn, ok := s.funcs[key[:open]]; ok {
+			return s.call(key[:open], fn, key[open+1:len(key)-1])
+		}
+	}
+
+	if v, ok, err := s.lookup(key); err != nil || ok {
+		return v, err
+	}
+	if v, ok := s.env[key]; ok {
+		return v, nil
+	}
+	if hasDefault {
+		return s.expand(def)
+	}
+	if fn, ok := s.funcs[key]; ok {
+		return s.call(key, fn, "")
+	}
+	if s.r.collect {
+		s.problems = append(s.problems, Problem{
+			Path:     s.current(),
+			Location: s.r.locations.Find(s.current()),
+			Err:      fmt.Errorf("%w ${%s}", ErrUnresolvedPlaceholder, expr),
+		})
+	}
+	return key, nil
+}
+
+func (s *substitution) call(name string, fn PlaceholderFunc, arg string) (string, error) {
+	v, err := fn(arg)
+	if err != nil {
+		return "", fmt.Errorf("placeholder function %s: %w", name, err)
+	}
+	return v, nil
+}
+
+// lookup returns the resolved value of key in the configuration.
+func (s *substitution) lookup(key string) (string, bool, error) {
+	path, err := ParsePath(key)
+	if err != nil {
+		return "", false, nil
+	}
+	if v, ok := getValue(s.root, path); ok {
+		if _, isString := v.(string); isString {
+			if _, err := s.resolveLeaf(path); err != nil {
+				return "", false, err
+			}
+		}
+	}
+	if s.structured[formatPath(path)] {
+		// a structured secret embedded in a string is rendered as JSON
+		v, _ := getValue(s.root, path)
+		rendered, err := secrets.FormatValue(v)
+		return rendered, err == nil, err
+	}
+	v, err := valueFromFlatKey(key, s.root)
+	if err != nil {
+		return "", false, nil
+	}
+	return v, true, nil
+}
+
+// getValue returns the value at path.
+func getValue(root OutputMap, path []PathElement) (interface{}, bool) {
+	var curr interface{} = root
+	for _, elem := range path {
+		switch c := curr.(type) {
+		case OutputMap:
+			v, ok := c[elem.Key]
+			if !ok || elem.IsIndex {
+				return nil, false
+			}
+			curr = v
+		case []interface{}:
+			if !elem.IsIndex || elem.Index >= len(c) {
+				return nil, false
+			}
+			curr = c[elem.Index]
+		default:
+			return nil, false
+		}
+	}
+	return curr, true
+}
+
+// setValue replaces the existing value at path.
+func setValue(root OutputMap, path []PathElement, v interface{}) {
+	parent, ok := getValue(root, path[:len(path)-1])
+	if !ok {
+		return
+	}
+	last := path[len(path)-1]
+	switch p := parent.(type) {
+	case OutputMap:
+		p[last.Key] = v
+	case []interface{}:
+		p[last.Index] = v
+	}
+}
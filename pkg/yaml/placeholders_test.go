@@ -0,0 +1,297 @@
+package yaml
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/armory/go-yaml-tools/pkg/secrets"
+)
+
+func TestPlaceholderFuncs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(file, []byte("  t0k3n\n"), 0600))
+
+	m, err := Resolve([]ObjectMap{{
+		"dir":      filepath.Dir(file),
+		"token":    "${trim(${file(${dir}/token)})}",
+		"encoded":  "${base64(hello)}",
+		"decoded":  "${base64decode(${encoded})}",
+		"home":     "${env(HOME)}",
+		"id":       "${random.uuid}",
+		"port":     "${random.int(1000,1002)}",
+		"value":    "${random.value}",
+		"fallback": "${missing:${env(HOME)}}",
+	}}, StringMap{"HOME": "/home/spinnaker"})
+	assert.NoError(t, err)
+	assert.Equal(t, "t0k3n", m["token"])
+	assert.Equal(t, "aGVsbG8=", m["encoded"])
+	assert.Equal(t, "hello", m["decoded"])
+	assert.Equal(t, "/home/spinnaker", m["home"])
+	assert.Equal(t, "/home/spinnaker", m["fallback"])
+	assert.Len(t, m["id"], 36)
+	assert.Len(t, m["value"], 32)
+	port, err := strconv.Atoi(m["port"].(string))
+	assert.NoError(t, err)
+	assert.True(t, port == 1000 || port == 1001, port)
+}
+
+func TestPlaceholderFileFs(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(mfs, "/secrets/token", []byte("in-memory"), 0600))
+
+	m, err := NewResolver(WithFs(mfs)).Resolve([]ObjectMap{{"token": "${file(/secrets/token)}"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "in-memory", m["token"])
+
+	// the host disk isn't read
+	_, err = NewResolver(WithFs(mfs)).Resolve([]ObjectMap{{"hosts": "${file(/etc/hosts)}"}}, nil)
+	assert.Error(t, err)
+}
+
+func TestPlaceholderFuncErrors(t *testing.T) {
+	for _, value := range []string{"${env(MISSING)}", "${file(/does/not/exist)}", "${base64decode(%%%)}", "${random.int(5,1)}"} {
+		_, err := Resolve([]ObjectMap{{"a": value}}, nil)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPlaceholderKeysNamedLikeFuncs(t *testing.T) {
+	// a bare ${name} reads the configuration or the environment before calling
+	// the function of the same name
+	m, err := Resolve([]ObjectMap{{
+		"env":     "prod",
+		"file":    "gate.yml",
+		"name":    "svc-${env}",
+		"config":  "/etc/${file}",
+		"home":    "${env(HOME)}",
+		"trimmed": "${trim}",
+	}}, StringMap{"HOME": "/home/spinnaker", "trim": "from-env"})
+	assert.NoError(t, err)
+	assert.Equal(t, "svc-prod", m["name"])
+	assert.Equal(t, "/etc/gate.yml", m["config"])
+	assert.Equal(t, "/home/spinnaker", m["home"])
+	assert.Equal(t, "from-env", m["trimmed"])
+}
+
+func TestPlaceholderDefaultsNamedLikeFuncs(t *testing.T) {
+	// ${key:default} is never a function call, whatever the key
+	m, err := Resolve([]ObjectMap{{
+		"a":    "${env:dev}",
+		"b":    "${file:gate.yml}",
+		"c":    "${trim: x }",
+		"d":    "${base64:plain}",
+		"time": "${random.int:now}",
+	}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, OutputMap{"a": "dev", "b": "gate.yml", "c": " x ", "d": "plain", "time": "now"}, m)
+
+	m, err = Resolve([]ObjectMap{{"env": "prod", "a": "${env:dev}"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "prod", m["a"])
+
+	m, err = Resolve([]ObjectMap{{"a": "${env:dev}"}}, StringMap{"env": "staging"})
+	assert.NoError(t, err)
+	assert.Equal(t, "staging", m["a"])
+}
+
+func TestRegisterPlaceholderFunc(t *testing.T) {
+	upper := func(arg string) (string, error) { return strings.ToUpper(arg), nil }
+	RegisterPlaceholderFunc("test.upper", upper)
+	defer func() {
+		placeholderFuncsMu.Lock()
+		delete(placeholderFuncs, "test.upper")
+		placeholderFuncsMu.Unlock()
+	}()
+
+	r := NewResolver(WithPlaceholderFunc("test.lower", func(arg string) (string, error) {
+		return strings.ToLower(arg), nil
+	}))
+	m, err := r.Resolve([]ObjectMap{{"name": "Gate", "a": "${test.upper(${name})}", "b": "${test.lower(${name})}"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "GATE", m["a"])
+	assert.Equal(t, "gate", m["b"])
+
+	// only registered on r
+	m, err = Resolve([]ObjectMap{{"b": "${test.lower:x}"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "x", m["b"])
+}
+
+func TestPlaceholderOrder(t *testing.T) {
+	// values are resolved on demand whatever the order they are visited in
+	m, err := Resolve([]ObjectMap{{
+		"a":        "${b}",
+		"b":        "${c}",
+		"c":        "${z.password}",
+		"z":        ObjectMap{"password": "encrypted:noop!s3cr3t"},
+		"url":      "http://${host}:${port}",
+		"host":     "localhost",
+		"port":     8080,
+		"unknown":  "${not.there}",
+		"defaults": "${not.there:${host}}",
+	}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", m["a"])
+	assert.Equal(t, "http://localhost:8080", m["url"])
+	assert.Equal(t, "not.there", m["unknown"])
+	assert.Equal(t, "localhost", m["defaults"])
+}
+
+func TestPlaceholderCycle(t *testing.T) {
+	_, err := Resolve([]ObjectMap{{"a": "${b}", "b": "x-${c}", "c": "${a}"}}, nil)
+	assert.True(t, errors.Is(err, ErrPlaceholderCycle), "error was %v", err)
+	assert.EqualError(t, err, "placeholder cycle: a -> b -> c -> a")
+
+	_, err = Resolve([]ObjectMap{{"a": "${a:default}"}}, nil)
+	assert.True(t, errors.Is(err, ErrPlaceholderCycle), "error was %v", err)
+}
+
+func TestSecretReferencePlaceholders(t *testing.T) {
+	var params []string
+	engines := secrets.NewRegistry()
+	engines.Register("s3", func(ctx context.Context, isFile bool, p string) (secrets.Decrypter, error) {
+		params = append(params, p)
+		return secrets.NewNoopDecrypter(ctx, isFile, "creds")
+	})
+	m, err := NewResolver(WithSecretEngines(engines)).Resolve([]ObjectMap{{
+		"aws":    ObjectMap{"region": "${REGION:us-east-1}"},
+		"bucket": "my-bucket",
+		"creds":  "encrypted:${engine}!r:${aws.region}!b:${bucket}!f:creds.yml",
+		"engine": "s3",
+	}}, StringMap{"REGION": "eu-west-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "creds", m["creds"])
+	assert.Equal(t, []string{"r:eu-west-1!b:my-bucket!f:creds.yml"}, params)
+}
+
+func TestKeyExpansion(t *testing.T) {
+	templates := func() []ObjectMap {
+		return []ObjectMap{{
+			"env": ObjectMap{"region": "us-west-2"},
+			"buckets": ObjectMap{
+				"${env.region}-bucket": ObjectMap{"name": "${env.region}-data"},
+				"shared":               "yes",
+			},
+			"${missing:fallback}": "value",
+		}}
+	}
+	// keys are left alone by default
+	m, err := Resolve(templates(), nil)
+	assert.NoError(t, err)
+	assert.Contains(t, m["buckets"], "${env.region}-bucket")
+
+	m, err = NewResolver(WithKeyExpansion()).Resolve(templates(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, OutputMap{
+		"us-west-2-bucket": OutputMap{"name": "us-west-2-data"},
+		"shared":           "yes",
+	}, m["buckets"])
+	assert.Equal(t, "value", m["fallback"])
+
+	_, err = NewResolver(WithKeyExpansion()).Resolve([]ObjectMap{{
+		"region": "a",
+		"x":      ObjectMap{"${region}": "1", "a": "2"},
+	}}, nil)
+	assert.True(t, errors.Is(err, ErrKeyCollision), "error was %v", err)
+	assert.EqualError(t, err, "key collision: x.${region} and x.a both expand to x.a")
+}
+
+func TestCollectErrors(t *testing.T) {
+	templates := []ObjectMap{{
+		"a":      "${b}",
+		"b":      "${a}",
+		"secret": "encrypted:unknown!x",
+		"file":   "${file(/does/not/exist)}",
+		"host":   "${not.there}",
+		"ok":     "${host:x}",
+	}}
+	locs := Locations{"secret": {File: "gate.yml", Line: 3}}
+	_, err := NewResolver(WithCollectErrors(locs)).Resolve(templates, nil)
+	var multi *MultiError
+	if !assert.True(t, errors.As(err, &multi), "error was %v", err) {
+		return
+	}
+	var paths []string
+	for _, p := range multi.Problems {
+		paths = append(paths, p.Path)
+	}
+	assert.Equal(t, []string{"b", "file", "host", "secret"}, paths)
+	assert.True(t, errors.Is(err, ErrPlaceholderCycle))
+	assert.True(t, errors.Is(err, ErrUnresolvedPlaceholder))
+	assert.Equal(t, "gate.yml:3", multi.Problems[3].Location.String())
+
+	// Is and As don't depend on Unwrap() []error, which Go 1.19 ignores
+	assert.True(t, multi.Is(ErrUnresolvedPlaceholder))
+	assert.False(t, multi.Is(ErrKeyCollision))
+	var pathErr *os.PathError
+	if assert.True(t, multi.As(&pathErr)) {
+		assert.Equal(t, "/does/not/exist", pathErr.Path)
+	}
+}
+
+// structuredDecrypter decrypts to a fixed structured value.
+type structuredDecrypter struct {
+	value interface{}
+}
+
+func (d structuredDecrypter) Decrypt() (string, error) {
+	return secrets.FormatValue(d.value)
+}
+
+func (d structuredDecrypter) DecryptValue(ctx context.Context) (interface{}, error) {
+	return d.value, nil
+}
+
+func (d structuredDecrypter) IsFile() bool {
+	return false
+}
+
+func TestStructuredSecrets(t *testing.T) {
+	engines := secrets.NewRegistry()
+	engines.Register("json", func(ctx context.Context, isFile bool, p string) (secrets.Decrypter, error) {
+		switch p {
+		case "k:db":
+			return structuredDecrypter{map[string]interface{}{
+				"username": "admin",
+				"password": "${not.expanded}",
+				"port":     json.Number("5432"),
+				"hosts":    []interface{}{"db1", "db2"},
+			}}, nil
+		case "k:port":
+			return structuredDecrypter{json.Number("5432")}, nil
+		}
+		return structuredDecrypter{true}, nil
+	})
+	tracker := NewSecretTracker()
+	m, err := NewResolver(WithSecretEngines(engines), WithSecretTracker(tracker)).Resolve([]ObjectMap{{
+		"db":      "encrypted:json!k:db",
+		"port":    "encrypted:json!k:port",
+		"enabled": "encrypted:json!k:enabled",
+		"user":    "${db.username}",
+		"json":    "db=${db}",
+	}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, OutputMap{
+		"username": "admin",
+		"password": "${not.expanded}",
+		"port":     "5432",
+		"hosts":    []interface{}{"db1", "db2"},
+	}, m["db"])
+	assert.Equal(t, "5432", m["port"])
+	assert.Equal(t, "true", m["enabled"])
+	assert.Equal(t, "admin", m["user"])
+	assert.Equal(t, `db={"hosts":["db1","db2"],"password":"${not.expanded}","port":"5432","username":"admin"}`, m["json"])
+
+	redacted := tracker.Redact(m)
+	assert.Equal(t, Redacted, redacted["db"])
+	assert.Equal(t, Redacted, redacted["user"])
+}
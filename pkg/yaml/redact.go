@@ -0,0 +1,116 @@
+package yaml
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secret values in redacted output.
+const Redacted = "<redacted>"
+
+// minRedactedLength is the length under which secrets are only redacted where
+// they were decrypted, replacing them everywhere would mangle unrelated values.
+const minRedactedLength = 4
+
+// SecretTracker records the secrets decrypted by a resolver so that they can be
+// redacted from its output, see WithSecretTracker. It is safe for concurrent use.
+type SecretTracker struct {
+	mu      sync.Mutex
+	paths   map[string]bool
+	secrets map[string]bool
+}
+
+func NewSecretTracker() *SecretTracker {
+	return &SecretTracker{paths: map[string]bool{}, secrets: map[string]bool{}}
+}
+
+func (t *SecretTracker) record(path, secret string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paths[path] = true
+	if secret != "" {
+		t.secrets[secret] = true
+	}
+}
+
+// recordTree records a decrypted secret, the leaves of structured ones being
+// redacted wherever they appear.
+func (t *SecretTracker) recordTree(path string, secret interface{}) {
+	switch v := secret.(type) {
+	case OutputMap:
+		t.record(path, "")
+		for _, e := range v {
+			t.recordTree(path, e)
+		}
+	case []interface{}:
+		t.record(path, "")
+		for _, e := range v {
+			t.recordTree(path, e)
+		}
+	case string:
+		t.record(path, v)
+	}
+}
+
+// Paths returns the sorted dotted paths of the values that were decrypted.
+func (t *SecretTracker) Paths() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	paths := make([]string, 0, len(t.paths))
+	for p := range t.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Redact returns a copy of m where decrypted values are replaced with Redacted.
+// Secrets copied elsewhere through placeholders, such as a password embedded in
+// a url, are replaced wherever they appear.
+func (t *SecretTracker) Redact(m OutputMap) OutputMap {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var secrets []string
+	for s := range t.secrets {
+		if len(s) >= minRedactedLength {
+			secrets = append(secrets, s)
+		}
+	}
+	// longest first, so that a secret containing another one is replaced whole
+	sort.Slice(secrets, func(i, j int) bool {
+		if len(secrets[i]) != len(secrets[j]) {
+			return len(secrets[i]) > len(secrets[j])
+		}
+		return secrets[i] < secrets[j]
+	})
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, s := range secrets {
+		pairs = append(pairs, s, Redacted)
+	}
+	return t.redactValue(m, "", strings.NewReplacer(pairs...)).(OutputMap)
+}
+
+func (t *SecretTracker) redactValue(v interface{}, path string, replacer *strings.Replacer) interface{} {
+	if t.paths[path] && path != "" {
+		return Redacted
+	}
+	switch v := v.(type) {
+	case OutputMap:
+		m := make(OutputMap, len(v))
+		for k, e := range v {
+			m[k] = t.redactValue(e, joinPath(path, k), replacer)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = t.redactValue(e, indexPath(path, i), replacer)
+		}
+		return l
+	case string:
+		return replacer.Replace(v)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,259 @@
+package yaml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema is a compiled JSON Schema used to validate resolved configurations.
+// Schemas that don't declare "$schema" are treated as draft 2020-12.
+type Schema struct {
+	schema *jsonschema.Schema
+}
+
+const schemaURL = "config.schema.json"
+
+// CompileSchema compiles a JSON Schema document.
+func CompileSchema(schema []byte) (*Schema, error) {
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	if err := c.AddResource(schemaURL, bytes.NewReader(schema)); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	s, err := c.Compile(schemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return &Schema{schema: s}, nil
+}
+
+// SchemaViolation is a value of the configuration that doesn't satisfy the schema.
+type SchemaViolation struct {
+	// Path is the dotted path of the offending value, empty for the root.
+	Path    string
+	Message string
+	// Location is where the value was defined, zero if unknown.
+	Location Location
+}
+
+func (v SchemaViolation) String() string {
+	path := v.Path
+	if path == "" {
+		path = "(root)"
+	}
+	if v.Location.File != "" {
+		return fmt.Sprintf("%s: %s (%s)", path, v.Message, v.Location)
+	}
+	return fmt.Sprintf("%s: %s", path, v.Message)
+}
+
+// SchemaError lists every violation found when validating a configuration.
+type SchemaError struct {
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	lines := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		lines = append(lines, v.String())
+	}
+	return fmt.Sprintf("configuration doesn't match schema:\n  %s", strings.Join(lines, "\n  "))
+}
+
+// Validate validates a resolved configuration against the schema and returns
+// a *SchemaError listing every violation. locations, which can be nil, is used
+// to report where offending values were defined.
+//
+// Resolve turns every scalar into a string, so before validating, scalars are
+// typed back the way YAML would type them: "8080" is validated as an integer
+// and "true" as a boolean. Where the schema expects a string, such values are
+// validated as the strings they were, so that zip: "01234" is a valid string.
+func (s *Schema) Validate(m OutputMap, locations Locations) error {
+	instance := typedValue(m)
+	err := s.schema.Validate(instance)
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err
+	}
+	for untypeStrings(instance, m, ve) {
+		if err = s.schema.Validate(instance); err == nil {
+			return nil
+		}
+		if ve, ok = err.(*jsonschema.ValidationError); !ok {
+			return err
+		}
+	}
+
+	var violations []SchemaViolation
+	for _, leaf := range leafErrors(ve) {
+		path := pointerToPath(instance, leaf.InstanceLocation)
+		if strings.HasSuffix(leaf.KeywordLocation, "/additionalProperties") {
+			// report the unexpected keys themselves, that's where the typo is
+			for _, name := range quotedNames.FindAllStringSubmatch(leaf.Message, -1) {
+				p := joinPath(path, name[1])
+				violations = append(violations, SchemaViolation{Path: p, Message: "property not allowed", Location: locations.Find(p)})
+			}
+			continue
+		}
+		violations = append(violations, SchemaViolation{Path: path, Message: leaf.Message, Location: locations.Find(path)})
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Path < violations[j].Path
+	})
+	return &SchemaError{Violations: violations}
+}
+
+// untypeStrings puts back the original strings of the typed values that
+// failed validation because the schema expects strings, and tells whether it
+// changed anything.
+func untypeStrings(instance interface{}, original OutputMap, ve *jsonschema.ValidationError) bool {
+	changed := false
+	for _, leaf := range leafErrors(ve) {
+		if strings.HasSuffix(leaf.KeywordLocation, "/type") && expectsString(leaf.Message) &&
+			restoreString(instance, original, leaf.InstanceLocation) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// expectsString tells whether a type error message lists string among the
+// expected types, as in "expected string or null, but got number".
+func expectsString(msg string) bool {
+	expected := strings.TrimPrefix(strings.SplitN(msg, ", but got", 2)[0], "expected ")
+	for _, t := range strings.Split(expected, " or ") {
+		if t == "string" {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreString replaces the value at a JSON pointer of instance with the
+// string at the same pointer of original, unless there's nothing to restore.
+func restoreString(instance, original interface{}, pointer string) bool {
+	if pointer == "" {
+		return false
+	}
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		last := i == len(tokens)-1
+		switch c := instance.(type) {
+		case map[string]interface{}:
+			o, ok := original.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			if last {
+				return restore(c[token], o[token], func(v interface{}) { c[token] = v })
+			}
+			instance, original = c[token], o[token]
+		case []interface{}:
+			o, ok := original.([]interface{})
+			j, err := strconv.Atoi(token)
+			if !ok || err != nil || j >= len(c) || j >= len(o) {
+				return false
+			}
+			if last {
+				return restore(c[j], o[j], func(v interface{}) { c[j] = v })
+			}
+			instance, original = c[j], o[j]
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// restore sets the original string of a typed value.
+func restore(typed, original interface{}, set func(interface{})) bool {
+	s, ok := original.(string)
+	if _, isString := typed.(string); !ok || isString {
+		return false
+	}
+	set(s)
+	return true
+}
+
+var quotedNames = regexp.MustCompile(`'((?:[^'\\]|\\.)*)'`)
+
+func leafErrors(ve *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(ve.Causes) == 0 {
+		return []*jsonschema.ValidationError{ve}
+	}
+	var leaves []*jsonschema.ValidationError
+	for _, c := range ve.Causes {
+		leaves = append(leaves, leafErrors(c)...)
+	}
+	return leaves
+}
+
+// pointerToPath converts a JSON pointer into the dotted path used by placeholders.
+func pointerToPath(instance interface{}, pointer string) string {
+	path := ""
+	if pointer == "" {
+		return path
+	}
+	curr := instance
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch c := curr.(type) {
+		case []interface{}:
+			path = fmt.Sprintf("%s[%s]", path, token)
+			if i, err := strconv.Atoi(token); err == nil && i < len(c) {
+				curr = c[i]
+			}
+		case map[string]interface{}:
+			path = joinPath(path, token)
+			curr = c[token]
+		default:
+			path = joinPath(path, token)
+		}
+	}
+	return path
+}
+
+// typedValue copies a resolved value, typing string scalars as YAML would.
+func typedValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = typedValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = typedValue(e)
+		}
+		return l
+	case string:
+		switch v {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return json.Number(v)
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil && !strings.ContainsAny(v, "xXnN") {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		return v
+	default:
+		return v
+	}
+}
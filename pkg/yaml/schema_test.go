@@ -0,0 +1,134 @@
+package yaml
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "services": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "echo": {
+          "type": "object",
+          "required": ["host"],
+          "properties": {
+            "host": {"type": "string"},
+            "port": {"type": "integer", "maximum": 65535},
+            "enabled": {"type": "boolean"}
+          }
+        }
+      }
+    },
+    "tags": {"type": "array", "items": {"type": "integer"}}
+  }
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	s, err := CompileSchema([]byte(testSchema))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	valid := OutputMap{
+		"services": OutputMap{
+			"echo": OutputMap{"host": "localhost", "port": "8089", "enabled": "true"},
+		},
+		"tags": []interface{}{"1", "2"},
+	}
+	assert.NoError(t, s.Validate(valid, nil))
+
+	invalid := OutputMap{
+		"servcies": OutputMap{},
+		"services": OutputMap{
+			"echo": OutputMap{"port": "99999"},
+		},
+		"tags": []interface{}{"1", "two"},
+	}
+	locs := Locations{
+		"servcies":           {File: "/config/gate.yml", Line: 1},
+		"services":           {File: "/config/gate.yml", Line: 2},
+		"services.echo":      {File: "/config/gate.yml", Line: 3},
+		"services.echo.port": {File: "/config/gate-local.yml", Line: 7},
+	}
+	err = s.Validate(invalid, locs)
+	var schemaErr *SchemaError
+	if !assert.True(t, errors.As(err, &schemaErr)) {
+		return
+	}
+	if !assert.Len(t, schemaErr.Violations, 4) {
+		return
+	}
+	assert.Equal(t, SchemaViolation{Path: "servcies", Message: "property not allowed", Location: Location{File: "/config/gate.yml", Line: 1}}, schemaErr.Violations[0])
+	assert.Equal(t, "services.echo", schemaErr.Violations[1].Path)
+	assert.Contains(t, schemaErr.Violations[1].Message, "missing properties")
+	assert.Equal(t, "services.echo.port", schemaErr.Violations[2].Path)
+	assert.Equal(t, Location{File: "/config/gate-local.yml", Line: 7}, schemaErr.Violations[2].Location)
+	assert.Equal(t, "tags[1]", schemaErr.Violations[3].Path)
+	assert.Equal(t, Location{}, schemaErr.Violations[3].Location)
+	assert.Contains(t, err.Error(), "services.echo.port: must be <= 65535 but found 99999 (/config/gate-local.yml:7)")
+}
+
+func TestSchemaValidateQuotedStrings(t *testing.T) {
+	s, err := CompileSchema([]byte(`{
+  "type": "object",
+  "properties": {
+    "zip": {"type": "string"},
+    "version": {"type": "string"},
+    "flag": {"type": "string"},
+    "codes": {"type": "array", "items": {"type": "string"}},
+    "label": {"anyOf": [{"type": "string", "pattern": "^0"}, {"type": "integer", "maximum": 10}]},
+    "port": {"type": "integer"}
+  }
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// quoted in the file, these are strings even though they look typed
+	assert.NoError(t, s.Validate(OutputMap{
+		"zip":     "01234",
+		"version": "1.10",
+		"flag":    "true",
+		"codes":   []interface{}{"12", "abc"},
+		"label":   "0777",
+		"port":    "8080",
+	}, nil))
+
+	err = s.Validate(OutputMap{"label": "999", "port": "80a"}, nil)
+	var schemaErr *SchemaError
+	if assert.True(t, errors.As(err, &schemaErr)) {
+		assert.Contains(t, err.Error(), "label")
+		assert.Contains(t, err.Error(), "port")
+	}
+}
+
+func TestCompileSchemaError(t *testing.T) {
+	_, err := CompileSchema([]byte(`{"type": 12}`))
+	assert.Error(t, err)
+}
+
+func TestLocate(t *testing.T) {
+	locs, err := Locate("gate.yml", []byte(`
+services:
+  echo:
+    port: 8089
+list:
+  - a
+  - b: c
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, Location{File: "gate.yml", Line: 4}, locs["services.echo.port"])
+	assert.Equal(t, Location{File: "gate.yml", Line: 7}, locs["list[1]"])
+	assert.Equal(t, Location{File: "gate.yml", Line: 7}, locs["list[1].b"])
+	assert.Equal(t, Location{File: "gate.yml", Line: 3}, locs.Find("services.echo.missing"))
+	assert.Equal(t, Location{}, locs.Find("missing"))
+}
@@ -4,14 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"regexp"
 	"strconv"
-	"strings"
 
+	"github.com/armory/go-yaml-tools/pkg/logging"
 	"github.com/armory/go-yaml-tools/pkg/secrets"
 
 	"dario.cat/mergo"
-	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
 )
 
 type ObjectMap = map[interface{}]interface{}
@@ -22,29 +21,160 @@ type OutputMap = map[string]interface{}
 // properties.  The order of `ymlTemplates` matters, it should go from lowest
 // to highest precendence.
 func Resolve(ymlTemplates []ObjectMap, envKeyPairs StringMap) (OutputMap, error) {
-	log.Debugf("Using environ %+v\n", envKeyPairs)
+	m, err := NewResolver(WithSecretEngines(secrets.Engines)).Resolve(ymlTemplates, envKeyPairs)
+	if err == nil {
+		secrets.Engines.ReleaseReplaced()
+	}
+	return m, err
+}
+
+// Resolver merges yaml maps and substitutes placeholders and secrets in them.
+// Use NewResolver to create one.
+type Resolver struct {
+	engines *secrets.Registry
+	// ownEngines is set when engines is the resolver's own copy of
+	// secrets.Engines, to release on Close
+	ownEngines bool
+	logger     logging.Logger
+	fs         afero.Fs
+	onDecrypt  func(keyPath string, d secrets.Decrypter)
+	tracker    *SecretTracker
+	funcs      map[string]PlaceholderFunc
+	expandKeys bool
+	collect    bool
+	locations  Locations
+}
+
+// ResolverOption configures a Resolver.
+type ResolverOption func(*Resolver)
+
+// WithSecretEngines makes the resolver decrypt secrets with the engines of the
+// given registry instead of its own copy of secrets.Engines. The vault engine
+// is registered in that registry when the configuration contains a vault section,
+// the caller releasing the connection of the configuration it replaces with
+// the registry's ReleaseReplaced.
+func WithSecretEngines(engines *secrets.Registry) ResolverOption {
+	return func(r *Resolver) {
+		r.engines = engines
+	}
+}
+
+// WithLogger sets the logger used by the resolver and handed to secret engines,
+// logging.Default() by default.
+func WithLogger(logger logging.Logger) ResolverOption {
+	return func(r *Resolver) {
+		r.logger = logger
+	}
+}
+
+// WithFs sets the file system ${file(path)} placeholders read from, the OS file
+// system by default.
+func WithFs(fs afero.Fs) ResolverOption {
+	return func(r *Resolver) {
+		r.fs = fs
+	}
+}
+
+// WithDecryptHook registers a function called with the key path and the
+// decrypter of every secret successfully decrypted.
+func WithDecryptHook(fn func(keyPath string, d secrets.Decrypter)) ResolverOption {
+	return func(r *Resolver) {
+		r.onDecrypt = fn
+	}
+}
+
+// WithSecretTracker records the decrypted secrets in t, to redact them from the
+// resolved configuration with t.Redact or WithRedaction.
+func WithSecretTracker(t *SecretTracker) ResolverOption {
+	return func(r *Resolver) {
+		r.tracker = t
+	}
+}
+
+// WithKeyExpansion also replaces placeholders in map keys, so that a key such
+// as "${region}-bucket" can depend on the environment. Keys are expanded
+// before values. Resolving fails with ErrKeyCollision when two keys of a map
+// end up with the same name.
+func WithKeyExpansion() ResolverOption {
+	return func(r *Resolver) {
+		r.expandKeys = true
+	}
+}
+
+// WithCollectErrors makes Resolve carry on when a secret can't be decrypted or
+// a placeholder fails, and return a *MultiError listing every problem instead
+// of the first one. Placeholders that can't be resolved, which otherwise
+// evaluate to their key, are reported as ErrUnresolvedPlaceholder.
+// locations, which can be nil, is used to report where failing values are defined.
+func WithCollectErrors(locations Locations) ResolverOption {
+	return func(r *Resolver) {
+		r.collect = true
+		r.locations = locations
+	}
+}
+
+// NewResolver returns a resolver configured with opts. Unless given
+// WithSecretEngines, it decrypts secrets with a copy of secrets.Engines, so
+// that the vault configuration it finds isn't shared with other resolvers.
+func NewResolver(opts ...ResolverOption) *Resolver {
+	r := &Resolver{
+		logger: logging.Default(),
+		fs:     afero.NewOsFs(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.engines == nil {
+		r.engines = secrets.Engines.Clone()
+		r.ownEngines = true
+	}
+	return r
+}
+
+// Close releases the vault connection of the resolver's copy of
+// secrets.Engines, revoking its leases and token once no other registry uses
+// it. The registry given WithSecretEngines is left alone.
+func (r *Resolver) Close() {
+	if r.ownEngines {
+		r.engines.Close()
+	}
+}
+
+// Resolve behaves like the package level Resolve using the resolver's settings.
+func (r *Resolver) Resolve(ymlTemplates []ObjectMap, envKeyPairs StringMap) (OutputMap, error) {
+	return r.ResolveContext(context.Background(), ymlTemplates, envKeyPairs)
+}
+
+// ResolveContext is like Resolve, secrets being decrypted with ctx so that
+// their fetching can be cancelled or given a deadline.
+func (r *Resolver) ResolveContext(ctx context.Context, ymlTemplates []ObjectMap, envKeyPairs StringMap) (OutputMap, error) {
+	r.logger.Debug("resolving configuration", "environ", envKeyPairs)
 
 	mergedMap := ObjectMap{}
 	for _, yml := range ymlTemplates {
 		if err := mergo.Merge(&mergedMap, yml, mergo.WithOverride); err != nil {
-			log.Error(err)
+			r.logger.Error("unable to merge configuration", logging.ErrorKey, err)
 		}
 	}
 
 	// unlike other secret engines, the vault config needs to be registered before it can decrypt anything
 	vaultCfg, err := extractVaultConfig(mergedMap)
 	if err == nil {
-		if err := secrets.RegisterVaultConfig(*vaultCfg); err != nil {
-			log.Errorf("Error registering vault config: %v", err)
+		if err := secrets.RegisterVaultConfigIn(r.engines, *vaultCfg); err != nil {
+			r.logger.Error("error registering vault config", logging.EngineKey, "vault", logging.ErrorKey, err)
 		}
 	}
 
 	stringMap := convertToStringMap(mergedMap)
 
-	if err := subValues(stringMap, stringMap, envKeyPairs); err != nil {
+	if err := r.subValues(ctx, stringMap, envKeyPairs); err != nil {
 		return nil, err
 	}
 
+	// the secrets of previous resolutions have been replaced
+	if r.ownEngines {
+		r.engines.ReleaseReplaced()
+	}
 	return stringMap, nil
 }
 
@@ -136,141 +266,99 @@ func converOneArrayToStringMap(v []interface{}, i int) {
 	}
 }
 
-var re = regexp.MustCompile("\\$\\{(.*?)}")
-
-func subValues(fullMap OutputMap, subMap OutputMap, env StringMap) error {
-	//responsible for finding all variables that need to be substituted
-	loops := 0
-	for loops < len(subMap) {
-		loops++
-		for k, value := range subMap {
-			if err := processOneSubvalue(fullMap, subMap, env, value, k); err != nil {
-				return err
-			}
-		}
+// decrypt decrypts the secret found at the given key path. Secret engines get
+// the resolver's logger through their context. Structured secrets, such as
+// JSON objects stored in Vault, are returned as subtrees whose leaves are
+// strings.
+func (r *Resolver) decrypt(ctx context.Context, value string, path string) (interface{}, error) {
+	logger := r.logger.With(logging.KeyPathKey, path)
+	ctx = logging.NewContext(ctx, logger)
+	decrypter, err := r.engines.NewDecrypter(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	var secret interface{}
+	if sd, ok := decrypter.(secrets.StructuredDecrypter); ok {
+		secret, err = sd.DecryptValue(ctx)
+	} else {
+		secret, err = secrets.DecryptContext(ctx, decrypter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if secret, err = secretTree(secret); err != nil {
+		return nil, err
+	}
+	engine, _, _ := secrets.GetEngine(value)
+	logger.Debug("decrypted secret", logging.EngineKey, engine)
+	if r.onDecrypt != nil {
+		r.onDecrypt(path, decrypter)
+	}
+	if r.tracker != nil {
+		r.tracker.recordTree(path, secret)
 	}
-	return nil
+	return secret, nil
 }
 
-func processOneSubvalue(fullMap OutputMap, subMap OutputMap, env StringMap, value interface{}, k string) error {
-	var secret string
-	var decrypter secrets.Decrypter
-	var valueBytes []byte
-	switch value := value.(type) {
+// secretTree converts a structured secret to the types of a resolved
+// configuration, rendering its scalars as strings.
+func secretTree(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
 	case map[string]interface{}:
-		err := subValues(fullMap, value, env)
-		if err != nil {
-			return err
-		}
-	case []interface{}:
-		for i := 0; i < len(value); i++ {
-			err := processOneSubvalueFromArray(fullMap, value[:], env, value[i], i)
-			if err != nil {
-				return err
-			}
-		}
-	case string:
-		if secrets.IsEncryptedSecret(value) {
+		m := make(OutputMap, len(v))
+		for k, e := range v {
 			var err error
-			if decrypter, err = secrets.NewDecrypter(context.TODO(), value); err != nil {
-				return err
-			} else if secret, err = decrypter.Decrypt(); err != nil {
-				return err
+			if m[k], err = secretTree(e); err != nil {
+				return nil, err
 			}
-			subMap[k] = secret
-			return nil
-		}
-
-		valueBytes = []byte(value)
-		valueBytes = re.ReplaceAllFunc(valueBytes, func(key []byte) []byte {
-			i := len(key) - 1
-			myKey := string(key[2:i])
-			return []byte(resolveSubs(fullMap, myKey, env))
-		})
-		value = string(valueBytes)
-		subMap[k] = value
-	}
-	return nil
-}
-
-func processOneSubvalueFromArray(fullMap OutputMap, subslice []interface{}, env StringMap, value interface{}, k int) error {
-	var secret string
-	var decrypter secrets.Decrypter
-	var valueBytes []byte
-	switch value := value.(type) {
-	case map[string]interface{}:
-		err := subValues(fullMap, value, env)
-		if err != nil {
-			return err
 		}
+		return m, nil
 	case []interface{}:
-		for i := 0; i < len(value); i++ {
-			err := processOneSubvalueFromArray(fullMap, value[:], env, value[i], i)
-			if err != nil {
-				return err
-			}
-		}
-	case string:
-		if secrets.IsEncryptedSecret(value) {
+		l := make([]interface{}, len(v))
+		for i, e := range v {
 			var err error
-			if decrypter, err = secrets.NewDecrypter(context.TODO(), value); err != nil {
-				return err
-			} else if secret, err = decrypter.Decrypt(); err != nil {
-				return err
+			if l[i], err = secretTree(e); err != nil {
+				return nil, err
 			}
-			subslice[k] = secret
-			return nil
 		}
-
-		valueBytes = []byte(value)
-		valueBytes = re.ReplaceAllFunc(valueBytes, func(key []byte) []byte {
-			i := len(key) - 1
-			myKey := string(key[2:i])
-			return []byte(resolveSubs(fullMap, myKey, env))
-		})
-		value = string(valueBytes)
-		subslice[k] = value
-	}
-	return nil
-}
-
-func resolveSubs(m map[string]interface{}, keyToSub string, env map[string]string) string {
-	//this function returns array of tuples with their substituted values
-	//this handles the case of multiple substitutions in a value
-	//baseUrl: ${services.default.protocol}://${services.echo.host}:${services.echo.port}
-	keyDefaultSplit := strings.Split(keyToSub, ":")
-	subKey, defaultKey := keyDefaultSplit[0], keyDefaultSplit[0]
-	if len(keyDefaultSplit) == 2 {
-		defaultKey = keyDefaultSplit[1]
-	}
-
-	if v, err := valueFromFlatKey(subKey, m); err == nil {
-		defaultKey = v
-	} else if v, ok := env[subKey]; ok {
-		defaultKey = v
+		return l, nil
 	}
-
-	return defaultKey
+	return secrets.FormatValue(v)
 }
 
 var VFFKErrorNotFound = errors.New("not found")
-var VFFKErrorInvalidIntermediaryType = errors.New("expected map[string]interface{}")
+var VFFKErrorInvalidIntermediaryType = errors.New("expected map[string]interface{} or []interface{}")
 var VFFKErrorInvalidLeafType = errors.New("expected string or stringer()")
 
 func valueFromFlatKey(flatKey string, root map[string]interface{}) (string, error) {
-	fields := strings.Split(flatKey, ".")
+	path, err := ParsePath(flatKey)
+	if err != nil {
+		return "", fmt.Errorf("path %q was %w: %v", flatKey, VFFKErrorNotFound, err)
+	}
 	var currVal interface{} = root
-	var currMap OutputMap // pre-alloc OutputMap ref. Actually assigned & used in loop below
-	var ok bool
-	for i := range fields {
+	for i, elem := range path {
 		if currVal == nil {
 			return "", fmt.Errorf("path %q was %w", flatKey, VFFKErrorNotFound)
 		}
-		if currMap, ok = currVal.(OutputMap); !ok {
-			return "", fmt.Errorf("path %q was of type %T, %w", strings.Join(fields[:i], "."), currVal, VFFKErrorInvalidIntermediaryType)
-		}
-		if currVal, ok = currMap[fields[i]]; !ok {
-			return "", fmt.Errorf("path %q was %w", flatKey, VFFKErrorNotFound)
+		switch curr := currVal.(type) {
+		case OutputMap:
+			if elem.IsIndex {
+				return "", fmt.Errorf("path %q was of type %T, %w", formatPath(path[:i]), currVal, VFFKErrorInvalidIntermediaryType)
+			}
+			var ok bool
+			if currVal, ok = curr[elem.Key]; !ok {
+				return "", fmt.Errorf("path %q was %w", flatKey, VFFKErrorNotFound)
+			}
+		case []interface{}:
+			if !elem.IsIndex {
+				return "", fmt.Errorf("path %q was of type %T, %w", formatPath(path[:i]), currVal, VFFKErrorInvalidIntermediaryType)
+			}
+			if elem.Index >= len(curr) {
+				return "", fmt.Errorf("path %q was %w", flatKey, VFFKErrorNotFound)
+			}
+			currVal = curr[elem.Index]
+		default:
+			return "", fmt.Errorf("path %q was of type %T, %w", formatPath(path[:i]), currVal, VFFKErrorInvalidIntermediaryType)
 		}
 	}
 	switch v := currVal.(type) {
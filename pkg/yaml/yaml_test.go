@@ -1,6 +1,7 @@
 package yaml
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/armory/go-yaml-tools/pkg/secrets"
@@ -81,14 +82,14 @@ func TestSubValues(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		err := subValues(test.m, test.m, nil)
+		err := NewResolver().subValues(context.Background(), test.m, nil)
 		assert.Nil(t, err)
 		testValue := test.actual(test.m)
 		assert.Equal(t, test.expectedValue, testValue)
 	}
 }
 
-func TestResolveSubs(t *testing.T) {
+func TestEvaluate(t *testing.T) {
 	m := map[string]interface{}{
 		"mock": map[string]interface{}{
 			"flat": map[string]interface{}{
@@ -98,7 +99,9 @@ func TestResolveSubs(t *testing.T) {
 			},
 		},
 	}
-	str := resolveSubs(m, "mock.flat.otherkey.value", nil)
+	s := &substitution{ctx: context.Background(), r: NewResolver(), root: m, done: map[string]bool{}}
+	str, err := s.evaluate("mock.flat.otherkey.value")
+	assert.NoError(t, err)
 	assert.Equal(t, "mockValue", str)
 }
 
@@ -181,6 +184,31 @@ func TestResolver(t *testing.T) {
 
 }
 
+func TestResolverOwnsVaultConfig(t *testing.T) {
+	secrets.Engines.Unregister("vault")
+	defer secrets.Engines.Unregister("vault")
+	cfg := ObjectMap{"secrets": ObjectMap{"vault": ObjectMap{
+		"enabled":    true,
+		"url":        "https://vault.com",
+		"authMethod": "TOKEN",
+		"token":      "s.token",
+	}}}
+
+	r := NewResolver()
+	_, err := r.Resolve([]ObjectMap{cfg}, nil)
+	assert.NoError(t, err)
+	_, ok := r.engines.Lookup("vault")
+	assert.True(t, ok)
+	_, ok = secrets.Engines.Lookup("vault")
+	assert.False(t, ok, "the vault config of a resolver must not leak into the global registry")
+
+	// the package level Resolve keeps registering vault globally
+	_, err = Resolve([]ObjectMap{cfg}, nil)
+	assert.NoError(t, err)
+	_, ok = secrets.Engines.Lookup("vault")
+	assert.True(t, ok)
+}
+
 func TestResolverCollections(t *testing.T) {
 
 	fileNames := []string{